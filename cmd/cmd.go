@@ -4,12 +4,15 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"log/slog"
 	"math/rand/v2"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -17,12 +20,20 @@ import (
 
 	"github.com/decentrio/gateway/config"
 	"github.com/decentrio/gateway/gateway"
+	"github.com/decentrio/gateway/logging"
+	"github.com/decentrio/gateway/tracing"
 
 	tmservice "github.com/cosmos/cosmos-sdk/client/grpc/tmservice"
 )
 
 var configFile string
 
+// shutdownTracing flushes the spans not yet exported when the gateway stops.
+var shutdownTracing func(context.Context) error
+
+// startConfig is the configuration loaded for the start command.
+var startConfig *config.Config
+
 var rootCmd = &cobra.Command{
 	Use:   "gateway",
 	Short: "Gateway CLI",
@@ -47,17 +58,40 @@ var startCmd = &cobra.Command{
 			os.Exit(1)
 		}
 		// fmt.Printf("%+v\n", cfg)
-		config.SetConfig(cfg)
+		if err := logging.Setup(cfg.Log); err != nil {
+			fmt.Printf("Error setting up logging: %v\n", err)
+			os.Exit(1)
+		}
+		shutdownTracing, err = tracing.Setup(cfg.Tracing)
+		if err != nil {
+			fmt.Printf("Error setting up tracing: %v\n", err)
+			os.Exit(1)
+		}
+		startConfig = cfg
 	},
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Printf("Starting gateway with config file: %s\n", configFile)
-		gw, err := gateway.NewGateway(config.GetConfig())
+		slog.Info("Starting gateway", "config", configFile)
+		gw, err := gateway.New(startConfig)
 		if err != nil {
-			fmt.Printf("Error creating gateway: %v\n", err)
+			slog.Error("Error creating gateway", "err", err)
 			os.Exit(1)
 		}
 
-		gw.Start()
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		runErr := gw.Run(ctx)
+		if runErr != nil {
+			slog.Error("Gateway stopped with errors", "err", runErr)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			slog.Warn("Error flushing traces", "err", err)
+		}
+		if runErr != nil {
+			os.Exit(1)
+		}
 	},
 }
 
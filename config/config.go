@@ -1,19 +1,146 @@
 package config
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/url"
 	"os"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 type Node struct {
-	RPC        string   `yaml:"rpc"`
-	API        string   `yaml:"api"`
-	GRPC       string   `yaml:"grpc"`
-	JSONRPC    string   `yaml:"jsonrpc"`
-	JSONRPC_WS string   `yaml:"jsonrpc_ws"`
-	Blocks     []uint64 `yaml:"blocks"`
+	// Name identifies the node in the admin API. Defaults to node-<n>, n
+	// being the node's position in the list, starting from 1.
+	Name       string `yaml:"name,omitempty"`
+	RPC        string `yaml:"rpc"`
+	API        string `yaml:"api"`
+	GRPC       string `yaml:"grpc"`
+	JSONRPC    string `yaml:"jsonrpc"`
+	JSONRPC_WS string `yaml:"jsonrpc_ws"`
+	// Headers sent with the WebSocket handshake, e.g. Authorization or Origin.
+	JSONRPC_WS_Headers map[string]string `yaml:"jsonrpc_ws_headers,omitempty"`
+	Blocks             []uint64          `yaml:"blocks"`
+	// Share of the requests the node takes among the nodes serving the same
+	// heights. When none of them has a weight, the first one listed takes
+	// every request and the others are fallbacks, as are nodes without a
+	// weight among weighted ones.
+	Weight uint    `yaml:"weight,omitempty"`
+	TLS    NodeTLS `yaml:"tls,omitempty"`
+
+	// State is changed at runtime through the admin API.
+	State NodeState `yaml:"-"`
+}
+
+// NodeState tells whether a node is given new requests. Only enabled nodes
+// are; a draining node finishes the requests it already has.
+type NodeState string
+
+const (
+	NodeEnabled  NodeState = "enabled"
+	NodeDraining NodeState = "draining"
+	NodeDisabled NodeState = "disabled"
+)
+
+// Enabled reports whether the node is given new requests.
+func (n *Node) Enabled() bool {
+	return n.State == "" || n.State == NodeEnabled
+}
+
+// Endpoint returns the address of the node's endpoint for protocol (rpc, api,
+// grpc, jsonrpc or jsonrpc_ws).
+func (n *Node) Endpoint(protocol string) string {
+	switch protocol {
+	case "rpc":
+		return n.RPC
+	case "api":
+		return n.API
+	case "grpc":
+		return n.GRPC
+	case "jsonrpc":
+		return n.JSONRPC
+	case "jsonrpc_ws":
+		return n.JSONRPC_WS
+	}
+	return ""
+}
+
+// HeightRange describes the blocks held by the node: "x-y", "x-latest", or
+// "pruned" for a node keeping only recent blocks.
+func (n *Node) HeightRange() string {
+	switch {
+	case len(n.Blocks) == 1:
+		return "pruned"
+	case len(n.Blocks) == 2 && n.Blocks[1] == 0:
+		return fmt.Sprintf("%d-latest", n.Blocks[0])
+	case len(n.Blocks) == 2:
+		return fmt.Sprintf("%d-%d", n.Blocks[0], n.Blocks[1])
+	}
+	return "unknown"
+}
+
+// NodeTLS holds the TLS settings used to reach each endpoint of a node.
+type NodeTLS struct {
+	RPC        TLS `yaml:"rpc,omitempty"`
+	API        TLS `yaml:"api,omitempty"`
+	GRPC       TLS `yaml:"grpc,omitempty"`
+	JSONRPC    TLS `yaml:"jsonrpc,omitempty"`
+	JSONRPC_WS TLS `yaml:"jsonrpc_ws,omitempty"`
+}
+
+// TLS configures the connection to an upstream endpoint. Enable turns TLS on
+// for endpoints that would otherwise be dialed in plain text (gRPC addresses,
+// http:// and ws:// URLs); https:// and wss:// URLs always use TLS and only
+// take the other settings from here.
+type TLS struct {
+	Enable bool `yaml:"enable,omitempty"`
+	// CA bundle to verify the node's certificate with, instead of the system roots.
+	CAFile string `yaml:"ca_file,omitempty"`
+	// Client certificate presented to the node.
+	CertFile           string `yaml:"cert_file,omitempty"`
+	KeyFile            string `yaml:"key_file,omitempty"`
+	ServerName         string `yaml:"server_name,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify,omitempty"`
+}
+
+// ClientConfig loads the files referenced by t into a client tls.Config.
+func (t TLS) ClientConfig() (*tls.Config, error) {
+	c := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca_file: %w", err)
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in ca_file %s", t.CAFile)
+		}
+	}
+	if t.CertFile != "" || t.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
 }
 
 type Ports struct {
@@ -22,11 +149,295 @@ type Ports struct {
 	API        uint16 `yaml:"api"`
 	JSONRPC    uint16 `yaml:"jsonrpc"`
 	JSONRPC_WS uint16 `yaml:"jsonrpc_ws"`
+	// Prometheus /metrics endpoint, off when 0.
+	Metrics uint16 `yaml:"metrics,omitempty"`
+	// Admin API, off when 0. Requires admin.token.
+	Admin uint16 `yaml:"admin,omitempty"`
+}
+
+// Listen lists, for each server, the addresses it binds instead of ":<port>":
+// "host:port", or "unix:///path" for a Unix domain socket.
+type Listen struct {
+	RPC        []string `yaml:"rpc,omitempty"`
+	GRPC       []string `yaml:"grpc,omitempty"`
+	API        []string `yaml:"api,omitempty"`
+	JSONRPC    []string `yaml:"jsonrpc,omitempty"`
+	JSONRPC_WS []string `yaml:"jsonrpc_ws,omitempty"`
+	Metrics    []string `yaml:"metrics,omitempty"`
+	Admin      []string `yaml:"admin,omitempty"`
+}
+
+// ListenAddresses returns the addresses server binds: its listen list when
+// there is one, else ":<port>", or none when the server is off.
+func (cfg *Config) ListenAddresses(server string) []string {
+	var port uint16
+	var listen []string
+	switch server {
+	case "rpc":
+		port, listen = cfg.Ports.RPC, cfg.Listen.RPC
+	case "grpc":
+		port, listen = cfg.Ports.GRPC, cfg.Listen.GRPC
+	case "api":
+		port, listen = cfg.Ports.API, cfg.Listen.API
+	case "jsonrpc":
+		port, listen = cfg.Ports.JSONRPC, cfg.Listen.JSONRPC
+	case "jsonrpc_ws":
+		port, listen = cfg.Ports.JSONRPC_WS, cfg.Listen.JSONRPC_WS
+	case "metrics":
+		port, listen = cfg.Ports.Metrics, cfg.Listen.Metrics
+	case "admin":
+		port, listen = cfg.Ports.Admin, cfg.Listen.Admin
+	}
+	if len(listen) > 0 {
+		return listen
+	}
+	if port != 0 {
+		return []string{fmt.Sprintf(":%d", port)}
+	}
+	return nil
+}
+
+// ParseListenAddress returns the network and address to give net.Listen for a
+// listen address.
+func ParseListenAddress(addr string) (network, address string, err error) {
+	if path, ok := strings.CutPrefix(addr, "unix://"); ok {
+		if path == "" {
+			return "", "", fmt.Errorf("invalid listen address %q: missing socket path", addr)
+		}
+		return "unix", path, nil
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid listen address %q: %w", addr, err)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", "", fmt.Errorf("invalid listen address %q: invalid port", addr)
+	}
+	return "tcp", addr, nil
+}
+
+type GRPCOptions struct {
+	// Descriptor set files (protoc --descriptor_set_out, buf build -o) used
+	// alongside upstream reflection to find heights in gRPC requests.
+	DescriptorSets []string `yaml:"descriptor_sets,omitempty"`
+	// Origins allowed to make gRPC-Web and Connect calls from a browser.
+	// Defaults to any origin.
+	CORSAllowedOrigins []string `yaml:"cors_allowed_origins,omitempty"`
+}
+
+// ListenerTLS turns on TLS for a gateway listener. The files are read again
+// whenever they change, so certificates can be rotated without a restart.
+type ListenerTLS struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// Oldest TLS version accepted: "1.2" (default) or "1.3".
+	MinVersion string `yaml:"min_version,omitempty"`
+	// When set, clients must present a certificate signed by one of these CAs.
+	ClientCAFile string `yaml:"client_ca_file,omitempty"`
+}
+
+// MinTLSVersion returns the tls package constant for MinVersion.
+func (l *ListenerTLS) MinTLSVersion() (uint16, error) {
+	switch l.MinVersion {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported min_version %q", l.MinVersion)
+	}
+}
+
+// ServerTLS holds the TLS settings of each gateway listener; listeners
+// without settings serve plain text.
+type ServerTLS struct {
+	RPC        *ListenerTLS `yaml:"rpc,omitempty"`
+	API        *ListenerTLS `yaml:"api,omitempty"`
+	GRPC       *ListenerTLS `yaml:"grpc,omitempty"`
+	JSONRPC    *ListenerTLS `yaml:"jsonrpc,omitempty"`
+	JSONRPC_WS *ListenerTLS `yaml:"jsonrpc_ws,omitempty"`
+}
+
+// APIKey is a key clients present to use the gateway.
+type APIKey struct {
+	Name string `yaml:"name"`
+	Key  string `yaml:"key"`
+	// Keys are enabled unless set to false.
+	Enabled *bool `yaml:"enabled,omitempty"`
+	// Servers the key may be used on (rpc, api, grpc, jsonrpc, jsonrpc_ws).
+	// Empty means all of them.
+	Protocols []string `yaml:"protocols,omitempty"`
+	// Rate limit of the key, replacing the default one when set.
+	Rate  float64 `yaml:"rate,omitempty"`
+	Burst float64 `yaml:"burst,omitempty"`
+}
+
+func (k *APIKey) IsEnabled() bool {
+	return k.Enabled == nil || *k.Enabled
+}
+
+// Allows reports whether the key may be used on the server of protocol.
+func (k *APIKey) Allows(protocol string) bool {
+	return len(k.Protocols) == 0 || slices.Contains(k.Protocols, protocol)
+}
+
+// AuthOptions turns on API-key authentication for every server.
+type AuthOptions struct {
+	Enabled bool     `yaml:"enabled"`
+	Keys    []APIKey `yaml:"keys,omitempty"`
+	// YAML file holding more keys, as a list in the format of keys.
+	KeyFile string `yaml:"key_file,omitempty"`
+	// Header (or gRPC metadata) carrying the key. Defaults to X-API-Key;
+	// "Authorization: Bearer <key>" is accepted as well.
+	Header string `yaml:"header,omitempty"`
+	// Query parameter carrying the key. Defaults to api_key.
+	QueryParam string `yaml:"query_param,omitempty"`
+}
+
+// RateLimitOptions limits each client, identified by its API key or else its
+// IP address, with a token bucket.
+type RateLimitOptions struct {
+	Enabled bool `yaml:"enabled"`
+	// Tokens added to a client's bucket per second, and the bucket size.
+	// Burst defaults to Rate.
+	Rate  float64 `yaml:"rate"`
+	Burst float64 `yaml:"burst,omitempty"`
+	// Tokens taken by a request, by exact name or glob pattern: CometBFT routes
+	// ("tx_search"), Ethereum methods ("eth_getLogs"), REST paths
+	// ("/cosmos/tx/v1beta1/txs*") and gRPC full methods
+	// ("/cosmos.tx.v1beta1.Service/*"). Anything else costs 1.
+	Costs map[string]float64 `yaml:"costs,omitempty"`
+	// Header carrying the client address when the gateway runs behind a
+	// proxy, e.g. X-Forwarded-For. Each proxy appends the address it got the
+	// request from, so only the entries added by trusted proxies can be
+	// relied on: the one TrustedProxies places from the right is used.
+	ClientIPHeader string `yaml:"client_ip_header,omitempty"`
+	// Proxies in front of the gateway adding to ClientIPHeader. Defaults to 1,
+	// the right-most entry, added by the proxy the gateway is reached through.
+	TrustedProxies int `yaml:"trusted_proxies,omitempty"`
+
+	// costPatterns holds the keys of Costs in lexical order, set up when the
+	// configuration is stored.
+	costPatterns []string
+}
+
+// Cost returns the tokens taken by method, matched exactly first and then
+// against the glob patterns of Costs in lexical order.
+func (o *RateLimitOptions) Cost(method string) float64 {
+	if cost, ok := o.Costs[method]; ok {
+		return cost
+	}
+	for _, pattern := range o.costPatterns {
+		if ok, err := path.Match(pattern, method); err == nil && ok {
+			return o.Costs[pattern]
+		}
+	}
+	return 1
+}
+
+func (o *RateLimitOptions) sortCosts() {
+	o.costPatterns = make([]string, 0, len(o.Costs))
+	for pattern := range o.Costs {
+		o.costPatterns = append(o.costPatterns, pattern)
+	}
+	sort.Strings(o.costPatterns)
+}
+
+// MethodRules filters the calls a server forwards. Patterns are globs with
+// the syntax of path.Match on CometBFT routes ("dump_consensus_state"),
+// Ethereum methods ("debug_*"), REST paths ("/cosmos/tx/v1beta1/*") and gRPC
+// full methods ("/cosmos.tx.v1beta1.Service/*"). Deny wins over allow, and
+// an empty allow list allows everything not denied.
+type MethodRules struct {
+	Allow []string `yaml:"allow,omitempty"`
+	Deny  []string `yaml:"deny,omitempty"`
+}
+
+// ServerMethods holds the method rules of each server.
+type ServerMethods struct {
+	RPC        *MethodRules `yaml:"rpc,omitempty"`
+	API        *MethodRules `yaml:"api,omitempty"`
+	GRPC       *MethodRules `yaml:"grpc,omitempty"`
+	JSONRPC    *MethodRules `yaml:"jsonrpc,omitempty"`
+	JSONRPC_WS *MethodRules `yaml:"jsonrpc_ws,omitempty"`
+}
+
+// LogOptions configures the gateway's logger.
+type LogOptions struct {
+	// debug, info (default), warn or error.
+	Level string `yaml:"level,omitempty"`
+	// logfmt (default) or json.
+	Format string `yaml:"format,omitempty"`
+	// One line per finished request, logged at info level. On by default.
+	AccessLog *bool `yaml:"access_log,omitempty"`
+}
+
+// SlogLevel parses Level.
+func (o LogOptions) SlogLevel() (slog.Level, error) {
+	var level slog.Level
+	if o.Level == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := level.UnmarshalText([]byte(o.Level)); err != nil {
+		return 0, fmt.Errorf("invalid log level %q", o.Level)
+	}
+	return level, nil
+}
+
+// AccessLogEnabled reports whether access lines are logged.
+func (o LogOptions) AccessLogEnabled() bool {
+	return o.AccessLog == nil || *o.AccessLog
+}
+
+// TracingOptions configures the export of OpenTelemetry traces over OTLP.
+type TracingOptions struct {
+	Enabled bool `yaml:"enabled"`
+	// host:port of the collector. Defaults to the OTEL_EXPORTER_OTLP_*
+	// environment variables, then to localhost.
+	Endpoint string `yaml:"endpoint,omitempty"`
+	// grpc (default) or http.
+	Protocol string            `yaml:"protocol,omitempty"`
+	Insecure bool              `yaml:"insecure,omitempty"`
+	Headers  map[string]string `yaml:"headers,omitempty"`
+	// Share of new traces recorded, from 0 to 1 (default 1). Calls whose
+	// caller recorded them are always traced.
+	SampleRatio *float64 `yaml:"sample_ratio,omitempty"`
+	// Defaults to gateway.
+	ServiceName string `yaml:"service_name,omitempty"`
+}
+
+// AdminOptions protects the admin API.
+type AdminOptions struct {
+	// Token admin requests present as "Authorization: Bearer <token>".
+	Token string `yaml:"token,omitempty"`
+	// File holding the token, read when token is not set.
+	TokenFile string `yaml:"token_file,omitempty"`
+}
+
+// HealthOptions tunes the readiness the gateway reports on /readyz and
+// through the gRPC health service.
+type HealthOptions struct {
+	// Time the latest block may go without a newer one before the gateway is
+	// no longer ready. Defaults to 1m; a negative value disables the check.
+	MaxTipAge time.Duration `yaml:"max_tip_age,omitempty"`
+	// Interval at which the nodes serving the latest blocks are asked for
+	// their height. Defaults to 10s.
+	TipInterval time.Duration `yaml:"tip_interval,omitempty"`
 }
 
 type Config struct {
-	Upstream []Node `yaml:"upstream"`
-	Ports    Ports  `yaml:"ports"`
+	Upstream  []Node           `yaml:"upstream"`
+	Ports     Ports            `yaml:"ports"`
+	Listen    Listen           `yaml:"listen,omitempty"`
+	GRPC      GRPCOptions      `yaml:"grpc,omitempty"`
+	TLS       ServerTLS        `yaml:"tls,omitempty"`
+	Auth      AuthOptions      `yaml:"auth,omitempty"`
+	RateLimit RateLimitOptions `yaml:"rate_limit,omitempty"`
+	Methods   ServerMethods    `yaml:"methods,omitempty"`
+	Log       LogOptions       `yaml:"log,omitempty"`
+	Tracing   TracingOptions   `yaml:"tracing,omitempty"`
+	Admin     AdminOptions     `yaml:"admin,omitempty"`
+	Health    HealthOptions    `yaml:"health,omitempty"`
 }
 
 var DefaultConfig = Config{
@@ -36,7 +447,7 @@ var DefaultConfig = Config{
 			API:        "http://localhost:1317",
 			GRPC:       "localhost:9090",
 			JSONRPC:    "http://localhost:8545",
-			JSONRPC_WS: "http://localhost:8546/websocket",
+			JSONRPC_WS: "ws://localhost:8546",
 			Blocks:     []uint64{1, 1000},
 		},
 	},
@@ -49,8 +460,6 @@ var DefaultConfig = Config{
 	},
 }
 
-var cfg *Config
-
 func GenerateConfig() error {
 	data, err := yaml.Marshal(DefaultConfig)
 	if err != nil {
@@ -74,83 +483,380 @@ func LoadConfig(configPath string) (*Config, error) {
 		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
 	}
 
+	names := map[string]bool{}
 	for i, node := range config.Upstream {
 		if len(node.Blocks) > 2 {
 			return nil, fmt.Errorf("invalid blocks range for node %d", i+1)
 		}
+		name := config.NodeName(i)
+		if names[name] {
+			return nil, fmt.Errorf("duplicate node name %q", name)
+		}
+		names[name] = true
+		for protocol, settings := range node.TLS.byProtocol() {
+			if settings == (TLS{}) {
+				continue
+			}
+			if _, err := settings.ClientConfig(); err != nil {
+				return nil, fmt.Errorf("invalid %s tls for node %d: %w", protocol, i+1, err)
+			}
+		}
+	}
+
+	for protocol, settings := range map[string]*ListenerTLS{
+		"rpc": config.TLS.RPC, "api": config.TLS.API, "grpc": config.TLS.GRPC,
+		"jsonrpc": config.TLS.JSONRPC, "jsonrpc_ws": config.TLS.JSONRPC_WS,
+	} {
+		if settings == nil {
+			continue
+		}
+		if settings.CertFile == "" || settings.KeyFile == "" {
+			return nil, fmt.Errorf("invalid %s listener tls: cert_file and key_file are required", protocol)
+		}
+		if _, err := settings.MinTLSVersion(); err != nil {
+			return nil, fmt.Errorf("invalid %s listener tls: %w", protocol, err)
+		}
+	}
+
+	if config.Auth.KeyFile != "" {
+		data, err := os.ReadFile(config.Auth.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %w", err)
+		}
+		var keys []APIKey
+		if err := yaml.Unmarshal(data, &keys); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal key file: %w", err)
+		}
+		config.Auth.Keys = append(config.Auth.Keys, keys...)
+	}
+	for i, key := range config.Auth.Keys {
+		if key.Key == "" {
+			return nil, fmt.Errorf("api key %d (%s) has no key", i+1, key.Name)
+		}
+	}
+
+	if config.Admin.Token == "" && config.Admin.TokenFile != "" {
+		token, err := os.ReadFile(config.Admin.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read admin token file: %w", err)
+		}
+		config.Admin.Token = strings.TrimSpace(string(token))
+	}
+	for _, server := range []string{"rpc", "grpc", "api", "jsonrpc", "jsonrpc_ws", "metrics", "admin"} {
+		for _, addr := range config.ListenAddresses(server) {
+			if _, _, err := ParseListenAddress(addr); err != nil {
+				return nil, fmt.Errorf("%s server: %w", server, err)
+			}
+		}
+	}
+	if len(config.ListenAddresses("admin")) > 0 && config.Admin.Token == "" {
+		return nil, errors.New("the admin port requires an admin token")
+	}
+	if config.RateLimit.TrustedProxies < 0 {
+		return nil, fmt.Errorf("invalid rate_limit trusted_proxies %d", config.RateLimit.TrustedProxies)
+	}
+	if config.Health.TipInterval < 0 {
+		return nil, fmt.Errorf("invalid health tip_interval %s", config.Health.TipInterval)
+	}
+
+	if _, err := config.Log.SlogLevel(); err != nil {
+		return nil, err
+	}
+	if format := config.Log.Format; format != "" && format != "logfmt" && format != "json" {
+		return nil, fmt.Errorf("invalid log format %q", format)
+	}
+	if protocol := config.Tracing.Protocol; protocol != "" && protocol != "grpc" && protocol != "http" {
+		return nil, fmt.Errorf("invalid tracing protocol %q", protocol)
+	}
+	if ratio := config.Tracing.SampleRatio; ratio != nil && (*ratio < 0 || *ratio > 1) {
+		return nil, fmt.Errorf("invalid tracing sample_ratio %v", *ratio)
+	}
+
+	for protocol, rules := range map[string]*MethodRules{
+		"rpc": config.Methods.RPC, "api": config.Methods.API, "grpc": config.Methods.GRPC,
+		"jsonrpc": config.Methods.JSONRPC, "jsonrpc_ws": config.Methods.JSONRPC_WS,
+	} {
+		if rules == nil {
+			continue
+		}
+		for _, pattern := range append(slices.Clone(rules.Allow), rules.Deny...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid %s method pattern %q: %w", protocol, pattern, err)
+			}
+		}
 	}
 
 	return config, nil
 }
 
-func GetConfig() *Config {
-	return cfg
+// Store holds the configuration a gateway runs with. It is replaced as a
+// whole on every change, so that requests being routed keep a consistent view
+// of it.
+type Store struct {
+	current  atomic.Pointer[Config]
+	updateMu sync.Mutex
 }
 
-func SetConfig(config *Config) {
-	cfg = config
+// NewStore returns a store holding cfg.
+func NewStore(cfg *Config) *Store {
+	s := &Store{}
+	s.Set(cfg)
+	return s
 }
 
-func GetNodebyHeight(height uint64) *Node {
+// Get returns the current configuration.
+func (s *Store) Get() *Config {
+	return s.current.Load()
+}
+
+// Set replaces the configuration.
+func (s *Store) Set(cfg *Config) {
+	if cfg != nil {
+		cfg.RateLimit.sortCosts()
+	}
+	s.current.Store(cfg)
+}
+
+// NodeName returns the name of the node at index i of Upstream.
+func (c *Config) NodeName(i int) string {
+	if c.Upstream[i].Name != "" {
+		return c.Upstream[i].Name
+	}
+	return fmt.Sprintf("node-%d", i+1)
+}
+
+// ErrNodeNotFound is returned for a node name matching no upstream.
+var ErrNodeNotFound = errors.New("node not found")
+
+// UpdateNode applies update to the node called name. The configuration is
+// copied rather than changed in place, so requests being routed keep a
+// consistent view of it.
+func (s *Store) UpdateNode(name string, update func(n *Node) error) (Node, error) {
+	s.updateMu.Lock()
+	defer s.updateMu.Unlock()
+
+	old := s.Get()
+	i := -1
+	for j := range old.Upstream {
+		if old.NodeName(j) == name {
+			i = j
+			break
+		}
+	}
+	if i < 0 {
+		return Node{}, ErrNodeNotFound
+	}
+	next := *old
+	next.Upstream = slices.Clone(old.Upstream)
+	if err := update(&next.Upstream[i]); err != nil {
+		return Node{}, err
+	}
+	s.Set(&next)
+	return next.Upstream[i], nil
+}
+
+// NodesByHeight returns every enabled node able to serve height, in order of
+// preference: [x, y] and [x, 0] nodes holding the height, then pruned nodes
+// as a fallback.
+func (cfg *Config) NodesByHeight(height uint64) []*Node {
 	if height == 0 {
-		fmt.Println("find node for height is zero")
+		return cfg.LatestNodes()
+	}
+	var holding, pruned []*Node
+	for i := range cfg.Upstream {
+		n := &cfg.Upstream[i]
+		if !n.Enabled() {
+			continue
+		}
+		if len(n.Blocks) == 2 && height >= n.Blocks[0] && (n.Blocks[1] == 0 || height <= n.Blocks[1]) {
+			holding = append(holding, n)
+		} else if len(n.Blocks) == 1 {
+			pruned = append(pruned, n)
+		}
+	}
+	return append(weighted(holding), weighted(pruned)...)
+}
 
-		// prioritize [x] node
-		for _, n := range cfg.Upstream {
-			if len(n.Blocks) == 1 {
-				return &n
-			}
+// LatestNodes returns every enabled node able to serve the latest block:
+// pruned nodes first, then [x, 0] nodes.
+func (cfg *Config) LatestNodes() []*Node {
+	var pruned, open []*Node
+	for i := range cfg.Upstream {
+		n := &cfg.Upstream[i]
+		if !n.Enabled() {
+			continue
+		}
+		if len(n.Blocks) == 1 {
+			pruned = append(pruned, n)
+		} else if len(n.Blocks) == 2 && n.Blocks[1] == 0 {
+			open = append(open, n)
 		}
+	}
+	return append(weighted(pruned), weighted(open)...)
+}
 
-		// fallback: If no pruned nodes found, return [x, 0] node.
-		for _, n := range cfg.Upstream {
-			if len(n.Blocks) == 2 && n.Blocks[1] == 0 {
-				return &n
-			}
+// weighted moves a node picked at random in proportion to the weights to the
+// front of nodes, which are equally able to serve a request. The others keep
+// their order as fallbacks.
+func weighted(nodes []*Node) []*Node {
+	var total uint
+	for _, n := range nodes {
+		total += n.Weight
+	}
+	if total == 0 {
+		return nodes
+	}
+	pick := uint(rand.Uint64N(uint64(total)))
+	for i, n := range nodes {
+		if pick < n.Weight {
+			return append(append([]*Node{n}, nodes[:i]...), nodes[i+1:]...)
 		}
-	} else {
-		fmt.Println("find node for height ", height)
-
-		// prioritize [x, y] node
-		// for [x,y] nodes, if height is between x and y, return that node.
-		// for [x,0] nodes, if height is greater than x, return that node.
-		for _, n := range cfg.Upstream {
-			if len(n.Blocks) == 2 {
-				if n.Blocks[1] != 0 {
-					if height >= n.Blocks[0] && height <= n.Blocks[1] {
-						return &n
-					}
-				} else if height >= n.Blocks[0] {
-					return &n
-				}
+		pick -= n.Weight
+	}
+	return nodes
+}
+
+// NodeRange is the part [From, To] of a height range held by Node. To is 0 when
+// the range has no upper bound.
+type NodeRange struct {
+	Node *Node
+	From uint64
+	To   uint64
+}
+
+// SplitHeightRange divides [from, to] (to 0 meaning up to the latest block)
+// into consecutive, non-overlapping parts, each held by a single node. [x, y]
+// and [x, 0] nodes take the heights they cover; the pruned [x] node takes
+// whatever lies above them when no [x, 0] node exists. Heights held by no node
+// are left out.
+func (cfg *Config) SplitHeightRange(from, to uint64) []NodeRange {
+	var ranges []NodeRange
+	var pruned *Node
+	open, top := false, uint64(0)
+	for i := range cfg.Upstream {
+		n := &cfg.Upstream[i]
+		if !n.Enabled() {
+			continue
+		}
+		switch len(n.Blocks) {
+		case 1:
+			if pruned == nil {
+				pruned = n
+			}
+		case 2:
+			ranges = append(ranges, NodeRange{Node: n, From: n.Blocks[0], To: n.Blocks[1]})
+			if n.Blocks[1] == 0 {
+				open = true
+			} else {
+				top = max(top, n.Blocks[1])
 			}
 		}
+	}
+	if !open && pruned != nil {
+		ranges = append(ranges, NodeRange{Node: pruned, From: top + 1})
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].From < ranges[j].From })
 
-		// fallback: If no nodes found for the given height, return pruned node.
-		for _, n := range cfg.Upstream {
-			if len(n.Blocks) == 1 {
-				return &n
+	var parts []NodeRange
+	next := max(from, 1)
+	for _, r := range ranges {
+		if to != 0 && next > to {
+			break
+		}
+		part := NodeRange{Node: r.Node, From: max(r.From, next), To: r.To}
+		if to != 0 && (part.To == 0 || part.To > to) {
+			part.To = to
+		}
+		if part.To != 0 && part.From > part.To {
+			continue
+		}
+		parts = append(parts, part)
+		if part.To == 0 {
+			break
+		}
+		next = part.To + 1
+	}
+	return parts
+}
+
+func (t NodeTLS) byProtocol() map[string]TLS {
+	return map[string]TLS{"rpc": t.RPC, "api": t.API, "grpc": t.GRPC, "jsonrpc": t.JSONRPC, "jsonrpc_ws": t.JSONRPC_WS}
+}
+
+// EndpointTLS returns the TLS settings of the upstream endpoint, given as
+// configured (a URL, or host:port for gRPC). An endpoint not configured as is,
+// such as a URL with another path, is matched by host, as long as that host
+// belongs to a single node endpoint.
+func (cfg *Config) EndpointTLS(endpoint string) TLS {
+	_, settings := cfg.findEndpoint(endpoint)
+	return settings
+}
+
+// NodeByEndpoint returns the node an upstream endpoint belongs to, matched as
+// in EndpointTLS.
+func (cfg *Config) NodeByEndpoint(endpoint string) *Node {
+	node, _ := cfg.findEndpoint(endpoint)
+	return node
+}
+
+func (cfg *Config) findEndpoint(endpoint string) (*Node, TLS) {
+	type match struct {
+		node     *Node
+		settings TLS
+	}
+	host := endpointHost(endpoint)
+	var byHost []match
+	for i, n := range cfg.Upstream {
+		for _, e := range []struct {
+			addr     string
+			settings TLS
+		}{
+			{n.RPC, n.TLS.RPC},
+			{n.API, n.TLS.API},
+			{n.GRPC, n.TLS.GRPC},
+			{n.JSONRPC, n.TLS.JSONRPC},
+			{n.JSONRPC_WS, n.TLS.JSONRPC_WS},
+		} {
+			if e.addr == "" {
+				continue
+			}
+			if e.addr == endpoint {
+				return &cfg.Upstream[i], e.settings
+			}
+			if endpointHost(e.addr) == host {
+				byHost = append(byHost, match{&cfg.Upstream[i], e.settings})
 			}
 		}
 	}
+	if len(byHost) == 0 {
+		return nil, TLS{}
+	}
+	// A host shared by different nodes or settings is ambiguous.
+	for _, m := range byHost[1:] {
+		if m != byHost[0] {
+			return nil, TLS{}
+		}
+	}
+	return byHost[0].node, byHost[0].settings
+}
 
-	return nil
+func endpointHost(endpoint string) string {
+	if !strings.Contains(endpoint, "://") {
+		return endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return endpoint
+	}
+	return u.Host
 }
 
-func GetNodesByType(nodeType string) []string {
+// NodesByType returns the endpoint for nodeType of every enabled node.
+func (cfg *Config) NodesByType(nodeType string) []string {
 	nodes := []string{}
 	for _, node := range cfg.Upstream {
-		switch nodeType {
-		case "rpc":
-			nodes = append(nodes, node.RPC)
-		case "api":
-			nodes = append(nodes, node.API)
-		case "grpc":
-			nodes = append(nodes, node.GRPC)
-		case "jsonrpc":
-			nodes = append(nodes, node.JSONRPC)
-		case "jsonrpc_ws":
-			nodes = append(nodes, node.JSONRPC_WS)
+		if node.Enabled() {
+			nodes = append(nodes, node.Endpoint(nodeType))
 		}
 	}
 	return nodes
@@ -0,0 +1,61 @@
+package config_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/decentrio/gateway/config"
+)
+
+func TestNodeByEndpoint(t *testing.T) {
+	cfg := &config.Config{Upstream: []config.Node{
+		{Name: "a", RPC: "https://proxy.example:443/a", API: "http://a.example:1317"},
+		{Name: "b", RPC: "https://proxy.example:443/b", TLS: config.NodeTLS{RPC: config.TLS{Enable: true, ServerName: "b"}}},
+	}}
+
+	// Nodes behind one host are told apart by their full endpoint.
+	require.Equal(t, "a", cfg.NodeByEndpoint("https://proxy.example:443/a").Name)
+	require.Equal(t, "b", cfg.NodeByEndpoint("https://proxy.example:443/b").Name)
+	require.Equal(t, "b", cfg.EndpointTLS("https://proxy.example:443/b").ServerName)
+
+	// Other paths only match a host that belongs to a single endpoint.
+	require.Nil(t, cfg.NodeByEndpoint("https://proxy.example:443/c"))
+	require.Equal(t, "a", cfg.NodeByEndpoint("http://a.example:1317/cosmos/base/tendermint/v1beta1/blocks/latest").Name)
+	require.Nil(t, cfg.NodeByEndpoint("http://unknown.example:1317"))
+}
+
+func TestSplitHeightRange(t *testing.T) {
+	cfg := &config.Config{Upstream: []config.Node{
+		{Name: "pruned", Blocks: []uint64{500}},
+		{Name: "archive", Blocks: []uint64{1, 199}},
+		{Name: "middle", Blocks: []uint64{200, 399}},
+	}}
+	split := func(from, to uint64) (parts []string) {
+		for _, p := range cfg.SplitHeightRange(from, to) {
+			parts = append(parts, fmt.Sprintf("%s[%d,%d]", p.Node.Name, p.From, p.To))
+		}
+		return parts
+	}
+
+	require.Equal(t, []string{"archive[10,20]"}, split(10, 20))
+	require.Equal(t, []string{"archive[150,199]", "middle[200,250]"}, split(150, 250))
+	// The pruned node takes what lies above the bounded ones, open-ended.
+	require.Equal(t, []string{"archive[1,199]", "middle[200,399]", "pruned[400,0]"}, split(0, 0))
+	require.Equal(t, []string{"pruned[450,600]"}, split(450, 600))
+}
+
+func TestRateLimitCost(t *testing.T) {
+	cfg := &config.Config{RateLimit: config.RateLimitOptions{Costs: map[string]float64{
+		"eth_getLogs": 10,
+		"eth_*":       2,
+		"eth_get*":    3,
+	}}}
+	opts := &config.NewStore(cfg).Get().RateLimit
+
+	require.Equal(t, 10.0, opts.Cost("eth_getLogs"))
+	// Patterns are tried in lexical order.
+	require.Equal(t, 2.0, opts.Cost("eth_getBalance"))
+	require.Equal(t, 1.0, opts.Cost("net_version"))
+}
@@ -0,0 +1,258 @@
+package gateway
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/decentrio/gateway/config"
+	"github.com/decentrio/gateway/health"
+)
+
+// upstreamProtocols are the protocols a node may have an endpoint for.
+var upstreamProtocols = []string{"rpc", "api", "grpc", "jsonrpc", "jsonrpc_ws"}
+
+// adminNode is an upstream as listed by the admin API.
+type adminNode struct {
+	Name   string           `json:"name"`
+	State  config.NodeState `json:"state"`
+	Blocks []uint64         `json:"blocks"`
+	Range  string           `json:"range"`
+	Weight uint             `json:"weight"`
+	// Healthy is true when every endpoint of the node is.
+	Healthy  bool  `json:"healthy"`
+	InFlight int64 `json:"in_flight"`
+	// Drained is set once a draining node has no call left in flight.
+	Drained bool `json:"drained,omitempty"`
+	// Tip is the latest block seen from any endpoint of the node.
+	Tip       uint64                   `json:"tip,omitempty"`
+	Endpoints map[string]adminEndpoint `json:"endpoints"`
+}
+
+type adminEndpoint struct {
+	Address string `json:"address"`
+	Healthy bool   `json:"healthy"`
+	health.Status
+}
+
+// adminNodeUpdate holds the settings of a node changed by a PATCH request.
+type adminNodeUpdate struct {
+	Blocks []uint64 `json:"blocks"`
+	Weight *uint    `json:"weight"`
+}
+
+func (server *Server) startAdmin() error {
+	g := server.gw
+	g.log.Info("Starting admin server")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /upstreams", g.adminListNodes)
+	mux.HandleFunc("GET /upstreams/{name}", g.adminGetNode)
+	mux.HandleFunc("PATCH /upstreams/{name}", g.adminUpdateNode)
+	mux.HandleFunc("POST /upstreams/{name}/drain", g.adminSetNodeState(config.NodeDraining))
+	mux.HandleFunc("POST /upstreams/{name}/disable", g.adminSetNodeState(config.NodeDisabled))
+	mux.HandleFunc("POST /upstreams/{name}/enable", g.adminSetNodeState(config.NodeEnabled))
+	mux.HandleFunc("POST /caches/flush", g.adminFlushCaches)
+
+	srv := &http.Server{
+		Handler: g.requireAdminToken(mux),
+	}
+
+	return server.startHTTP(srv, nil)
+}
+
+// requireAdminToken lets through the requests bearing the admin token.
+func (g *Gateway) requireAdminToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		expected := g.cfg.Get().Admin.Token
+		if !ok || expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAdminError(w, http.StatusUnauthorized, "invalid admin token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeAdminJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, code int, message string) {
+	writeAdminJSON(w, code, map[string]string{"error": message})
+}
+
+// describeNode gathers what is known of the node at index i of cfg.
+func (g *Gateway) describeNode(cfg *config.Config, i int) adminNode {
+	node := &cfg.Upstream[i]
+	state := node.State
+	if state == "" {
+		state = config.NodeEnabled
+	}
+	n := adminNode{
+		Name:      cfg.NodeName(i),
+		State:     state,
+		Blocks:    node.Blocks,
+		Range:     node.HeightRange(),
+		Weight:    node.Weight,
+		Healthy:   true,
+		Endpoints: map[string]adminEndpoint{},
+	}
+	seen := map[string]bool{}
+	for _, protocol := range upstreamProtocols {
+		endpoint := node.Endpoint(protocol)
+		if endpoint == "" {
+			continue
+		}
+		addr := endpointAddr(protocol, endpoint)
+		status := g.health.Get(addr)
+		healthy := status.Breaker == health.BreakerClosed
+		if protocol == "grpc" {
+			healthy = healthy && g.pool.Healthy(addr)
+		}
+		n.Endpoints[protocol] = adminEndpoint{Address: addr, Healthy: healthy, Status: status}
+		n.Healthy = n.Healthy && healthy
+		n.Tip = max(n.Tip, status.Tip)
+		// Endpoints sharing an address share their calls.
+		if !seen[addr] {
+			seen[addr] = true
+			n.InFlight += status.InFlight
+		}
+	}
+	n.Drained = state == config.NodeDraining && n.InFlight == 0
+	return n
+}
+
+func (g *Gateway) adminListNodes(w http.ResponseWriter, r *http.Request) {
+	cfg := g.cfg.Get()
+	nodes := make([]adminNode, len(cfg.Upstream))
+	for i := range cfg.Upstream {
+		nodes[i] = g.describeNode(cfg, i)
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]any{"upstreams": nodes})
+}
+
+// writeNode answers with the node called name.
+func (g *Gateway) writeNode(w http.ResponseWriter, name string) {
+	cfg := g.cfg.Get()
+	for i := range cfg.Upstream {
+		if cfg.NodeName(i) == name {
+			writeAdminJSON(w, http.StatusOK, g.describeNode(cfg, i))
+			return
+		}
+	}
+	writeAdminError(w, http.StatusNotFound, config.ErrNodeNotFound.Error())
+}
+
+func (g *Gateway) adminGetNode(w http.ResponseWriter, r *http.Request) {
+	g.writeNode(w, r.PathValue("name"))
+}
+
+func (g *Gateway) adminUpdateNode(w http.ResponseWriter, r *http.Request) {
+	var update adminNodeUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeAdminError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+		return
+	}
+	if update.Blocks == nil && update.Weight == nil {
+		writeAdminError(w, http.StatusBadRequest, "nothing to update: set blocks or weight")
+		return
+	}
+	if update.Blocks != nil {
+		if err := validateBlocks(update.Blocks); err != nil {
+			writeAdminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	name := r.PathValue("name")
+	node, err := g.cfg.UpdateNode(name, func(n *config.Node) error {
+		if update.Blocks != nil {
+			n.Blocks = update.Blocks
+		}
+		if update.Weight != nil {
+			n.Weight = *update.Weight
+		}
+		return nil
+	})
+	if !adminUpdated(w, err) {
+		return
+	}
+	g.log.Info("Upstream updated", "node", name, "range", node.HeightRange(), "weight", node.Weight)
+	g.writeNode(w, name)
+}
+
+// validateBlocks checks a height range given in the format of the blocks
+// setting: [x] for a pruned node, [x, y] or [x, 0] up to the latest block.
+func validateBlocks(blocks []uint64) error {
+	switch {
+	case len(blocks) == 0 || len(blocks) > 2:
+		return errors.New("blocks must be [x], [x, y] or [x, 0]")
+	case len(blocks) == 2 && blocks[1] != 0 && blocks[0] > blocks[1]:
+		return fmt.Errorf("invalid blocks range %d-%d", blocks[0], blocks[1])
+	}
+	return nil
+}
+
+func adminUpdated(w http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, config.ErrNodeNotFound):
+		writeAdminError(w, http.StatusNotFound, err.Error())
+		return false
+	case err != nil:
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return false
+	}
+	return true
+}
+
+// adminSetNodeState moves a node to state. Draining and disabling both stop
+// new requests; disabling also closes the node's pooled gRPC and WebSocket
+// connections at once, moving its subscriptions to other nodes. Enabling a
+// node closes its breakers, so that it gets requests again straight away.
+func (g *Gateway) adminSetNodeState(state config.NodeState) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		node, err := g.cfg.UpdateNode(name, func(n *config.Node) error {
+			n.State = state
+			return nil
+		})
+		if !adminUpdated(w, err) {
+			return
+		}
+
+		switch state {
+		case config.NodeDisabled:
+			if node.GRPC != "" {
+				g.pool.CloseGRPCConn(node.GRPC)
+			}
+			if node.JSONRPC_WS != "" {
+				g.wsPool.closeNode(node.JSONRPC_WS)
+				g.wsHub.closeUpstream(node.JSONRPC_WS)
+			}
+		case config.NodeEnabled:
+			for _, protocol := range upstreamProtocols {
+				if endpoint := node.Endpoint(protocol); endpoint != "" {
+					g.health.Reset(endpointAddr(protocol, endpoint))
+				}
+			}
+		}
+		g.log.Info("Upstream state changed", "node", name, "state", state)
+		g.writeNode(w, name)
+	}
+}
+
+// adminFlushCaches drops the reverse proxies and TLS transports kept for the
+// upstreams and reloads the gRPC descriptors from them.
+func (g *Gateway) adminFlushCaches(w http.ResponseWriter, r *http.Request) {
+	g.http.FlushCaches()
+	g.grpcDescriptors.load(g.cfg.Get())
+	g.log.Info("Caches flushed")
+	writeAdminJSON(w, http.StatusOK, map[string]any{"flushed": []string{"http_proxies", "grpc_descriptors"}})
+}
@@ -0,0 +1,156 @@
+package gateway_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/decentrio/gateway/config"
+)
+
+func TestAdminUpstreams(t *testing.T) {
+	release := make(chan struct{})
+	var failing atomic.Bool
+	newUpstream := func(name string) *httptest.Server {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				<-release
+			}
+			if name == "a" && failing.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte(name))
+		}))
+		t.Cleanup(upstream.Close)
+		return upstream
+	}
+	a, b := newUpstream("a"), newUpstream("b")
+
+	gw := startGateway(t, &config.Config{
+		Upstream: []config.Node{
+			{Name: "a", API: a.URL, Blocks: []uint64{1, 0}},
+			{Name: "b", API: b.URL, Blocks: []uint64{1, 0}},
+		},
+		Admin: config.AdminOptions{Token: "secret"},
+	}, listenOn(t, "api"), listenOn(t, "admin"))
+	api, adminServer := &gw.API_Server, &gw.Admin_Server
+
+	get := func(path string) string {
+		var res *http.Response
+		require.Eventually(t, func() bool {
+			var err error
+			res, err = http.Get(fmt.Sprintf("http://127.0.0.1:%d%s", api.Port, path))
+			return err == nil
+		}, 5*time.Second, 10*time.Millisecond)
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+	admin := func(method, path, token, body string) (int, map[string]any) {
+		req, err := http.NewRequest(method, fmt.Sprintf("http://127.0.0.1:%d%s", adminServer.Port, path), strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		var res *http.Response
+		require.Eventually(t, func() bool {
+			res, err = http.DefaultClient.Do(req)
+			return err == nil
+		}, 5*time.Second, 10*time.Millisecond)
+		defer res.Body.Close()
+		var reply map[string]any
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&reply))
+		return res.StatusCode, reply
+	}
+
+	code, _ := admin(http.MethodGet, "/upstreams", "wrong", "")
+	require.Equal(t, http.StatusUnauthorized, code)
+
+	code, reply := admin(http.MethodGet, "/upstreams", "secret", "")
+	require.Equal(t, http.StatusOK, code)
+	nodes := reply["upstreams"].([]any)
+	require.Len(t, nodes, 2)
+	node := nodes[0].(map[string]any)
+	require.Equal(t, "a", node["name"])
+	require.Equal(t, "enabled", node["state"])
+	require.Equal(t, "1-latest", node["range"])
+	require.Equal(t, true, node["healthy"])
+	require.Equal(t, "closed", node["endpoints"].(map[string]any)["api"].(map[string]any)["breaker"])
+	require.Equal(t, "a", get("/params"))
+
+	t.Run("drain lets calls in flight finish", func(t *testing.T) {
+		slow := make(chan string)
+		go func() { slow <- get("/slow") }()
+		require.Eventually(t, func() bool {
+			_, node := admin(http.MethodGet, "/upstreams/a", "secret", "")
+			return node["in_flight"] == 1.0
+		}, 5*time.Second, 10*time.Millisecond)
+
+		code, node := admin(http.MethodPost, "/upstreams/a/drain", "secret", "")
+		require.Equal(t, http.StatusOK, code)
+		require.Equal(t, "draining", node["state"])
+		require.Nil(t, node["drained"])
+		require.Equal(t, "b", get("/params"))
+
+		close(release)
+		require.Equal(t, "a", <-slow)
+		_, node = admin(http.MethodGet, "/upstreams/a", "secret", "")
+		require.Equal(t, true, node["drained"])
+
+		code, node = admin(http.MethodPost, "/upstreams/a/enable", "secret", "")
+		require.Equal(t, http.StatusOK, code)
+		require.Equal(t, "enabled", node["state"])
+		require.Equal(t, "a", get("/params"))
+	})
+
+	t.Run("disable", func(t *testing.T) {
+		admin(http.MethodPost, "/upstreams/a/disable", "secret", "")
+		require.Equal(t, "b", get("/params"))
+		admin(http.MethodPost, "/upstreams/a/enable", "secret", "")
+		require.Equal(t, "a", get("/params"))
+	})
+
+	t.Run("update", func(t *testing.T) {
+		code, node := admin(http.MethodPatch, "/upstreams/a", "secret", `{"blocks":[1,10],"weight":3}`)
+		require.Equal(t, http.StatusOK, code)
+		require.Equal(t, "1-10", node["range"])
+		require.Equal(t, 3.0, node["weight"])
+		require.Equal(t, "b", get("/params"))
+
+		code, _ = admin(http.MethodPatch, "/upstreams/a", "secret", `{"blocks":[10,1]}`)
+		require.Equal(t, http.StatusBadRequest, code)
+		code, _ = admin(http.MethodPatch, "/upstreams/c", "secret", `{"weight":1}`)
+		require.Equal(t, http.StatusNotFound, code)
+
+		code, _ = admin(http.MethodPatch, "/upstreams/a", "secret", `{"blocks":[1,0],"weight":0}`)
+		require.Equal(t, http.StatusOK, code)
+		require.Equal(t, "a", get("/params"))
+	})
+
+	t.Run("breaker opens on failures", func(t *testing.T) {
+		failing.Store(true)
+		for range 5 {
+			get("/params")
+		}
+		_, node := admin(http.MethodGet, "/upstreams/a", "secret", "")
+		require.Equal(t, false, node["healthy"])
+		require.Equal(t, "open", node["endpoints"].(map[string]any)["api"].(map[string]any)["breaker"])
+		require.Equal(t, "b", get("/params"))
+
+		failing.Store(false)
+		admin(http.MethodPost, "/upstreams/a/enable", "secret", "")
+		require.Equal(t, "a", get("/params"))
+	})
+
+	code, reply = admin(http.MethodPost, "/caches/flush", "secret", "")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, []any{"http_proxies", "grpc_descriptors"}, reply["flushed"])
+}
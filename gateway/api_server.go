@@ -8,92 +8,39 @@ import (
 	"slices"
 	"strconv"
 	"strings"
-	"sync/atomic"
 	"time"
 
 	"github.com/decentrio/gateway/config"
-	httpUtils "github.com/decentrio/gateway/utils"
 )
 
-var (
-	apiServers            = make(map[uint16]*http.Server)
-	activeAPIRequestCount int32
-)
-
-func Start_API_Server(server *Server) {
-	fmt.Printf("Starting API server on port %d\n", server.Port)
+func (server *Server) startAPI() error {
+	g := server.gw
+	g.log.Info("Starting API server")
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", server.handleAPIRequest)
 
 	srv := &http.Server{
-		Addr:    fmt.Sprintf(":%d", server.Port),
-		Handler: mux,
-	}
-
-	mu.Lock()
-	apiServers[server.Port] = srv
-	mu.Unlock()
-
-	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		fmt.Printf("Failed to start API server: %v\n", err)
-	}
-}
-
-func Shutdown_API_Server(server *Server) {
-	mu.Lock()
-	srv, exists := apiServers[server.Port]
-	if !exists {
-		mu.Unlock()
-		fmt.Println("API server is not running.")
-		return
-	}
-	delete(apiServers, server.Port)
-	mu.Unlock()
-
-	fmt.Printf("Waiting for %d active requests to complete before shutting down API server...\n", atomic.LoadInt32(&activeAPIRequestCount))
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	done := make(chan struct{})
-	go func() {
-		wg.Wait()
-		close(done)
-	}()
-
-	select {
-	case <-done:
-		fmt.Println("All API requests completed. Proceeding with shutdown...")
-	case <-ctx.Done():
-		fmt.Println("[WARNING] Timeout waiting for API requests. Forcing shutdown...")
+		Handler: g.instrumentHTTP("api", g.withProbes(g.withMiddleware(g.requireAPIKey("api", rejectREST, g.filterMethods("api", rejectREST, g.rateLimit("api", rejectREST, mux)))))),
 	}
 
-	if err := srv.Shutdown(ctx); err != nil {
-		fmt.Printf("Error shutting down API server: %v\n", err)
-	} else {
-		fmt.Println("API server stopped.")
-	}
+	return server.startHTTP(srv, g.cfg.Get().TLS.API)
 }
 
 func (server *Server) handleAPIRequest(w http.ResponseWriter, r *http.Request) {
+	g := server.gw
 	ctx, cancel := context.WithTimeout(r.Context(), 60*time.Second)
 	defer cancel()
 
-	select {
-	case semaphore <- struct{}{}:
-		defer func() { <-semaphore }()
-	case <-ctx.Done():
+	if !g.acquireSemaphore(ctx) {
 		http.Error(w, "Server busy, please try again later", http.StatusTooManyRequests)
 		return
 	}
-	atomic.AddInt32(&activeAPIRequestCount, 1)
-	wg.Add(1)
-	defer func() {
-		wg.Done()
-		atomic.AddInt32(&activeAPIRequestCount, -1)
-	}()
+	defer func() { <-g.semaphore }()
+	server.requests.begin()
+	defer server.requests.end()
 
-	fmt.Printf("Received API query: %s\n", r.URL.Path)
+	g.log.DebugContext(r.Context(), "Received API query", "path", r.URL.Path)
 	var node *config.Node
 	var height uint64 = 0
 	var err error
@@ -130,14 +77,14 @@ func (server *Server) handleAPIRequest(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	node = config.GetNodebyHeight(height)
+	node = g.routeByHeight(r.Context(), height)
 	if node == nil {
 		http.Error(w, "No node found", http.StatusNotFound)
 		return
 	} else {
-		fmt.Println("Node called: ", node.API)
+		g.log.DebugContext(r.Context(), "Node called", "upstream", node.API)
 	}
-	httpUtils.FowardRequest(w, r, node.API)
+	g.http.FowardRequest(w, r, node.API)
 }
 
 func GetHeightFromURL(rawURL string) (string, error) {
@@ -1,8 +1,17 @@
 package gateway_test
 
 import (
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/decentrio/gateway/config"
 	"github.com/decentrio/gateway/gateway"
 	"github.com/stretchr/testify/require"
 )
@@ -31,3 +40,42 @@ func TestGetHeightFromURL(t *testing.T) {
 	}
 
 }
+
+func TestAPIUpstreamTLS(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"block":{}}`))
+	}))
+	defer upstream.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw}), 0o600))
+	plainURL := "http" + strings.TrimPrefix(upstream.URL, "https")
+
+	testcases := []struct {
+		name      string
+		api       string
+		tls       config.TLS
+		expStatus int
+	}{
+		{name: "untrusted certificate", api: upstream.URL, expStatus: http.StatusBadGateway},
+		{name: "certificate verified against ca_file", api: upstream.URL, tls: config.TLS{CAFile: caFile}, expStatus: http.StatusOK},
+		{name: "http upgraded to https when enabled", api: plainURL, tls: config.TLS{Enable: true, CAFile: caFile}, expStatus: http.StatusOK},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			gw := startGateway(t, &config.Config{
+				Upstream: []config.Node{{API: tc.api, Blocks: []uint64{1, 0}, TLS: config.NodeTLS{API: tc.tls}}},
+			}, listenOn(t, "api"))
+			server := &gw.API_Server
+
+			url := fmt.Sprintf("http://127.0.0.1:%d/cosmos/base/tendermint/v1beta1/blocks/latest", server.Port)
+			var res *http.Response
+			require.Eventually(t, func() bool {
+				var err error
+				res, err = http.Get(url)
+				return err == nil
+			}, 5*time.Second, 10*time.Millisecond)
+			defer res.Body.Close()
+			require.Equal(t, tc.expStatus, res.StatusCode)
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package gateway
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/decentrio/gateway/config"
+)
+
+const (
+	defaultAPIKeyHeader     = "X-API-Key"
+	defaultAPIKeyQueryParam = "api_key"
+)
+
+// rejectFunc answers a request refused by the gateway itself, in the format
+// of the server's protocol.
+type rejectFunc func(w http.ResponseWriter, r *http.Request, st *status.Status)
+
+type apiKeyNameKey struct{}
+
+// apiKeyName returns the name of the API key the request was authenticated
+// with, if any.
+func apiKeyName(ctx context.Context) (string, bool) {
+	name, ok := ctx.Value(apiKeyNameKey{}).(string)
+	return name, ok
+}
+
+func (g *Gateway) authOptions() *config.AuthOptions {
+	cfg := g.cfg.Get()
+	if cfg == nil || !cfg.Auth.Enabled {
+		return nil
+	}
+	return &cfg.Auth
+}
+
+// authenticate checks key against the configured keys for the server of
+// protocol. It fails with Unauthenticated for missing, unknown or disabled
+// keys and with PermissionDenied for keys not allowed on protocol.
+func authenticate(auth *config.AuthOptions, protocol, key string) (*config.APIKey, error) {
+	if key == "" {
+		return nil, status.Error(codes.Unauthenticated, "missing API key")
+	}
+	apiKey := findAPIKey(auth, key)
+	if apiKey == nil || !apiKey.IsEnabled() {
+		return nil, status.Error(codes.Unauthenticated, "invalid API key")
+	}
+	if !apiKey.Allows(protocol) {
+		return nil, status.Errorf(codes.PermissionDenied, "API key %q is not allowed on %s", apiKey.Name, protocol)
+	}
+	return apiKey, nil
+}
+
+func findAPIKey(auth *config.AuthOptions, key string) *config.APIKey {
+	var found *config.APIKey
+	for i := range auth.Keys {
+		if subtle.ConstantTimeCompare([]byte(auth.Keys[i].Key), []byte(key)) == 1 && found == nil {
+			found = &auth.Keys[i]
+		}
+	}
+	return found
+}
+
+// takeHTTPAPIKey returns the key presented with r, looking at the key header,
+// an "Authorization: Bearer" header, the key query parameter and finally the
+// first path segment. The key is removed from r so that it never reaches an
+// upstream.
+func takeHTTPAPIKey(auth *config.AuthOptions, r *http.Request) string {
+	header := auth.Header
+	if header == "" {
+		header = defaultAPIKeyHeader
+	}
+	param := auth.QueryParam
+	if param == "" {
+		param = defaultAPIKeyQueryParam
+	}
+
+	if key := r.Header.Get(header); key != "" {
+		r.Header.Del(header)
+		return key
+	}
+	if key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		r.Header.Del("Authorization")
+		return key
+	}
+	if q := r.URL.Query(); q.Has(param) {
+		key := q.Get(param)
+		q.Del(param)
+		r.URL.RawQuery = q.Encode()
+		return key
+	}
+	segment, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if segment != "" && findAPIKey(auth, segment) != nil {
+		r.URL.Path = "/" + rest
+		r.URL.RawPath = ""
+		return segment
+	}
+	return ""
+}
+
+// requireAPIKey authenticates the requests of the server of protocol before
+// handing them to next. reject writes the error in the protocol's format.
+func (g *Gateway) requireAPIKey(protocol string, reject rejectFunc, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := g.authOptions()
+		if auth == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		apiKey, err := authenticate(auth, protocol, takeHTTPAPIKey(auth, r))
+		if err != nil {
+			reject(w, r, status.Convert(err))
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyNameKey{}, apiKey.Name)))
+	})
+}
+
+func rejectHTTPStatus(st *status.Status) int {
+	switch st.Code() {
+	case codes.PermissionDenied, codes.Unimplemented:
+		return http.StatusForbidden
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusUnauthorized
+	}
+}
+
+// rejectHTTP answers with a plain-text HTTP error.
+func rejectHTTP(w http.ResponseWriter, _ *http.Request, st *status.Status) {
+	http.Error(w, st.Message(), rejectHTTPStatus(st))
+}
+
+// rejectREST answers in the error format of the Cosmos REST API.
+func rejectREST(w http.ResponseWriter, _ *http.Request, st *status.Status) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(rejectHTTPStatus(st))
+	json.NewEncoder(w).Encode(map[string]any{"code": st.Code(), "message": st.Message(), "details": []any{}})
+}
+
+// rejectJSONRPC answers with a JSON-RPC error.
+func rejectJSONRPC(w http.ResponseWriter, _ *http.Request, st *status.Status) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(rejectHTTPStatus(st))
+	json.NewEncoder(w).Encode(JSONRPCResponse{
+		JSONRPC: "2.0",
+		ID:      cloneRawMessage(nullJSONRPCID),
+		Error:   &JSONRPCError{Code: jsonRPCErrorCode(st), Message: st.Message()},
+	})
+}
+
+func jsonRPCErrorCode(st *status.Status) int {
+	switch st.Code() {
+	case codes.ResourceExhausted:
+		return jsonRPCLimitExceeded
+	case codes.Unimplemented:
+		return jsonRPCMethodNotFound
+	default:
+		return jsonRPCUnauthorized
+	}
+}
+
+// rejectRPC answers CometBFT URI requests with an HTTP error and JSON-RPC
+// requests with a JSON-RPC error.
+func rejectRPC(w http.ResponseWriter, r *http.Request, st *status.Status) {
+	if r.Method == http.MethodPost {
+		rejectJSONRPC(w, r, st)
+		return
+	}
+	rejectHTTP(w, r, st)
+}
+
+// grpcAuthContext authenticates the call of ctx, returning a context whose
+// incoming metadata no longer carries the key.
+func (g *Gateway) grpcAuthContext(ctx context.Context) (context.Context, error) {
+	auth := g.authOptions()
+	if auth == nil {
+		return ctx, nil
+	}
+	header := strings.ToLower(auth.Header)
+	if header == "" {
+		header = strings.ToLower(defaultAPIKeyHeader)
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	md = md.Copy()
+	var key string
+	if values := md.Get(header); len(values) > 0 {
+		key = values[0]
+		md.Delete(header)
+	} else if values := md.Get("authorization"); len(values) > 0 && strings.HasPrefix(values[0], "Bearer ") {
+		key = strings.TrimPrefix(values[0], "Bearer ")
+		md.Delete("authorization")
+	}
+
+	apiKey, err := authenticate(auth, "grpc", key)
+	if err != nil {
+		return nil, err
+	}
+	ctx = metadata.NewIncomingContext(ctx, md)
+	return context.WithValue(ctx, apiKeyNameKey{}, apiKey.Name), nil
+}
+
+func (g *Gateway) authUnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if isHealthMethod(info.FullMethod) {
+		return handler(ctx, req)
+	}
+	ctx, err := g.grpcAuthContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (g *Gateway) authStreamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if isHealthMethod(info.FullMethod) {
+		return handler(srv, ss)
+	}
+	ctx, err := g.grpcAuthContext(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &contextServerStream{ServerStream: ss, ctx: ctx})
+}
+
+// contextServerStream replaces the context of a server stream.
+type contextServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextServerStream) Context() context.Context {
+	return s.ctx
+}
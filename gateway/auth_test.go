@@ -0,0 +1,184 @@
+package gateway_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/decentrio/gateway/config"
+	"github.com/decentrio/gateway/gateway"
+)
+
+func testAuth() config.AuthOptions {
+	disabled := false
+	return config.AuthOptions{
+		Enabled: true,
+		Keys: []config.APIKey{
+			{Name: "alice", Key: "alice-key"},
+			{Name: "old", Key: "old-key", Enabled: &disabled},
+			{Name: "grpc-only", Key: "grpc-key", Protocols: []string{"grpc"}},
+		},
+	}
+}
+
+func TestAPIKeyAuthenticationOverHTTP(t *testing.T) {
+	type seen struct {
+		path, query, header string
+	}
+	requests := make(chan seen, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- seen{r.URL.Path, r.URL.RawQuery, r.Header.Get("X-API-Key") + r.Header.Get("Authorization")}
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	gw := startGateway(t, &config.Config{
+		Upstream: []config.Node{{API: upstream.URL, Blocks: []uint64{1, 0}}},
+		Auth:     testAuth(),
+	}, listenOn(t, "api"))
+	server := &gw.API_Server
+	base := fmt.Sprintf("http://127.0.0.1:%d", server.Port)
+
+	testcases := []struct {
+		name      string
+		path      string
+		header    map[string]string
+		expStatus int
+		expPath   string
+		expQuery  string
+	}{
+		{name: "missing key", path: "/cosmos/base/tendermint/v1beta1/blocks/latest", expStatus: http.StatusUnauthorized},
+		{name: "unknown key", path: "/cosmos/base/tendermint/v1beta1/blocks/latest", header: map[string]string{"X-API-Key": "nope"}, expStatus: http.StatusUnauthorized},
+		{name: "disabled key", path: "/cosmos/base/tendermint/v1beta1/blocks/latest", header: map[string]string{"X-API-Key": "old-key"}, expStatus: http.StatusUnauthorized},
+		{name: "key of another protocol", path: "/cosmos/base/tendermint/v1beta1/blocks/latest", header: map[string]string{"X-API-Key": "grpc-key"}, expStatus: http.StatusForbidden},
+		{name: "header", path: "/cosmos/base/tendermint/v1beta1/blocks/latest", header: map[string]string{"X-API-Key": "alice-key"}, expStatus: http.StatusOK, expPath: "/cosmos/base/tendermint/v1beta1/blocks/latest"},
+		{name: "bearer token", path: "/cosmos/base/tendermint/v1beta1/blocks/latest", header: map[string]string{"Authorization": "Bearer alice-key"}, expStatus: http.StatusOK, expPath: "/cosmos/base/tendermint/v1beta1/blocks/latest"},
+		{name: "query param", path: "/cosmos/base/tendermint/v1beta1/blocks/latest?api_key=alice-key&x=1", expStatus: http.StatusOK, expPath: "/cosmos/base/tendermint/v1beta1/blocks/latest", expQuery: "x=1"},
+		{name: "path prefix", path: "/alice-key/cosmos/base/tendermint/v1beta1/blocks/latest", expStatus: http.StatusOK, expPath: "/cosmos/base/tendermint/v1beta1/blocks/latest"},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, base+tc.path, nil)
+			require.NoError(t, err)
+			for k, v := range tc.header {
+				req.Header.Set(k, v)
+			}
+			var res *http.Response
+			require.Eventually(t, func() bool {
+				res, err = http.DefaultClient.Do(req)
+				return err == nil
+			}, 5*time.Second, 10*time.Millisecond)
+			defer res.Body.Close()
+			require.Equal(t, tc.expStatus, res.StatusCode)
+
+			if tc.expStatus != http.StatusOK {
+				var body struct {
+					Code    codes.Code `json:"code"`
+					Message string     `json:"message"`
+				}
+				require.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+				require.Contains(t, []codes.Code{codes.Unauthenticated, codes.PermissionDenied}, body.Code)
+				return
+			}
+			got := <-requests
+			require.Equal(t, seen{path: tc.expPath, query: tc.expQuery}, got, "the key is not forwarded upstream")
+		})
+	}
+}
+
+func TestAPIKeyAuthenticationOverJSONRPC(t *testing.T) {
+	gw := startGateway(t, &config.Config{Auth: testAuth()}, listenOn(t, "jsonrpc"))
+	server := &gw.JSON_RPC_Server
+
+	var res *http.Response
+	require.Eventually(t, func() bool {
+		var err error
+		res, err = http.Post(fmt.Sprintf("http://127.0.0.1:%d", server.Port), "application/json",
+			bytes.NewReader([]byte(`{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber","params":[]}`)))
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	var body gateway.JSONRPCResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+	require.NotNil(t, body.Error)
+	require.Equal(t, -32002, body.Error.Code)
+	require.Equal(t, "missing API key", body.Error.Message)
+}
+
+func TestAPIKeyAuthenticationOverWebSocket(t *testing.T) {
+	gwURL := startWSGatewayWithConfig(t, &config.Config{
+		Upstream: wsUpstream(newFakeWSNode(t, newFakeChain(t))),
+		Auth:     testAuth(),
+	})
+
+	_, res, err := websocket.DefaultDialer.Dial(gwURL, nil)
+	require.Error(t, err)
+	require.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	client, _, err := websocket.DefaultDialer.Dial(gwURL+"?api_key=alice-key", nil)
+	require.NoError(t, err)
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	require.NoError(t, client.WriteJSON(map[string]any{"jsonrpc": "2.0", "id": 1, "method": "eth_blockNumber", "params": []any{}}))
+	var reply gateway.JSONRPCResponse
+	require.NoError(t, client.ReadJSON(&reply))
+	require.Nil(t, reply.Error)
+}
+
+func TestAPIKeyAuthenticationOverGRPC(t *testing.T) {
+	keys := make(chan []string, 1)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := lis.Addr().String()
+	srv := grpc.NewServer(grpc.UnknownServiceHandler(func(_ any, stream grpc.ServerStream) error {
+		if method, _ := grpc.Method(stream.Context()); method != "/gateway.test.Query/Block" {
+			return status.Error(codes.Unimplemented, "reflection is not served")
+		}
+		md, _ := metadata.FromIncomingContext(stream.Context())
+		keys <- append(md.Get("x-api-key"), md.Get("authorization")...)
+		if err := stream.RecvMsg(&emptypb.Empty{}); err != nil {
+			return err
+		}
+		return stream.SendMsg(&emptypb.Empty{})
+	}))
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn := startGRPCGateway(t, &config.Config{
+		Upstream: []config.Node{{GRPC: addr, Blocks: []uint64{1, 0}}},
+		Auth:     testAuth(),
+	})
+	call := func(md ...string) error {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), md...)
+		return conn.Invoke(ctx, "/gateway.test.Query/Block", &emptypb.Empty{}, &emptypb.Empty{})
+	}
+
+	require.Equal(t, codes.Unauthenticated, status.Code(call()))
+	require.Equal(t, codes.Unauthenticated, status.Code(call("x-api-key", "old-key")))
+	require.NoError(t, call("x-api-key", "grpc-key"))
+	require.Empty(t, <-keys, "the key is not forwarded upstream")
+	require.NoError(t, call("authorization", "Bearer alice-key"))
+	require.Empty(t, <-keys)
+
+	// Connect and gRPC-Web calls go through the same check.
+	res, err := http.Post("http://"+conn.Target()+"/gateway.test.Query/Block", "application/proto", nil)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, res.StatusCode)
+}
@@ -2,157 +2,259 @@ package gateway
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"os"
-	"os/signal"
+	"log/slog"
+	"net"
+	"net/http"
 	"sync"
-	"syscall"
 	"time"
 
+	"google.golang.org/grpc"
+
 	"github.com/decentrio/gateway/config"
+	"github.com/decentrio/gateway/health"
+	"github.com/decentrio/gateway/logging"
+	"github.com/decentrio/gateway/metrics"
+	"github.com/decentrio/gateway/pool"
+	httpUtils "github.com/decentrio/gateway/utils"
 )
 
-var (
-	mu        sync.Mutex
-	wg        sync.WaitGroup
-	semaphore = make(chan struct{}, 2000)
-)
+// maxConcurrentRequests is the size of the request semaphore of a gateway.
+const maxConcurrentRequests = 2000
 
 type Server struct {
+	Name string
+	// Port is the TCP port the server listens on once started, 0 when it only
+	// listens on Unix sockets.
 	Port uint16
 
-	Start    func(server *Server)
-	Shutdown func(server *Server)
+	// Start binds the addresses of the server and serves them in the background,
+	// returning the error keeping it from listening, if any.
+	Start func(server *Server) error
+	// Shutdown stops the server accepting connections and drains it,
+	// closing whatever is left once ctx is done.
+	Shutdown func(ctx context.Context, server *Server) error
+
+	gw *Gateway
+	// addrs are the configured addresses the server binds, unless it was
+	// given listeners with WithListener.
+	addrs     []string
+	listeners []net.Listener
+	requests  inflight
+
+	mu         sync.Mutex
+	http       *http.Server // gRPC-Web and Connect on the gRPC server
+	grpc       *grpc.Server
+	grpcHealth *grpcHealthServer
+	sessions   map[*wsSession]struct{} // open WebSocket sessions
 }
 
+// Gateway routes the requests of its servers to the upstream nodes of its
+// configuration. Every gateway holds its own state, so that several of them
+// can run in one process.
 type Gateway struct {
 	RPC_Server         Server
 	GRPC_Server        Server
 	API_Server         Server
 	JSON_RPC_Server    Server
 	JSON_RPC_WS_Server Server
-}
+	Metrics_Server     Server
+	Admin_Server       Server
 
-func NewGateway(cfg *config.Config) (*Gateway, error) {
-	gw := &Gateway{}
-	gw.RPC_Server = NewServer(cfg, "rpc")
-	gw.GRPC_Server = NewServer(cfg, "grpc")
-	gw.API_Server = NewServer(cfg, "api")
-	gw.JSON_RPC_Server = NewServer(cfg, "jsonrpc")
-	gw.JSON_RPC_WS_Server = NewServer(cfg, "jsonrpc_ws")
-	return gw, nil
+	cfg       *config.Store
+	log       *slog.Logger
+	router    Router
+	health    *health.Tracker
+	metrics   *metrics.Metrics
+	pool      *pool.Pool
+	http      *httpUtils.Client
+	semaphore chan struct{}
+	limiter   *rateLimiter
+
+	listenersMu sync.Mutex
+	listeners   map[string]listener // address -> listener
+
+	wsPool *wsConnPool
+	wsHub  *wsSubscriptionHub
+	// wsTLSDialers holds a copy of wsDialer for each WebSocket upstream
+	// with its own TLS settings, keyed by URL.
+	wsTLSDialers    sync.Map // map[string]*websocket.Dialer
+	grpcDescriptors *grpcDescriptorSet
+
+	transport          *http.Transport
+	injected           map[string][]net.Listener
+	middleware         []func(http.Handler) http.Handler
+	unaryInterceptors  []grpc.UnaryServerInterceptor
+	streamInterceptors []grpc.StreamServerInterceptor
+
+	stopMu sync.Mutex
+	stop   chan struct{} // closed on Shutdown, stopping the background loops
 }
 
-func NewServer(cfg *config.Config, serverType string) Server {
-	new_server := &Server{}
-	switch serverType {
-	case "rpc":
-		if cfg.Ports.RPC != 0 {
-			new_server.Port = cfg.Ports.RPC
-			new_server.Start = Start_RPC_Server
-			new_server.Shutdown = Shutdown_RPC_Server
-		} else {
-			fmt.Println("RPC Service is disabled.")
-		}
-	case "grpc":
-		if cfg.Ports.GRPC != 0 {
-			new_server.Port = cfg.Ports.GRPC
-			new_server.Start = Start_GRPC_Server
-			new_server.Shutdown = Shutdown_GRPC_Server
-		} else {
-			fmt.Println("gRPC Service is disabled.")
+// shutdownTimeout bounds the drain of the servers when Run returns.
+const shutdownTimeout = 10 * time.Second
+
+// New returns a gateway serving cfg, configured by opts. Servers without a
+// port, listen address or listener given with WithListener are disabled.
+func New(cfg *config.Config, opts ...Option) (*Gateway, error) {
+	g := &Gateway{
+		cfg:       config.NewStore(cfg),
+		log:       slog.Default(),
+		router:    RouterFunc((*config.Config).NodesByHeight),
+		health:    health.NewTracker(),
+		metrics:   metrics.New(),
+		semaphore: make(chan struct{}, maxConcurrentRequests),
+		limiter:   newRateLimiter(),
+		listeners: make(map[string]listener),
+		injected:  make(map[string][]net.Listener),
+	}
+	for _, opt := range opts {
+		opt(g)
+	}
+	g.log = slog.New(logging.ContextHandler(g.log.Handler()))
+	g.pool = pool.New(g.cfg, g.health, g.metrics, func(height uint64) []*config.Node {
+		return g.router.Route(g.cfg.Get(), height)
+	})
+	g.http = httpUtils.NewClient(g.cfg, g.health, g.metrics, g.log, g.transport)
+	g.grpcDescriptors = newGRPCDescriptorSet(g.log, g.pool)
+	g.wsPool = newWSConnPool(g)
+	g.wsHub = newWSSubscriptionHub(g)
+
+	servers := []struct {
+		server   *Server
+		name     string
+		title    string
+		start    func(*Server) error
+		shutdown func(*Server, context.Context) error
+	}{
+		{&g.RPC_Server, "rpc", "RPC", (*Server).startRPC, (*Server).shutdownHTTP},
+		{&g.GRPC_Server, "grpc", "gRPC", (*Server).startGRPC, (*Server).shutdownGRPC},
+		{&g.API_Server, "api", "API", (*Server).startAPI, (*Server).shutdownHTTP},
+		{&g.JSON_RPC_Server, "jsonrpc", "JSON-RPC", (*Server).startJSONRPC, (*Server).shutdownHTTP},
+		{&g.JSON_RPC_WS_Server, "jsonrpc_ws", "JSON-RPC WebSocket", (*Server).startJSONRPCWS, (*Server).shutdownJSONRPCWS},
+		{&g.Metrics_Server, "metrics", "Metrics", (*Server).startMetrics, (*Server).shutdownHTTP},
+		{&g.Admin_Server, "admin", "Admin", (*Server).startAdmin, (*Server).shutdownHTTP},
+	}
+	for name := range g.injected {
+		known := false
+		for _, s := range servers {
+			known = known || s.name == name
 		}
-	case "api":
-		if cfg.Ports.API != 0 {
-			new_server.Port = cfg.Ports.API
-			new_server.Start = Start_API_Server
-			new_server.Shutdown = Shutdown_API_Server
-		} else {
-			fmt.Println("API Service is disabled.")
+		if !known {
+			return nil, fmt.Errorf("invalid server type %q", name)
 		}
-	case "jsonrpc":
-		if cfg.Ports.JSONRPC != 0 {
-			new_server.Port = cfg.Ports.JSONRPC
-			new_server.Start = Start_JSON_RPC_Server
-			new_server.Shutdown = Shutdown_JSON_RPC_Server
-		} else {
-			fmt.Println("JSON-RPC Service is disabled.")
+	}
+	for _, s := range servers {
+		s.server.Name = s.name
+		s.server.gw = g
+		if lis, ok := g.injected[s.name]; ok {
+			s.server.listeners = lis
+		} else if s.server.addrs = cfg.ListenAddresses(s.name); len(s.server.addrs) == 0 {
+			g.log.Info(s.title + " service is disabled")
+			continue
 		}
-	case "jsonrpc_ws":
-		if cfg.Ports.JSONRPC_WS != 0 {
-			new_server.Port = cfg.Ports.JSONRPC_WS
-			new_server.Start = Start_JSON_RPC_WS_Server
-			new_server.Shutdown = Shutdown_JSON_RPC_WS_Server
-		} else {
-			fmt.Println("JSON-RPC WebSocket Service is disabled.")
+		s.server.Start = s.start
+		s.server.Shutdown = func(ctx context.Context, server *Server) error {
+			return s.shutdown(server, ctx)
 		}
-	default:
-		fmt.Println("Invalid server type")
-		os.Exit(1)
 	}
-	return *new_server
+	g.registerGauges()
+	return g, nil
 }
 
-func (g *Gateway) Start() {
-	if g.RPC_Server.Port != 0 {
-		go g.RPC_Server.Start(&g.RPC_Server)
-	}
-	if g.GRPC_Server.Port != 0 {
-		go g.GRPC_Server.Start(&g.GRPC_Server)
-	}
-	if g.API_Server.Port != 0 {
-		go g.API_Server.Start(&g.API_Server)
-	}
-	if g.JSON_RPC_Server.Port != 0 {
-		go g.JSON_RPC_Server.Start(&g.JSON_RPC_Server)
-	}
-	if g.JSON_RPC_WS_Server.Port != 0 {
-		go g.JSON_RPC_WS_Server.Start(&g.JSON_RPC_WS_Server)
+// listenerPort returns the TCP port lis is bound to, or 0.
+func listenerPort(lis net.Listener) uint16 {
+	if addr, ok := lis.Addr().(*net.TCPAddr); ok {
+		return uint16(addr.Port)
 	}
+	return 0
+}
 
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+// Config returns the configuration the gateway currently serves, which the
+// admin API may have changed since New.
+func (g *Gateway) Config() *config.Config {
+	return g.cfg.Get()
+}
 
-	<-stop
-	g.Shutdown()
+// Health returns the health the gateway tracks for its upstreams.
+func (g *Gateway) Health() *health.Tracker {
+	return g.health
 }
 
-func (g *Gateway) Shutdown() {
-	var wg sync.WaitGroup
-	servers := []*Server{
-		&g.RPC_Server, &g.GRPC_Server, &g.API_Server, &g.JSON_RPC_Server, &g.JSON_RPC_WS_Server,
+// Metrics returns the metrics of the gateway, served by its metrics server.
+func (g *Gateway) Metrics() *metrics.Metrics {
+	return g.metrics
+}
+
+func (g *Gateway) servers() []*Server {
+	return []*Server{
+		&g.RPC_Server, &g.GRPC_Server, &g.API_Server, &g.JSON_RPC_Server, &g.JSON_RPC_WS_Server, &g.Metrics_Server, &g.Admin_Server,
+	}
+}
+
+// Run starts the gateway and serves until ctx is done, then shuts it down,
+// giving the servers shutdownTimeout to drain.
+func (g *Gateway) Run(ctx context.Context) error {
+	if err := g.Start(); err != nil {
+		return err
 	}
+	<-ctx.Done()
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
 	defer cancel()
+	return g.Shutdown(shutdownCtx)
+}
 
-	for _, server := range servers {
-		if server.Port != 0 {
-			wg.Add(1)
-			go func(s *Server) {
-				defer wg.Done()
-				if err := shutdownWithTimeout(ctx, s); err != nil {
-					fmt.Printf("Error shutting down %T: %v\n", s, err)
-				}
-			}(server)
+// Start starts every enabled server, returning once they all listen. If one
+// of them cannot start, the ones already started are shut down and its error
+// returned.
+func (g *Gateway) Start() error {
+	for _, server := range g.servers() {
+		if server.Start == nil {
+			continue
+		}
+		if err := server.Start(server); err != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			g.Shutdown(ctx)
+			return fmt.Errorf("failed to start %s server: %w", server.Name, err)
 		}
 	}
-
-	wg.Wait()
-	fmt.Println("All servers stopped.")
+	g.stopMu.Lock()
+	defer g.stopMu.Unlock()
+	g.stop = make(chan struct{})
+	go g.watchTips(g.stop)
+	go g.wsPool.reapIdle(g.stop)
+	return nil
 }
 
-func shutdownWithTimeout(ctx context.Context, server *Server) error {
-	done := make(chan error, 1)
-	go func() {
-		server.Shutdown(server)
-		done <- nil
-	}()
+// Shutdown drains the servers in parallel until ctx is done, closing what is
+// left of them then. Each server only waits for its own requests.
+func (g *Gateway) Shutdown(ctx context.Context) error {
+	g.stopMu.Lock()
+	if g.stop != nil {
+		close(g.stop)
+		g.stop = nil
+	}
+	g.stopMu.Unlock()
 
-	select {
-	case err := <-done:
-		return err
-	case <-ctx.Done():
-		return fmt.Errorf("shutdown timeout")
+	var wg sync.WaitGroup
+	errs := make([]error, len(g.servers()))
+	for i, server := range g.servers() {
+		if server.Shutdown == nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = server.Shutdown(ctx, server)
+		}()
 	}
+	wg.Wait()
+	g.wsPool.closeAll()
+	g.wsHub.closeAll()
+	g.pool.CloseAllGRPCConnections()
+	g.log.Info("All servers stopped")
+	return errors.Join(errs...)
 }
@@ -0,0 +1,115 @@
+package gateway_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/decentrio/gateway/config"
+	"github.com/decentrio/gateway/gateway"
+)
+
+// listenOn makes server serve a listener on a free local port.
+func listenOn(t *testing.T, server string) gateway.Option {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { lis.Close() })
+	return gateway.WithListener(server, lis)
+}
+
+// startGateway starts a gateway serving cfg, shut down when the test ends.
+func startGateway(t *testing.T, cfg *config.Config, opts ...gateway.Option) *gateway.Gateway {
+	gw, err := gateway.New(cfg, opts...)
+	require.NoError(t, err)
+	require.NoError(t, gw.Start())
+	t.Cleanup(func() { gw.Shutdown(context.Background()) })
+	return gw
+}
+
+func getBody(t *testing.T, url string) string {
+	res, err := http.Get(url)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	return string(body)
+}
+
+func namedUpstream(t *testing.T, name string) *httptest.Server {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(name))
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+func TestGatewaysRunSideBySide(t *testing.T) {
+	a, b := namedUpstream(t, "a"), namedUpstream(t, "b")
+
+	gwA := startGateway(t, &config.Config{Upstream: []config.Node{{API: a.URL, Blocks: []uint64{1, 0}}}}, listenOn(t, "api"))
+	gwB := startGateway(t, &config.Config{Upstream: []config.Node{{API: b.URL, Blocks: []uint64{1, 0}}}}, listenOn(t, "api"))
+
+	require.Equal(t, "a", getBody(t, fmt.Sprintf("http://127.0.0.1:%d/params", gwA.API_Server.Port)))
+	require.Equal(t, "b", getBody(t, fmt.Sprintf("http://127.0.0.1:%d/params", gwB.API_Server.Port)))
+
+	// Shutting one down leaves the other serving.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, gwA.Shutdown(ctx))
+	require.Equal(t, "b", getBody(t, fmt.Sprintf("http://127.0.0.1:%d/params", gwB.API_Server.Port)))
+}
+
+func TestGatewayOptions(t *testing.T) {
+	a, b := namedUpstream(t, "a"), namedUpstream(t, "b")
+	cfg := &config.Config{Upstream: []config.Node{
+		{Name: "a", API: a.URL, Blocks: []uint64{1, 0}},
+		{Name: "b", API: b.URL, Blocks: []uint64{1, 0}},
+	}}
+
+	router := gateway.RouterFunc(func(cfg *config.Config, height uint64) []*config.Node {
+		return []*config.Node{&cfg.Upstream[1]}
+	})
+	middleware := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Embedded", "yes")
+			next.ServeHTTP(w, r)
+		})
+	}
+	gw := startGateway(t, cfg, listenOn(t, "api"), gateway.WithRouter(router), gateway.WithMiddleware(middleware))
+
+	res, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/params", gw.API_Server.Port))
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Equal(t, "b", string(body))
+	require.Equal(t, "yes", res.Header.Get("X-Embedded"))
+
+	// Servers without a port or listener stay disabled.
+	require.Nil(t, gw.RPC_Server.Start)
+}
+
+func TestGatewayRejectsUnknownListener(t *testing.T) {
+	_, err := gateway.New(&config.Config{}, listenOn(t, "ftp"))
+	require.ErrorContains(t, err, `invalid server type "ftp"`)
+}
+
+func TestGatewayShutdownTwice(t *testing.T) {
+	gw := startGateway(t, &config.Config{Upstream: []config.Node{{API: namedUpstream(t, "a").URL, Blocks: []uint64{1, 0}}}}, listenOn(t, "api"))
+
+	// Concurrent and repeated shutdowns stop the gateway once.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		gw.Shutdown(context.Background())
+	}()
+	gw.Shutdown(context.Background())
+	<-done
+}
@@ -0,0 +1,382 @@
+package gateway
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	gogoproto "github.com/cosmos/gogoproto/proto"
+
+	"github.com/decentrio/gateway/config"
+	"github.com/decentrio/gateway/pool"
+)
+
+const grpcReflectionTimeout = 5 * time.Second
+
+// grpcDescriptorSet holds the protobuf descriptors of the services offered by
+// the gRPC upstreams. It is rebuilt every time the gRPC server starts.
+type grpcDescriptorSet struct {
+	log  *slog.Logger
+	pool *pool.Pool
+
+	mu    sync.RWMutex
+	files *protoregistry.Files
+	types *protoregistry.Types // extensions declared by files
+}
+
+func newGRPCDescriptorSet(log *slog.Logger, p *pool.Pool) *grpcDescriptorSet {
+	return &grpcDescriptorSet{log: log, pool: p, files: new(protoregistry.Files), types: new(protoregistry.Types)}
+}
+
+// load replaces the descriptors with those of the configured descriptor sets,
+// followed by whatever the upstreams report over server reflection. When two
+// sources define the same file, the first one wins.
+func (d *grpcDescriptorSet) load(cfg *config.Config) {
+	var protos []*descriptorpb.FileDescriptorProto
+	for _, path := range cfg.GRPC.DescriptorSets {
+		set, err := readDescriptorSet(path)
+		if err != nil {
+			d.log.Warn("Failed to read descriptor set", "path", path, "err", err)
+			continue
+		}
+		protos = append(protos, set.GetFile()...)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), grpcReflectionTimeout)
+	defer cancel()
+
+	results := make([][]*descriptorpb.FileDescriptorProto, len(cfg.Upstream))
+	var wg sync.WaitGroup
+	for i, node := range cfg.Upstream {
+		if node.GRPC == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			files, err := d.fetchReflectionDescriptors(ctx, addr)
+			if err != nil {
+				d.log.Warn("Failed to load descriptors", "upstream", addr, "err", err)
+				return
+			}
+			results[i] = files
+		}(i, node.GRPC)
+	}
+	wg.Wait()
+	for _, files := range results {
+		protos = append(protos, files...)
+	}
+
+	files := d.buildFileRegistry(protos)
+	types := new(protoregistry.Types)
+	files.RangeFiles(func(fd protoreflect.FileDescriptor) bool {
+		d.registerExtensions(types, fd.Extensions())
+		for i := 0; i < fd.Messages().Len(); i++ {
+			d.registerNestedExtensions(types, fd.Messages().Get(i))
+		}
+		return true
+	})
+	d.log.Info("Loaded proto files from gRPC upstreams", "files", files.NumFiles())
+
+	d.mu.Lock()
+	d.files = files
+	d.types = types
+	d.mu.Unlock()
+}
+
+func (d *grpcDescriptorSet) registry() *protoregistry.Files {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.files
+}
+
+func (d *grpcDescriptorSet) extensions() *protoregistry.Types {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.types
+}
+
+// services returns the names of every service described by the upstreams.
+func (d *grpcDescriptorSet) services() []string {
+	var names []string
+	d.registry().RangeFiles(func(fd protoreflect.FileDescriptor) bool {
+		for i := 0; i < fd.Services().Len(); i++ {
+			names = append(names, string(fd.Services().Get(i).FullName()))
+		}
+		return true
+	})
+	return names
+}
+
+// FindFileByPath and FindDescriptorByName resolve against the upstream
+// descriptors first, falling back to the ones compiled into the gateway so
+// that its own services can always be described.
+func (d *grpcDescriptorSet) FindFileByPath(path string) (protoreflect.FileDescriptor, error) {
+	if fd, err := d.registry().FindFileByPath(path); err == nil {
+		return fd, nil
+	}
+	return gogoproto.HybridResolver.FindFileByPath(path)
+}
+
+func (d *grpcDescriptorSet) FindDescriptorByName(name protoreflect.FullName) (protoreflect.Descriptor, error) {
+	if desc, err := d.registry().FindDescriptorByName(name); err == nil {
+		return desc, nil
+	}
+	return gogoproto.HybridResolver.FindDescriptorByName(name)
+}
+
+func (d *grpcDescriptorSet) FindExtensionByName(field protoreflect.FullName) (protoreflect.ExtensionType, error) {
+	if xt, err := d.extensions().FindExtensionByName(field); err == nil {
+		return xt, nil
+	}
+	return protoregistry.GlobalTypes.FindExtensionByName(field)
+}
+
+func (d *grpcDescriptorSet) FindExtensionByNumber(message protoreflect.FullName, field protoreflect.FieldNumber) (protoreflect.ExtensionType, error) {
+	if xt, err := d.extensions().FindExtensionByNumber(message, field); err == nil {
+		return xt, nil
+	}
+	return protoregistry.GlobalTypes.FindExtensionByNumber(message, field)
+}
+
+func (d *grpcDescriptorSet) RangeExtensionsByMessage(message protoreflect.FullName, f func(protoreflect.ExtensionType) bool) {
+	seen := make(map[protoreflect.FieldNumber]bool)
+	stopped := false
+	d.extensions().RangeExtensionsByMessage(message, func(xt protoreflect.ExtensionType) bool {
+		seen[xt.TypeDescriptor().Number()] = true
+		stopped = !f(xt)
+		return !stopped
+	})
+	if stopped {
+		return
+	}
+	protoregistry.GlobalTypes.RangeExtensionsByMessage(message, func(xt protoreflect.ExtensionType) bool {
+		if seen[xt.TypeDescriptor().Number()] {
+			return true
+		}
+		return f(xt)
+	})
+}
+
+// input returns the request message descriptor of fullMethod, given as
+// "/package.Service/Method", or nil if the method is unknown.
+func (d *grpcDescriptorSet) input(fullMethod string) protoreflect.MessageDescriptor {
+	service, method, ok := strings.Cut(strings.TrimPrefix(fullMethod, "/"), "/")
+	if !ok {
+		return nil
+	}
+	desc, err := d.registry().FindDescriptorByName(protoreflect.FullName(service))
+	if err != nil {
+		return nil
+	}
+	sd, ok := desc.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil
+	}
+	md := sd.Methods().ByName(protoreflect.Name(method))
+	if md == nil {
+		return nil
+	}
+	return md.Input()
+}
+
+// method returns the descriptor of fullMethod, looking at the gateway's own
+// services as well, or nil if the method is unknown.
+func (d *grpcDescriptorSet) method(fullMethod string) protoreflect.MethodDescriptor {
+	service, method, ok := strings.Cut(strings.TrimPrefix(fullMethod, "/"), "/")
+	if !ok {
+		return nil
+	}
+	desc, err := d.FindDescriptorByName(protoreflect.FullName(service))
+	if err != nil {
+		return nil
+	}
+	sd, ok := desc.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil
+	}
+	return sd.Methods().ByName(protoreflect.Name(method))
+}
+
+// FindMessageByName and FindMessageByURL let protojson expand google.protobuf.Any
+// values of any type the descriptors know about.
+func (d *grpcDescriptorSet) FindMessageByName(name protoreflect.FullName) (protoreflect.MessageType, error) {
+	desc, err := d.FindDescriptorByName(name)
+	if err != nil {
+		return nil, err
+	}
+	md, ok := desc.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, protoregistry.NotFound
+	}
+	return dynamicpb.NewMessageType(md), nil
+}
+
+func (d *grpcDescriptorSet) FindMessageByURL(url string) (protoreflect.MessageType, error) {
+	if i := strings.LastIndexByte(url, '/'); i >= 0 {
+		url = url[i+1:]
+	}
+	return d.FindMessageByName(protoreflect.FullName(url))
+}
+
+func (d *grpcDescriptorSet) registerNestedExtensions(types *protoregistry.Types, md protoreflect.MessageDescriptor) {
+	d.registerExtensions(types, md.Extensions())
+	for i := 0; i < md.Messages().Len(); i++ {
+		d.registerNestedExtensions(types, md.Messages().Get(i))
+	}
+}
+
+func (d *grpcDescriptorSet) registerExtensions(types *protoregistry.Types, xds protoreflect.ExtensionDescriptors) {
+	for i := 0; i < xds.Len(); i++ {
+		xd := xds.Get(i)
+		if xd.ContainingMessage().IsPlaceholder() {
+			continue
+		}
+		if err := types.RegisterExtension(dynamicpb.NewExtensionType(xd)); err != nil {
+			d.log.Debug("Skipping extension", "extension", xd.FullName(), "err", err)
+		}
+	}
+}
+
+func readDescriptorSet(path string) (*descriptorpb.FileDescriptorSet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	set := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(data, set); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// fetchReflectionDescriptors asks the node at addr for the files defining
+// each of its services, along with their dependencies.
+func (d *grpcDescriptorSet) fetchReflectionDescriptors(ctx context.Context, addr string) ([]*descriptorpb.FileDescriptorProto, error) {
+	conn, err := d.pool.GetGRPCConn(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := rpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.CloseSend()
+
+	ask := func(req *rpb.ServerReflectionRequest) (*rpb.ServerReflectionResponse, error) {
+		if err := stream.Send(req); err != nil {
+			return nil, err
+		}
+		res, err := stream.Recv()
+		if err != nil {
+			return nil, err
+		}
+		if e := res.GetErrorResponse(); e != nil {
+			return nil, status.Error(codes.Code(e.GetErrorCode()), e.GetErrorMessage())
+		}
+		return res, nil
+	}
+
+	res, err := ask(&rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_ListServices{ListServices: "*"},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var files []*descriptorpb.FileDescriptorProto
+	seen := make(map[string]bool)
+	add := func(res *rpb.ServerReflectionResponse) {
+		for _, raw := range res.GetFileDescriptorResponse().GetFileDescriptorProto() {
+			file := &descriptorpb.FileDescriptorProto{}
+			if err := proto.Unmarshal(raw, file); err != nil || seen[file.GetName()] {
+				continue
+			}
+			seen[file.GetName()] = true
+			files = append(files, file)
+		}
+	}
+
+	for _, svc := range res.GetListServicesResponse().GetService() {
+		if strings.HasPrefix(svc.GetName(), "grpc.reflection.") {
+			continue
+		}
+		res, err := ask(&rpb.ServerReflectionRequest{
+			MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: svc.GetName()},
+		})
+		if err != nil {
+			d.log.Warn("Failed to load descriptors", "service", svc.GetName(), "upstream", addr, "err", err)
+			continue
+		}
+		add(res)
+	}
+
+	// Servers usually send the dependencies along, but are not required to.
+	for i := 0; i < len(files); i++ {
+		for _, dep := range files[i].GetDependency() {
+			if seen[dep] {
+				continue
+			}
+			seen[dep] = true
+			res, err := ask(&rpb.ServerReflectionRequest{
+				MessageRequest: &rpb.ServerReflectionRequest_FileByFilename{FileByFilename: dep},
+			})
+			if err != nil {
+				continue
+			}
+			add(res)
+		}
+	}
+	return files, nil
+}
+
+// buildFileRegistry links protos into a registry, dependencies first. Files
+// that cannot be linked are skipped; unresolvable imports are tolerated since
+// upstreams do not always serve all of them.
+func (d *grpcDescriptorSet) buildFileRegistry(protos []*descriptorpb.FileDescriptorProto) *protoregistry.Files {
+	byName := make(map[string]*descriptorpb.FileDescriptorProto)
+	for _, file := range protos {
+		if _, ok := byName[file.GetName()]; !ok {
+			byName[file.GetName()] = file
+		}
+	}
+
+	files := new(protoregistry.Files)
+	visited := make(map[string]bool)
+	var register func(name string)
+	register = func(name string) {
+		file, ok := byName[name]
+		if !ok || visited[name] {
+			return
+		}
+		visited[name] = true
+		for _, dep := range file.GetDependency() {
+			register(dep)
+		}
+
+		fd, err := protodesc.FileOptions{AllowUnresolvable: true}.New(file, files)
+		if err == nil {
+			err = files.RegisterFile(fd)
+		}
+		if err != nil {
+			d.log.Debug("Skipping proto file", "file", name, "err", err)
+		}
+	}
+	for _, file := range protos {
+		register(file.GetName())
+	}
+	return files
+}
@@ -0,0 +1,105 @@
+package gateway
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	grpchealth "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// grpcHealthInterval is how often the status given by the gRPC health service
+// is brought up to date.
+const grpcHealthInterval = time.Second
+
+// grpcHealthServer serves grpc.health.v1 with the readiness of the gateway.
+// The empty service name reports on the whole gateway, and every gRPC service
+// the gateway answers for on whether calls over gRPC can be served.
+type grpcHealthServer struct {
+	*grpchealth.Server
+	gw       *Gateway
+	services grpcReflectionServices
+	stop     chan struct{}
+}
+
+func (g *Gateway) registerHealth(server *grpc.Server) *grpcHealthServer {
+	s := &grpcHealthServer{
+		Server:   grpchealth.NewServer(),
+		gw:       g,
+		services: grpcReflectionServices{server: server, descriptors: g.grpcDescriptors},
+		stop:     make(chan struct{}),
+	}
+	healthpb.RegisterHealthServer(server, s)
+	s.update()
+	go s.run()
+	return s
+}
+
+func servingStatus(ready bool) healthpb.HealthCheckResponse_ServingStatus {
+	if ready {
+		return healthpb.HealthCheckResponse_SERVING
+	}
+	return healthpb.HealthCheckResponse_NOT_SERVING
+}
+
+func (s *grpcHealthServer) update() {
+	ready := s.gw.checkReadiness()
+	s.SetServingStatus("", servingStatus(ready.Ready))
+	status := servingStatus(ready.protocolReady("grpc"))
+	for name := range s.services.GetServiceInfo() {
+		if name != healthpb.Health_ServiceDesc.ServiceName {
+			s.SetServingStatus(name, status)
+		}
+	}
+}
+
+func (s *grpcHealthServer) run() {
+	ticker := time.NewTicker(grpcHealthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.update()
+		}
+	}
+}
+
+// Watch ends the watches once the server is shut down, as they would
+// otherwise hold up its graceful stop.
+func (s *grpcHealthServer) Watch(req *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return s.Server.Watch(req, healthWatchStream{Health_WatchServer: stream, ctx: ctx})
+}
+
+// shutdown reports every service as not serving and ends the watches.
+func (s *grpcHealthServer) shutdown() {
+	s.Server.Shutdown()
+	close(s.stop)
+}
+
+type healthWatchStream struct {
+	healthpb.Health_WatchServer
+	ctx context.Context
+}
+
+func (s healthWatchStream) Context() context.Context {
+	return s.ctx
+}
+
+// isHealthMethod tells whether fullMethod belongs to the gRPC health service,
+// which answers probes without API key, method rules or rate limits.
+func isHealthMethod(fullMethod string) bool {
+	return strings.HasPrefix(fullMethod, "/"+healthpb.Health_ServiceDesc.ServiceName+"/")
+}
@@ -0,0 +1,149 @@
+package gateway
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// grpcHeightFieldDepth is how deep into nested request messages a height
+// field is looked for.
+const grpcHeightFieldDepth = 2
+
+// grpcHeightFields are the request fields taken as the block height a call
+// is about.
+var grpcHeightFields = map[protoreflect.Name]bool{
+	"height":       true,
+	"block_height": true,
+}
+
+type grpcBodyHeightKey struct{}
+
+// grpcBodyHeight returns the height found in the request body by
+// inferHeightHandler, if any.
+func (g *Gateway) grpcBodyHeight(ctx context.Context) (uint64, bool) {
+	height, ok := ctx.Value(grpcBodyHeightKey{}).(uint64)
+	return height, ok
+}
+
+// inferHeightHandler reads the first request message of calls whose method is
+// known from the descriptors of the gateway before handing the stream to next,
+// so that the director can route on a height field of the request.
+func (g *Gateway) inferHeightHandler(next grpc.StreamHandler) grpc.StreamHandler {
+	return func(srv any, stream grpc.ServerStream) error {
+		fullMethod, _ := grpc.MethodFromServerStream(stream)
+		input := g.grpcDescriptors.input(fullMethod)
+		if input == nil {
+			return next(srv, stream)
+		}
+
+		first := &emptypb.Empty{}
+		err := stream.RecvMsg(first)
+		peeked := &peekedServerStream{ServerStream: stream, ctx: stream.Context(), first: first, err: err}
+		if err == nil {
+			if height, ok := requestHeight(first.ProtoReflect().GetUnknown(), input, grpcHeightFieldDepth); ok {
+				peeked.ctx = context.WithValue(stream.Context(), grpcBodyHeightKey{}, height)
+			}
+		}
+		return next(srv, peeked)
+	}
+}
+
+// peekedServerStream replays a message already read from the stream.
+type peekedServerStream struct {
+	grpc.ServerStream
+	ctx      context.Context
+	first    proto.Message
+	err      error
+	replayed bool
+}
+
+func (s *peekedServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *peekedServerStream) RecvMsg(m any) error {
+	if s.replayed {
+		return s.ServerStream.RecvMsg(m)
+	}
+	s.replayed = true
+	if s.err != nil {
+		return s.err
+	}
+	msg := m.(proto.Message)
+	proto.Reset(msg)
+	proto.Merge(msg, s.first)
+	return nil
+}
+
+// requestHeight scans the encoded message b, described by md, for a non-zero
+// height field. Top-level fields are preferred over nested ones.
+func requestHeight(b []byte, md protoreflect.MessageDescriptor, depth int) (uint64, bool) {
+	type nested struct {
+		b  []byte
+		md protoreflect.MessageDescriptor
+	}
+	var children []nested
+
+	fields := md.Fields()
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return 0, false
+		}
+		b = b[n:]
+
+		fd := fields.ByNumber(num)
+		switch {
+		case typ == protowire.VarintType && fd != nil && grpcHeightFields[fd.Name()]:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return 0, false
+			}
+			if height, ok := heightValue(fd.Kind(), v); ok {
+				return height, true
+			}
+		case typ == protowire.BytesType && fd != nil && fd.Kind() == protoreflect.MessageKind && !fd.IsMap():
+			v, n := protowire.ConsumeBytes(b)
+			if n >= 0 && depth > 0 && !fd.Message().IsPlaceholder() {
+				children = append(children, nested{v, fd.Message()})
+			}
+		}
+
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return 0, false
+		}
+		b = b[n:]
+	}
+
+	for _, child := range children {
+		if height, ok := requestHeight(child.b, child.md, depth-1); ok {
+			return height, true
+		}
+	}
+	return 0, false
+}
+
+func heightValue(kind protoreflect.Kind, v uint64) (uint64, bool) {
+	switch kind {
+	case protoreflect.Int64Kind, protoreflect.Int32Kind:
+		if int64(v) <= 0 {
+			return 0, false
+		}
+		return uint64(int64(v)), true
+	case protoreflect.Sint64Kind, protoreflect.Sint32Kind:
+		h := protowire.DecodeZigZag(v)
+		if h <= 0 {
+			return 0, false
+		}
+		return uint64(h), true
+	case protoreflect.Uint64Kind, protoreflect.Uint32Kind:
+		return v, v > 0
+	}
+	return 0, false
+}
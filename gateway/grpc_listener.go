@@ -0,0 +1,142 @@
+package gateway
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// grpcSniffTimeout bounds how long a new connection may take to send enough
+// bytes to tell HTTP/2 from HTTP/1.x.
+const grpcSniffTimeout = 10 * time.Second
+
+// splitGRPCListener shares lis between the native gRPC server, which gets the
+// connections opening with the HTTP/2 client preface, and an HTTP/1.x server
+// for everything else (gRPC-Web, Connect, CORS preflights).
+func splitGRPCListener(lis net.Listener) (grpcLis, httpLis net.Listener) {
+	s := &sniffListener{base: lis}
+	s.grpc = newSubListener(s)
+	s.http = newSubListener(s)
+	go s.serve()
+	return s.grpc, s.http
+}
+
+type sniffListener struct {
+	base       net.Listener
+	grpc, http *subListener
+	closing    sync.Mutex
+	closed     int
+}
+
+// serve hands out the connections of the shared listener until it is closed.
+// Other accept errors, such as running out of file descriptors, are retried
+// with a backoff, as http.Server and grpc.Server do.
+func (s *sniffListener) serve() {
+	var delay time.Duration
+	for {
+		conn, err := s.base.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			s.grpc.shutdown()
+			s.http.shutdown()
+			return
+		}
+		if err != nil {
+			delay = min(max(delay*2, 5*time.Millisecond), time.Second)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		go s.route(conn)
+	}
+}
+
+func (s *sniffListener) route(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(grpcSniffTimeout))
+	r := bufio.NewReader(conn)
+	target := s.grpc
+	for i := 1; i <= len(http2.ClientPreface); i++ {
+		b, err := r.Peek(i)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		if b[i-1] != http2.ClientPreface[i-1] {
+			target = s.http
+			break
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
+	target.deliver(&peekedConn{Conn: conn, r: r})
+}
+
+// release closes the shared listener once both servers are done with it.
+func (s *sniffListener) release() {
+	s.closing.Lock()
+	defer s.closing.Unlock()
+	s.closed++
+	if s.closed == 2 {
+		s.base.Close()
+	}
+}
+
+type subListener struct {
+	parent *sniffListener
+	conns  chan net.Conn
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newSubListener(parent *sniffListener) *subListener {
+	return &subListener{parent: parent, conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *subListener) deliver(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *subListener) shutdown() bool {
+	closed := false
+	l.once.Do(func() {
+		close(l.done)
+		closed = true
+	})
+	return closed
+}
+
+func (l *subListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *subListener) Close() error {
+	if l.shutdown() {
+		l.parent.release()
+	}
+	return nil
+}
+
+func (l *subListener) Addr() net.Addr {
+	return l.parent.base.Addr()
+}
+
+// peekedConn reads back the bytes consumed while sniffing.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,38 @@
+package gateway
+
+import (
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/reflection"
+	rpbv1 "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+)
+
+// grpcReflectionServices lists the services the gateway answers for: the ones
+// registered on it plus every service found on the upstreams.
+type grpcReflectionServices struct {
+	server      *grpc.Server
+	descriptors *grpcDescriptorSet
+}
+
+func (s grpcReflectionServices) GetServiceInfo() map[string]grpc.ServiceInfo {
+	info := s.server.GetServiceInfo()
+	for _, name := range s.descriptors.services() {
+		if _, ok := info[name]; !ok {
+			info[name] = grpc.ServiceInfo{}
+		}
+	}
+	return info
+}
+
+// registerReflection serves grpc.reflection.v1 and v1alpha from the gateway
+// itself, built from the descriptors cached by the gateway, rather than
+// proxying reflection to whichever upstream a call happens to land on.
+func (g *Gateway) registerReflection(server *grpc.Server) {
+	opts := reflection.ServerOptions{
+		Services:           grpcReflectionServices{server: server, descriptors: g.grpcDescriptors},
+		DescriptorResolver: g.grpcDescriptors,
+		ExtensionResolver:  g.grpcDescriptors,
+	}
+	rpb.RegisterServerReflectionServer(server, reflection.NewServer(opts))
+	rpbv1.RegisterServerReflectionServer(server, reflection.NewServerV1(opts))
+}
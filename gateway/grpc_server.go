@@ -3,10 +3,8 @@ package gateway
 import (
 	"context"
 	"fmt"
-	"net"
+	"net/http"
 	"strconv"
-	"sync/atomic"
-	"time"
 
 	"github.com/mwitkow/grpc-proxy/proxy"
 	"google.golang.org/grpc"
@@ -14,148 +12,204 @@ import (
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 
-	"github.com/decentrio/gateway/config"
+	"github.com/decentrio/gateway/pool"
 	"github.com/decentrio/gateway/register"
 )
 
-var (
-	grpcServers            = make(map[uint16]*grpc.Server)
-	activeGRPCRequestCount int32
-)
-
-func Start_GRPC_Server(server *Server) {
-	fmt.Printf("Starting gRPC server on port %d\n", server.Port)
+func (server *Server) startGRPC() error {
+	g := server.gw
+	g.log.Info("Starting gRPC server")
 	director := func(ctx context.Context, fullMethodName string) (context.Context, *grpc.ClientConn, error) {
 		md, ok := metadata.FromIncomingContext(ctx)
 		if !ok {
-			fmt.Println("[ERROR] Metadata missing from request context")
+			g.log.ErrorContext(ctx, "Metadata missing from request context")
 			return nil, nil, status.Errorf(codes.Unimplemented, "Unknown method")
 		}
 
 		outCtx := metadata.NewOutgoingContext(ctx, md.Copy())
-		var selectedHost string
 
-		heightStr := md.Get("x-cosmos-block-height")
+		var height uint64
+		heightStr := md.Get(pool.HeightHeader)
 		if len(heightStr) > 0 {
-			height, err := strconv.ParseUint(heightStr[0], 10, 64)
+			h, err := strconv.ParseUint(heightStr[0], 10, 64)
 			if err != nil {
-				fmt.Println("[ERROR] Invalid x-cosmos-block-height:", heightStr[0])
+				g.log.DebugContext(ctx, "Invalid x-cosmos-block-height", "value", heightStr[0])
 				return nil, nil, status.Errorf(codes.InvalidArgument, "Invalid x-cosmos-block-height")
 			}
-			if node := config.GetNodebyHeight(height); node != nil {
-				selectedHost = node.GRPC
-			} else {
-				fmt.Println("[ERROR] No matching backend found for height:", height)
-				return nil, nil, status.Errorf(codes.InvalidArgument, "No matching backend found")
+			height = h
+		} else if h, ok := g.grpcBodyHeight(ctx); ok {
+			height = h
+		}
+		// Unhealthy nodes are skipped in favour of others holding the height.
+		nodes := g.pool.Route(ctx, height)
+		if len(nodes) == 0 {
+			if height == 0 {
+				g.log.WarnContext(ctx, "No available gRPC backends")
+				return nil, nil, status.Errorf(codes.Unavailable, "No available gRPC backends")
 			}
-		} else if node := config.GetNodebyHeight(0); node != nil {
-			selectedHost = node.GRPC
-		} else {
-			fmt.Println("[ERROR] No available gRPC backends")
-			return nil, nil, status.Errorf(codes.Unavailable, "No available gRPC backends")
+			g.log.WarnContext(ctx, "No matching backend found", "height", height)
+			return nil, nil, status.Errorf(codes.InvalidArgument, "No matching backend found")
 		}
+		selectedHost := nodes[0].GRPC
 
-		fmt.Printf("Forwarding request %s to node: %s\n", fullMethodName, selectedHost)
+		g.log.DebugContext(ctx, "Forwarding gRPC request", "method", fullMethodName, "upstream", selectedHost)
+		if picked, ok := ctx.Value(grpcUpstreamKey{}).(*grpcUpstream); ok {
+			picked.addr = selectedHost
+			picked.call = g.health.Begin(selectedHost)
+		}
+		g.metrics.ObserveRoute("grpc", nodes[0].HeightRange(), selectedHost)
 
-		conn, err := getGRPCConn(ctx, selectedHost)
+		conn, err := g.pool.GetGRPCConn(ctx, selectedHost)
 		if err != nil {
-			fmt.Printf("[ERROR] Failed to get connection to backend %s: %v\n", selectedHost, err)
+			g.log.ErrorContext(ctx, "Failed to get connection to backend", "upstream", selectedHost, "err", err)
 			return nil, nil, status.Errorf(codes.Unavailable, "Connection error")
 		}
 
 		return outCtx, conn, err
 	}
 
+	// Descriptors let the proxy find the height in request bodies and back
+	// the gateway's own reflection service.
+	g.grpcDescriptors.load(g.cfg.Get())
+
+	// The interceptors given to the gateway run once the call is recorded,
+	// ahead of its API key, method rules and rate limits.
+	unary := append([]grpc.UnaryServerInterceptor{g.metricsUnaryInterceptor}, g.unaryInterceptors...)
+	unary = append(unary, g.authUnaryInterceptor, g.methodUnaryInterceptor, g.rateLimitUnaryInterceptor, server.requestInterceptor)
+	stream := append([]grpc.StreamServerInterceptor{g.metricsStreamInterceptor}, g.streamInterceptors...)
+	stream = append(stream, g.authStreamInterceptor, g.methodStreamInterceptor, g.rateLimitStreamInterceptor, server.requestStreamInterceptor)
 	grpcServer := grpc.NewServer(
-		grpc.UnknownServiceHandler(proxy.TransparentHandler(director)),
-		grpc.ChainUnaryInterceptor(requestInterceptor),
-		grpc.StreamInterceptor(requestStreamInterceptor),
+		grpc.StatsHandler(grpcStatsHandler{}),
+		grpc.UnknownServiceHandler(g.observeGRPCUpstream(g.inferHeightHandler(proxy.TransparentHandler(director)))),
+		grpc.ChainUnaryInterceptor(unary...),
+		grpc.ChainStreamInterceptor(stream...),
 	)
 
 	// Register service
-	register.Register(grpcServer)
+	register.Register(grpcServer, g.pool)
+	g.registerReflection(grpcServer)
 
-	lis, err := net.Listen("tcp", ":"+strconv.Itoa(int(server.Port)))
-	if err != nil {
-		panic(err)
+	webServer := &http.Server{Handler: g.grpcHTTPHandler(grpcServer)}
+	settings := g.cfg.Get().TLS.GRPC
+	if settings != nil {
+		tlsConfig, err := newServerTLSConfig(g.log, settings)
+		if err != nil {
+			return err
+		}
+		webServer.TLSConfig = tlsConfig
+		webServer.Handler = grpcTLSHandler(grpcServer, webServer.Handler)
 	}
 
-	mu.Lock()
-	grpcServers[server.Port] = grpcServer
-	mu.Unlock()
+	listeners, err := server.listen()
+	if err != nil {
+		return err
+	}
+	healthServer := g.registerHealth(grpcServer)
+
+	server.mu.Lock()
+	server.grpc = grpcServer
+	server.http = webServer
+	server.grpcHealth = healthServer
+	server.mu.Unlock()
+
+	for _, lis := range listeners {
+		g.setListener("grpc", lis, true)
+		serve := func(serve func() error) {
+			if err := serve(); err != nil && err != http.ErrServerClosed && err != grpc.ErrServerStopped {
+				g.log.Error("Server stopped serving", "server", "grpc", "address", lis.Addr().String(), "err", err)
+				g.setListener("grpc", lis, false)
+			}
+		}
+		if settings != nil {
+			// Behind TLS, every protocol is negotiated by net/http: native
+			// gRPC over HTTP/2, gRPC-Web and Connect over either version.
+			go serve(func() error { return webServer.ServeTLS(lis, "", "") })
+			continue
+		}
 
-	go func() {
-		_ = grpcServer.Serve(lis)
-	}()
+		// Native gRPC clients speak HTTP/2 from the first byte; gRPC-Web and
+		// Connect calls arrive over HTTP/1.1 on the same port.
+		grpcLis, httpLis := splitGRPCListener(lis)
+		go serve(func() error { return grpcServer.Serve(grpcLis) })
+		go serve(func() error { return webServer.Serve(httpLis) })
+	}
+	return nil
 }
 
-var requestInterceptor grpc.UnaryServerInterceptor = func(
+func (server *Server) requestInterceptor(
 	ctx context.Context,
 	req interface{},
 	info *grpc.UnaryServerInfo,
 	handler grpc.UnaryHandler,
 ) (interface{}, error) {
-	semaphore <- struct{}{}
-	atomic.AddInt32(&activeGRPCRequestCount, 1)
-	wg.Add(1)
+	if isHealthMethod(info.FullMethod) {
+		return handler(ctx, req)
+	}
+	g := server.gw
+	if !g.acquireSemaphore(ctx) {
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+	server.requests.begin()
 	defer func() {
-		<-semaphore
-		wg.Done()
-		atomic.AddInt32(&activeGRPCRequestCount, -1)
+		<-g.semaphore
+		server.requests.end()
 	}()
 	res, err := handler(ctx, req)
 	return res, err
 }
 
-func requestStreamInterceptor(
+func (server *Server) requestStreamInterceptor(
 	srv interface{},
 	ss grpc.ServerStream,
 	info *grpc.StreamServerInfo,
 	handler grpc.StreamHandler,
 ) error {
-	atomic.AddInt32(&activeGRPCRequestCount, 1)
-	wg.Add(1)
-	defer func() {
-		wg.Done()
-		atomic.AddInt32(&activeGRPCRequestCount, -1)
-	}()
+	// Health watches last as long as their clients, and are not waited for.
+	if isHealthMethod(info.FullMethod) {
+		return handler(srv, ss)
+	}
+	server.requests.begin()
+	defer server.requests.end()
 	err := handler(srv, ss)
 	return err
 }
 
-func Shutdown_GRPC_Server(server *Server) {
-	mu.Lock()
-	grpcServer, ok := grpcServers[server.Port]
-	mu.Unlock()
-
-	if !ok {
-		fmt.Println("[WARNING] No active gRPC server found to shut down.")
-		return
+func (server *Server) shutdownGRPC(ctx context.Context) error {
+	server.mu.Lock()
+	grpcServer, webServer, healthServer := server.grpc, server.http, server.grpcHealth
+	server.grpc, server.http, server.grpcHealth = nil, nil, nil
+	server.mu.Unlock()
+	if grpcServer == nil {
+		return nil
 	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	fmt.Printf("Waiting for %d active requests to complete before shutting down gRPC server...\n", atomic.LoadInt32(&activeGRPCRequestCount))
-
-	done := make(chan struct{})
-	go func() {
-		wg.Wait()
-		close(done)
-	}()
-
-	select {
-	case <-done:
-		fmt.Println("All active requests completed. Proceeding with shutdown...")
-	case <-ctx.Done():
-		fmt.Println("[WARNING] Timeout waiting for requests. Forcing shutdown...")
+	g := server.gw
+
+	// Probes see the server as not serving while it drains.
+	healthServer.shutdown()
+	g.log.Info("Draining server", "server", "grpc", "active", server.requests.count())
+
+	// Calls served over net/http must be finished before a graceful stop,
+	// which cannot drain them.
+	err := webServer.Shutdown(ctx)
+	if err == nil {
+		stopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
 	}
-
-	mu.Lock()
-	grpcServer.GracefulStop()
-	delete(grpcServers, server.Port)
-	mu.Unlock()
-
-	fmt.Println("gRPC server stopped.")
-	closeAllGRPCConnections()
+	g.removeListeners("grpc")
+	if err != nil {
+		webServer.Close()
+		grpcServer.Stop()
+		g.log.Warn("Timeout draining server, closing its connections", "server", "grpc")
+		return fmt.Errorf("grpc server: %w", err)
+	}
+	g.log.Info("Server stopped", "server", "grpc")
+	return nil
 }
@@ -1,18 +1,59 @@
 package gateway_test
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
+
+	tmservice "github.com/cosmos/cosmos-sdk/client/grpc/tmservice"
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	txsservice "github.com/cosmos/cosmos-sdk/types/tx"
 
 	"github.com/decentrio/gateway/config"
+	"github.com/decentrio/gateway/gateway"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	rpbv1 "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/emptypb"
 )
 
 type MockConfig struct {
@@ -76,3 +117,742 @@ func TestDirector_NoMatchingNode(t *testing.T) {
 	assert.Nil(t, conn)
 	mockConfig.AssertCalled(t, "GetNodebyHeight", uint64(9999))
 }
+
+// testQueryFile describes a module-style query service unknown to the gateway,
+// whose requests carry their height in the body.
+func testQueryFile() *descriptorpb.FileDescriptorProto {
+	field := func(name string, number int32, typ descriptorpb.FieldDescriptorProto_Type, typeName string) *descriptorpb.FieldDescriptorProto {
+		f := &descriptorpb.FieldDescriptorProto{
+			Name:   proto.String(name),
+			Number: proto.Int32(number),
+			Type:   typ.Enum(),
+			Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+		}
+		if typeName != "" {
+			f.TypeName = proto.String(typeName)
+		}
+		return f
+	}
+	method := func(name, input string) *descriptorpb.MethodDescriptorProto {
+		return &descriptorpb.MethodDescriptorProto{
+			Name:       proto.String(name),
+			InputType:  proto.String(input),
+			OutputType: proto.String(".gateway.test.Reply"),
+		}
+	}
+	return &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("gateway/test/query.proto"),
+		Package: proto.String("gateway.test"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{Name: proto.String("BlockRequest"), Field: []*descriptorpb.FieldDescriptorProto{
+				field("height", 1, descriptorpb.FieldDescriptorProto_TYPE_INT64, ""),
+			}},
+			{Name: proto.String("Filter"), Field: []*descriptorpb.FieldDescriptorProto{
+				field("height", 1, descriptorpb.FieldDescriptorProto_TYPE_INT64, ""),
+			}},
+			{Name: proto.String("SearchRequest"), Field: []*descriptorpb.FieldDescriptorProto{
+				field("query", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, ""),
+				field("filter", 2, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, ".gateway.test.Filter"),
+			}},
+			{Name: proto.String("Reply")},
+		},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("Query"),
+			Method: []*descriptorpb.MethodDescriptorProto{
+				method("Block", ".gateway.test.BlockRequest"),
+				method("Search", ".gateway.test.SearchRequest"),
+			},
+		}},
+	}
+}
+
+type testServices []string
+
+func (s testServices) GetServiceInfo() map[string]grpc.ServiceInfo {
+	info := make(map[string]grpc.ServiceInfo)
+	for _, name := range s {
+		info[name] = grpc.ServiceInfo{}
+	}
+	return info
+}
+
+// startFakeGRPCNode serves any method by answering with an empty message and
+// an x-node header naming the node, or three of them for Watch methods. Given files, it also serves reflection for
+// their services.
+func startFakeGRPCNode(t *testing.T, name string, files ...*descriptorpb.FileDescriptorProto) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := grpc.NewServer(grpc.UnknownServiceHandler(func(_ any, stream grpc.ServerStream) error {
+		if err := stream.RecvMsg(&emptypb.Empty{}); err != nil {
+			return err
+		}
+		stream.SetHeader(metadata.Pairs("x-node", name))
+		if method, _ := grpc.Method(stream.Context()); strings.HasSuffix(method, "/Watch") {
+			for i := 0; i < 2; i++ {
+				if err := stream.SendMsg(&emptypb.Empty{}); err != nil {
+					return err
+				}
+			}
+		}
+		return stream.SendMsg(&emptypb.Empty{})
+	}))
+	if len(files) > 0 {
+		registry := new(protoregistry.Files)
+		var services testServices
+		for _, file := range files {
+			fd, err := protodesc.NewFile(file, registry)
+			require.NoError(t, err)
+			require.NoError(t, registry.RegisterFile(fd))
+			for i := 0; i < fd.Services().Len(); i++ {
+				services = append(services, string(fd.Services().Get(i).FullName()))
+			}
+		}
+		rpb.RegisterServerReflectionServer(srv, reflection.NewServer(reflection.ServerOptions{
+			Services:           services,
+			DescriptorResolver: registry,
+		}))
+	}
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	return lis.Addr().String()
+}
+
+func startGRPCGateway(t *testing.T, cfg *config.Config, opts ...gateway.Option) *grpc.ClientConn {
+	return dialGRPCGateway(t, startGateway(t, cfg, append(opts, listenOn(t, "grpc"))...))
+}
+
+func dialGRPCGateway(t *testing.T, gw *gateway.Gateway) *grpc.ClientConn {
+	conn, err := grpc.NewClient(fmt.Sprintf("127.0.0.1:%d", gw.GRPC_Server.Port), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestGRPCProxyRoutesOnRequestHeight(t *testing.T) {
+	height := func(num protowire.Number, h uint64) []byte {
+		return protowire.AppendVarint(protowire.AppendTag(nil, num, protowire.VarintType), h)
+	}
+	search := append(protowire.AppendTag(nil, 1, protowire.BytesType), protowire.AppendString(nil, "q")...)
+	search = protowire.AppendBytes(protowire.AppendTag(search, 2, protowire.BytesType), height(1, 500))
+
+	descriptorSet, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{testQueryFile()}})
+	require.NoError(t, err)
+	descriptorSetPath := filepath.Join(t.TempDir(), "query.pb")
+	require.NoError(t, os.WriteFile(descriptorSetPath, descriptorSet, 0o600))
+
+	sources := []struct {
+		name    string
+		files   []*descriptorpb.FileDescriptorProto
+		options config.GRPCOptions
+	}{
+		{name: "upstream reflection", files: []*descriptorpb.FileDescriptorProto{testQueryFile()}},
+		{name: "descriptor set", options: config.GRPCOptions{DescriptorSets: []string{descriptorSetPath}}},
+	}
+	testcases := []struct {
+		name    string
+		method  string
+		body    []byte
+		expNode string
+	}{
+		{name: "top-level height", method: "/gateway.test.Query/Block", body: height(1, 500), expNode: "archive"},
+		{name: "nested height", method: "/gateway.test.Query/Search", body: search, expNode: "archive"},
+		{name: "no height", method: "/gateway.test.Query/Block", body: nil, expNode: "pruned"},
+		{name: "unknown method", method: "/gateway.test.Query/Other", body: height(1, 500), expNode: "pruned"},
+	}
+	for _, src := range sources {
+		t.Run(src.name, func(t *testing.T) {
+			conn := startGRPCGateway(t, &config.Config{
+				Upstream: []config.Node{
+					{GRPC: startFakeGRPCNode(t, "pruned", src.files...), Blocks: []uint64{100}},
+					{GRPC: startFakeGRPCNode(t, "archive", src.files...), Blocks: []uint64{1, 1000}},
+				},
+				GRPC: src.options,
+			})
+
+			for _, tc := range testcases {
+				t.Run(tc.name, func(t *testing.T) {
+					req := &emptypb.Empty{}
+					req.ProtoReflect().SetUnknown(tc.body)
+
+					var header metadata.MD
+					err := conn.Invoke(context.Background(), tc.method, req, &emptypb.Empty{}, grpc.Header(&header))
+					require.NoError(t, err)
+					require.Equal(t, []string{tc.expNode}, header.Get("x-node"))
+				})
+			}
+		})
+	}
+}
+
+func TestGRPCGatewayServesAggregatedReflection(t *testing.T) {
+	// The upstreams run different versions: only the archive node has Extra.
+	extra := &descriptorpb.FileDescriptorProto{
+		Name:       proto.String("gateway/test/extra.proto"),
+		Package:    proto.String("gateway.test"),
+		Syntax:     proto.String("proto3"),
+		Dependency: []string{"gateway/test/query.proto"},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("Extra"),
+			Method: []*descriptorpb.MethodDescriptorProto{{
+				Name:       proto.String("Ping"),
+				InputType:  proto.String(".gateway.test.Reply"),
+				OutputType: proto.String(".gateway.test.Reply"),
+			}},
+		}},
+	}
+	conn := startGRPCGateway(t, &config.Config{Upstream: []config.Node{
+		{GRPC: startFakeGRPCNode(t, "pruned", testQueryFile()), Blocks: []uint64{100}},
+		{GRPC: startFakeGRPCNode(t, "archive", testQueryFile(), extra), Blocks: []uint64{1, 1000}},
+	}})
+
+	stream, err := rpbv1.NewServerReflectionClient(conn).ServerReflectionInfo(context.Background())
+	require.NoError(t, err)
+	defer stream.CloseSend()
+
+	require.NoError(t, stream.Send(&rpbv1.ServerReflectionRequest{
+		MessageRequest: &rpbv1.ServerReflectionRequest_ListServices{},
+	}))
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	var services []string
+	for _, svc := range res.GetListServicesResponse().GetService() {
+		services = append(services, svc.GetName())
+	}
+	require.Subset(t, services, []string{
+		"gateway.test.Query",
+		"gateway.test.Extra",
+		"cosmos.base.tendermint.v1beta1.Service",
+		"cosmos.tx.v1beta1.Service",
+		"grpc.reflection.v1.ServerReflection",
+	})
+
+	for _, symbol := range []string{"gateway.test.Extra", "cosmos.base.tendermint.v1beta1.Service"} {
+		require.NoError(t, stream.Send(&rpbv1.ServerReflectionRequest{
+			MessageRequest: &rpbv1.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: symbol},
+		}))
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Nil(t, res.GetErrorResponse(), symbol)
+		require.NotEmpty(t, res.GetFileDescriptorResponse().GetFileDescriptorProto(), symbol)
+	}
+}
+
+// fakeTxsNode is a tx service holding one transaction per height in [from, to].
+// It is unavailable for broadcasts, which it counts.
+type fakeTxsNode struct {
+	txsservice.UnimplementedServiceServer
+	from, to   uint64
+	broadcasts atomic.Int32
+}
+
+func (n *fakeTxsNode) BroadcastTx(context.Context, *txsservice.BroadcastTxRequest) (*txsservice.BroadcastTxResponse, error) {
+	n.broadcasts.Add(1)
+	return nil, status.Error(codes.Unavailable, "node is syncing")
+}
+
+func (n *fakeTxsNode) GetTx(_ context.Context, req *txsservice.GetTxRequest) (*txsservice.GetTxResponse, error) {
+	height, err := strconv.ParseUint(strings.TrimPrefix(req.Hash, "TX"), 10, 64)
+	if err != nil || height < n.from || height > n.to {
+		return nil, status.Errorf(codes.NotFound, "tx not found: %s", req.Hash)
+	}
+	return &txsservice.GetTxResponse{TxResponse: &sdk.TxResponse{Height: int64(height), TxHash: req.Hash}}, nil
+}
+
+func (n *fakeTxsNode) GetTxsEvent(_ context.Context, req *txsservice.GetTxsEventRequest) (*txsservice.GetTxsEventResponse, error) {
+	from, to := n.from, n.to
+	for _, event := range req.Events {
+		for _, op := range []string{">=", "<=", "="} {
+			value, ok := strings.CutPrefix(event, "tx.height"+op)
+			if !ok {
+				continue
+			}
+			height, _ := strconv.ParseUint(value, 10, 64)
+			if op != "<=" {
+				from = max(from, height)
+			}
+			if op != ">=" {
+				to = min(to, height)
+			}
+			break
+		}
+	}
+
+	var heights []uint64
+	for h := from; h <= to; h++ {
+		heights = append(heights, h)
+	}
+	if req.OrderBy == txsservice.OrderBy_ORDER_BY_DESC {
+		slices.Reverse(heights)
+	}
+	res := &txsservice.GetTxsEventResponse{Total: uint64(len(heights))}
+	start := min((max(req.Page, 1)-1)*req.Limit, uint64(len(heights)))
+	for _, h := range heights[start:min(start+req.Limit, uint64(len(heights)))] {
+		res.Txs = append(res.Txs, &txsservice.Tx{})
+		res.TxResponses = append(res.TxResponses, &sdk.TxResponse{Height: int64(h), TxHash: fmt.Sprintf("TX%d", h)})
+	}
+	return res, nil
+}
+
+func startFakeTxsNode(t *testing.T, from, to uint64) string {
+	return serveFakeTxsNode(t, &fakeTxsNode{from: from, to: to})
+}
+
+func serveFakeTxsNode(t *testing.T, node *fakeTxsNode) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := grpc.NewServer()
+	txsservice.RegisterServiceServer(srv, node)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	return lis.Addr().String()
+}
+
+func TestGRPCBroadcastTxIsSentOnce(t *testing.T) {
+	first, second := &fakeTxsNode{}, &fakeTxsNode{}
+	client := txsservice.NewServiceClient(startGRPCGateway(t, &config.Config{Upstream: []config.Node{
+		{GRPC: serveFakeTxsNode(t, first), Blocks: []uint64{1, 0}},
+		{GRPC: serveFakeTxsNode(t, second), Blocks: []uint64{1, 0}},
+	}}))
+
+	// A node failing to answer may have taken the transaction, so it is not
+	// sent to the other one.
+	_, err := client.BroadcastTx(context.Background(), &txsservice.BroadcastTxRequest{TxBytes: []byte("tx")})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	require.Equal(t, int32(1), first.broadcasts.Load()+second.broadcasts.Load())
+}
+
+func TestGRPCTxLookupsSpanArchiveSegments(t *testing.T) {
+	// The archive node has heights 1-100, the pruned node 51-150.
+	conn := startGRPCGateway(t, &config.Config{Upstream: []config.Node{
+		{GRPC: startFakeTxsNode(t, 51, 150), Blocks: []uint64{100}},
+		{GRPC: startFakeTxsNode(t, 1, 100), Blocks: []uint64{1, 100}},
+	}})
+	client := txsservice.NewServiceClient(conn)
+	ctx := context.Background()
+
+	t.Run("GetTx", func(t *testing.T) {
+		for _, hash := range []string{"TX5", "TX140"} {
+			res, err := client.GetTx(ctx, &txsservice.GetTxRequest{Hash: hash})
+			require.NoError(t, err)
+			require.Equal(t, hash, res.TxResponse.TxHash)
+		}
+		_, err := client.GetTx(ctx, &txsservice.GetTxRequest{Hash: "TX500"})
+		require.Equal(t, codes.NotFound, status.Code(err))
+	})
+
+	testcases := []struct {
+		name       string
+		req        *txsservice.GetTxsEventRequest
+		expTotal   uint64
+		expHeights []int64
+	}{
+		{
+			name:       "exact height",
+			req:        &txsservice.GetTxsEventRequest{Events: []string{"message.action='send'", "tx.height=120"}, Limit: 10},
+			expTotal:   1,
+			expHeights: []int64{120},
+		},
+		{
+			name:       "range within one node",
+			req:        &txsservice.GetTxsEventRequest{Events: []string{"tx.height>=10", "tx.height<=12"}, Limit: 10},
+			expTotal:   3,
+			expHeights: []int64{10, 11, 12},
+		},
+		{
+			name:       "range across nodes",
+			req:        &txsservice.GetTxsEventRequest{Events: []string{"tx.height>=98", "tx.height<=103"}, Limit: 10},
+			expTotal:   6,
+			expHeights: []int64{98, 99, 100, 101, 102, 103},
+		},
+		{
+			name:       "page across the boundary",
+			req:        &txsservice.GetTxsEventRequest{Events: []string{"message.action='send'"}, Page: 4, Limit: 30},
+			expTotal:   150,
+			expHeights: heightsBetween(91, 120),
+		},
+		{
+			name:       "descending",
+			req:        &txsservice.GetTxsEventRequest{Events: []string{"tx.height<=105"}, OrderBy: txsservice.OrderBy_ORDER_BY_DESC, Page: 2, Limit: 4},
+			expTotal:   105,
+			expHeights: []int64{101, 100, 99, 98},
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := client.GetTxsEvent(ctx, tc.req)
+			require.NoError(t, err)
+			require.Equal(t, tc.expTotal, res.Total)
+			var heights []int64
+			for _, tx := range res.TxResponses {
+				heights = append(heights, tx.Height)
+			}
+			require.Equal(t, tc.expHeights, heights)
+			require.Len(t, res.Txs, len(heights))
+		})
+	}
+}
+
+func heightsBetween(from, to int64) []int64 {
+	var heights []int64
+	for h := from; h <= to; h++ {
+		heights = append(heights, h)
+	}
+	return heights
+}
+
+type fakeTmNode struct {
+	tmservice.UnimplementedServiceServer
+	name string
+}
+
+func (n *fakeTmNode) GetBlockByHeight(ctx context.Context, req *tmservice.GetBlockByHeightRequest) (*tmservice.GetBlockByHeightResponse, error) {
+	grpc.SetHeader(ctx, metadata.Pairs("x-node", n.name))
+	return &tmservice.GetBlockByHeightResponse{}, nil
+}
+
+// countingListener counts the connections accepted by a listener.
+type countingListener struct {
+	net.Listener
+	accepted atomic.Int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+	return conn, err
+}
+
+func startFakeTmNode(t *testing.T, name string) (string, *countingListener) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	counting := &countingListener{Listener: lis}
+	srv := grpc.NewServer()
+	tmservice.RegisterServiceServer(srv, &fakeTmNode{name: name})
+	go srv.Serve(counting)
+	t.Cleanup(srv.Stop)
+	return lis.Addr().String(), counting
+}
+
+func TestGRPCRegisteredServicesRouting(t *testing.T) {
+	t.Run("no upstream", func(t *testing.T) {
+		client := tmservice.NewServiceClient(startGRPCGateway(t, &config.Config{}))
+
+		_, err := client.GetBlockByHeight(context.Background(), &tmservice.GetBlockByHeightRequest{Height: 5})
+		require.Equal(t, codes.NotFound, status.Code(err))
+		_, err = client.GetLatestBlock(context.Background(), &tmservice.GetLatestBlockRequest{})
+		require.Equal(t, codes.Unavailable, status.Code(err))
+	})
+
+	t.Run("failover and pooling", func(t *testing.T) {
+		dead, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		dead.Close()
+		backup, lis := startFakeTmNode(t, "backup")
+		archive, _ := startFakeTmNode(t, "archive")
+
+		client := tmservice.NewServiceClient(startGRPCGateway(t, &config.Config{Upstream: []config.Node{
+			{GRPC: dead.Addr().String(), Blocks: []uint64{1, 1000}},
+			{GRPC: backup, Blocks: []uint64{200, 0}},
+			{GRPC: archive, Blocks: []uint64{1, 100}},
+		}}))
+
+		for i := 0; i < 5; i++ {
+			var header metadata.MD
+			_, err := client.GetBlockByHeight(context.Background(), &tmservice.GetBlockByHeightRequest{Height: 500}, grpc.Header(&header))
+			require.NoError(t, err)
+			require.Equal(t, []string{"backup"}, header.Get("x-node"))
+		}
+		require.Equal(t, int32(1), lis.accepted.Load())
+
+		// The header routes calls without a height of their own.
+		var header metadata.MD
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "x-cosmos-block-height", "50")
+		_, err = client.GetBlockByHeight(ctx, &tmservice.GetBlockByHeightRequest{}, grpc.Header(&header))
+		require.NoError(t, err)
+		require.Equal(t, []string{"archive"}, header.Get("x-node"))
+	})
+}
+
+func TestGRPCWebAndConnectCalls(t *testing.T) {
+	conn := startGRPCGateway(t, &config.Config{
+		Upstream: []config.Node{
+			{GRPC: startFakeGRPCNode(t, "pruned", testQueryFile()), Blocks: []uint64{100}},
+			{GRPC: startFakeGRPCNode(t, "archive", testQueryFile()), Blocks: []uint64{1, 1000}},
+		},
+	})
+	base := "http://" + conn.Target()
+	frame := func(flag byte, msg []byte) []byte {
+		return append([]byte{flag, 0, 0, 0, byte(len(msg))}, msg...)
+	}
+	blockAt := protowire.AppendVarint(protowire.AppendTag(nil, 1, protowire.VarintType), 500)
+
+	post := func(t *testing.T, path, contentType string, body []byte, header map[string]string) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, base+path, bytes.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", contentType)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { res.Body.Close() })
+		require.Equal(t, 1, res.ProtoMajor)
+		return res
+	}
+
+	t.Run("native gRPC on the same port", func(t *testing.T) {
+		var header metadata.MD
+		err := conn.Invoke(context.Background(), "/gateway.test.Query/Block", &emptypb.Empty{}, &emptypb.Empty{}, grpc.Header(&header))
+		require.NoError(t, err)
+		require.Equal(t, []string{"pruned"}, header.Get("x-node"))
+	})
+
+	t.Run("gRPC-Web binary", func(t *testing.T) {
+		res := post(t, "/gateway.test.Query/Block", "application/grpc-web+proto", frame(0, blockAt), nil)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Equal(t, "archive", res.Header.Get("x-node"))
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		require.Equal(t, frame(0, nil), body[:5])
+		require.Equal(t, byte(0x80), body[5])
+		require.Contains(t, strings.ToLower(string(body[10:])), "grpc-status: 0")
+	})
+
+	t.Run("gRPC-Web text", func(t *testing.T) {
+		body := []byte(base64.StdEncoding.EncodeToString(frame(0, blockAt)))
+		res := post(t, "/gateway.test.Query/Block", "application/grpc-web-text", body, nil)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Equal(t, "archive", res.Header.Get("x-node"))
+		encoded, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		var decoded []byte
+		// Messages and trailers are encoded separately, each with padding.
+		for _, chunk := range strings.SplitAfter(string(encoded), "=") {
+			if strings.Trim(chunk, "=") == "" {
+				continue
+			}
+			b, err := base64.StdEncoding.DecodeString(chunk)
+			require.NoError(t, err)
+			decoded = append(decoded, b...)
+		}
+		require.Contains(t, strings.ToLower(string(decoded)), "grpc-status: 0")
+	})
+
+	t.Run("gRPC-Web server streaming", func(t *testing.T) {
+		res := post(t, "/gateway.test.Query/Watch", "application/grpc-web+proto", frame(0, nil), nil)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		require.Equal(t, bytes.Repeat(frame(0, nil), 3), body[:15])
+		require.Equal(t, byte(0x80), body[15])
+		require.Contains(t, strings.ToLower(string(body[20:])), "grpc-status: 0")
+	})
+
+	t.Run("Connect proto", func(t *testing.T) {
+		res := post(t, "/gateway.test.Query/Block", "application/proto", blockAt, map[string]string{"Connect-Protocol-Version": "1"})
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Equal(t, "application/proto", res.Header.Get("Content-Type"))
+		require.Equal(t, "archive", res.Header.Get("x-node"))
+	})
+
+	t.Run("Connect JSON", func(t *testing.T) {
+		res := post(t, "/gateway.test.Query/Search", "application/json", []byte(`{"query":"q","filter":{"height":"500"}}`), nil)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Equal(t, "application/json", res.Header.Get("Content-Type"))
+		require.Equal(t, "archive", res.Header.Get("x-node"))
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		require.JSONEq(t, `{}`, string(body))
+	})
+
+	t.Run("Connect GET", func(t *testing.T) {
+		q := url.Values{"encoding": {"json"}, "message": {`{"height":"500"}`}}
+		res, err := http.Get(base + "/gateway.test.Query/Block?" + q.Encode())
+		require.NoError(t, err)
+		defer res.Body.Close()
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Equal(t, "archive", res.Header.Get("x-node"))
+	})
+
+	t.Run("Connect errors", func(t *testing.T) {
+		testcases := []struct {
+			name      string
+			path      string
+			header    map[string]string
+			expStatus int
+			expCode   string
+		}{
+			{name: "routing error", path: "/gateway.test.Query/Block", header: map[string]string{"x-cosmos-block-height": "abc"}, expStatus: http.StatusBadRequest, expCode: "invalid_argument"},
+			{name: "unknown method", path: "/gateway.test.Query/Other", expStatus: http.StatusNotImplemented, expCode: "unimplemented"},
+		}
+		for _, tc := range testcases {
+			t.Run(tc.name, func(t *testing.T) {
+				res := post(t, tc.path, "application/json", []byte(`{}`), tc.header)
+				require.Equal(t, tc.expStatus, res.StatusCode)
+				require.Equal(t, "application/json", res.Header.Get("Content-Type"))
+				var body struct{ Code, Message string }
+				require.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+				require.Equal(t, tc.expCode, body.Code)
+				require.NotEmpty(t, body.Message)
+			})
+		}
+	})
+
+	t.Run("Connect oversize", func(t *testing.T) {
+		var bomb bytes.Buffer
+		zw := gzip.NewWriter(&bomb)
+		zw.Write(make([]byte, 11<<20))
+		require.NoError(t, zw.Close())
+		for name, body := range map[string][]byte{"plain": make([]byte, 11<<20), "gzip": bomb.Bytes()} {
+			header := map[string]string{}
+			if name == "gzip" {
+				header["Content-Encoding"] = "gzip"
+			}
+			res := post(t, "/gateway.test.Query/Block", "application/proto", body, header)
+			require.Equal(t, http.StatusTooManyRequests, res.StatusCode, name)
+			var connectErr struct{ Code string }
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&connectErr))
+			require.Equal(t, "resource_exhausted", connectErr.Code, name)
+		}
+	})
+
+	t.Run("CORS", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodOptions, base+"/gateway.test.Query/Block", nil)
+		require.NoError(t, err)
+		req.Header.Set("Origin", "https://app.example")
+		req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		req.Header.Set("Access-Control-Request-Headers", "content-type,x-grpc-web,x-user-agent")
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		require.Equal(t, http.StatusNoContent, res.StatusCode)
+		require.Equal(t, "*", res.Header.Get("Access-Control-Allow-Origin"))
+
+		res = post(t, "/gateway.test.Query/Block", "application/grpc-web+proto", frame(0, nil), map[string]string{"Origin": "https://app.example"})
+		require.Equal(t, "*", res.Header.Get("Access-Control-Allow-Origin"))
+		require.Contains(t, strings.ToLower(res.Header.Get("Access-Control-Expose-Headers")), "grpc-status")
+	})
+}
+
+// writeTestCertificate creates a self-signed certificate for 127.0.0.1 and
+// node.test, usable both as CA and as server or client certificate, and writes
+// it and its key as PEM files.
+func writeTestCertificate(t *testing.T) (certFile, keyFile string, cert tls.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "node.test"},
+		DNSNames:              []string{"node.test"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, certPEM, 0o600))
+	require.NoError(t, os.WriteFile(keyFile, keyPEM, 0o600))
+	cert, err = tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+	return certFile, keyFile, cert
+}
+
+// flakyListener fails its first accepts as when out of file descriptors.
+type flakyListener struct {
+	net.Listener
+	failures atomic.Int32
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures.Add(-1) >= 0 {
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}
+	}
+	return l.Listener.Accept()
+}
+
+func TestGRPCPortSurvivesAcceptErrors(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	flaky := &flakyListener{Listener: lis}
+	flaky.failures.Store(3)
+
+	conn := dialGRPCGateway(t, startGateway(t, &config.Config{
+		Upstream: []config.Node{{GRPC: startFakeGRPCNode(t, "node"), Blocks: []uint64{1, 0}}},
+	}, gateway.WithListener("grpc", flaky)))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, conn.Invoke(ctx, "/gateway.test.Query/Block", &emptypb.Empty{}, &emptypb.Empty{}))
+}
+
+func TestGRPCUpstreamTLS(t *testing.T) {
+	certFile, keyFile, cert := writeTestCertificate(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := grpc.NewServer(
+		grpc.Creds(credentials.NewTLS(&tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientCAs:    roots,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		})),
+		grpc.UnknownServiceHandler(func(_ any, stream grpc.ServerStream) error {
+			if err := stream.RecvMsg(&emptypb.Empty{}); err != nil {
+				return err
+			}
+			stream.SetHeader(metadata.Pairs("x-node", "tls"))
+			return stream.SendMsg(&emptypb.Empty{})
+		}),
+	)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	// Dialed by name so that server_name has to be used for verification.
+	addr := strings.Replace(lis.Addr().String(), "127.0.0.1", "localhost", 1)
+
+	testcases := []struct {
+		name   string
+		tls    config.TLS
+		expErr bool
+	}{
+		{name: "verified with client certificate", tls: config.TLS{Enable: true, CAFile: certFile, CertFile: certFile, KeyFile: keyFile, ServerName: "node.test"}},
+		{name: "plaintext", expErr: true},
+		{name: "unknown server name", tls: config.TLS{Enable: true, CAFile: certFile, CertFile: certFile, KeyFile: keyFile}, expErr: true},
+		{name: "untrusted certificate", tls: config.TLS{Enable: true, CertFile: certFile, KeyFile: keyFile, ServerName: "node.test"}, expErr: true},
+		{name: "skip verify without client certificate", tls: config.TLS{Enable: true, InsecureSkipVerify: true}, expErr: true},
+		{name: "skip verify with client certificate", tls: config.TLS{Enable: true, InsecureSkipVerify: true, CertFile: certFile, KeyFile: keyFile}},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			conn := startGRPCGateway(t, &config.Config{
+				Upstream: []config.Node{{GRPC: addr, Blocks: []uint64{1, 0}, TLS: config.NodeTLS{GRPC: tc.tls}}},
+			})
+
+			var header metadata.MD
+			err := conn.Invoke(context.Background(), "/gateway.test.Query/Block", &emptypb.Empty{}, &emptypb.Empty{}, grpc.Header(&header))
+			if tc.expErr {
+				require.Equal(t, codes.Unavailable, status.Code(err))
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, []string{"tls"}, header.Get("x-node"))
+		})
+	}
+}
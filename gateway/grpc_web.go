@@ -0,0 +1,496 @@
+package gateway
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rs/cors"
+	"golang.org/x/net/http2"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// hopHeaders only make sense on the HTTP/1.1 hop from the browser and must not
+// be relayed as gRPC metadata.
+var hopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade"}
+
+// grpcHTTPHandler serves the calls of the gRPC port that are not native gRPC:
+// gRPC-Web (binary and text) and unary Connect calls are translated into gRPC
+// requests on server, so they go through the same director and routing as
+// native calls. gRPC-Web responses are streamed, so server streaming works
+// over it; Connect streaming calls are not supported.
+func (g *Gateway) grpcHTTPHandler(server *grpc.Server) http.Handler {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, h := range hopHeaders {
+			r.Header.Del(h)
+		}
+		if contentType, ok := grpcWebContentType(r); ok {
+			serveGRPCWeb(server, contentType, w, r)
+			return
+		}
+		if codec, ok := connectCodec(r); ok {
+			g.serveConnect(server, codec, w, r)
+			return
+		}
+		http.Error(w, "unsupported protocol: expected gRPC, gRPC-Web or Connect", http.StatusUnsupportedMediaType)
+	})
+
+	origins := g.cfg.Get().GRPC.CORSAllowedOrigins
+	if len(origins) == 0 {
+		origins = []string{"*"}
+	}
+	return cors.New(cors.Options{
+		AllowedOrigins: origins,
+		AllowedMethods: []string{http.MethodGet, http.MethodPost},
+		AllowedHeaders: []string{"*"},
+		ExposedHeaders: []string{"Grpc-Status", "Grpc-Message", "Grpc-Status-Details-Bin"},
+		MaxAge:         7200,
+	}).Handler(handler)
+}
+
+// grpcTLSHandler sends native gRPC calls, which arrive over HTTP/2 on TLS
+// listeners, straight to server and everything else to next.
+func grpcTLSHandler(server *grpc.Server, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType := r.Header.Get("Content-Type")
+		if r.ProtoMajor == 2 && strings.HasPrefix(contentType, "application/grpc") && !strings.HasPrefix(contentType, "application/grpc-web") {
+			server.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// grpcWebContentType reports whether r is a gRPC-Web call and, if so, returns
+// its content type without parameters.
+func grpcWebContentType(r *http.Request) (string, bool) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType, r.Method == http.MethodPost && strings.HasPrefix(mediaType, "application/grpc-web")
+}
+
+// serveGRPCWeb runs a gRPC-Web call as a gRPC call on server. The messages
+// are framed as in gRPC, base64 encoded for grpc-web-text, and the trailers
+// are sent as a last frame of the body.
+func serveGRPCWeb(server *grpc.Server, contentType string, w http.ResponseWriter, r *http.Request) {
+	text := strings.HasPrefix(contentType, "application/grpc-web-text")
+	subtype := strings.TrimPrefix(strings.TrimPrefix(contentType, "application/grpc-web"), "-text")
+
+	req := r.Clone(r.Context())
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/2.0", 2, 0
+	req.Header.Del("Content-Length")
+	req.ContentLength = -1
+	req.Header.Set("Content-Type", "application/grpc"+subtype)
+	req.Header.Set("Te", "trailers")
+	if text {
+		req.Body = io.NopCloser(base64.NewDecoder(base64.StdEncoding, r.Body))
+	}
+
+	rw := &grpcWebResponseWriter{w: w, contentType: contentType, text: text, header: make(http.Header)}
+	server.ServeHTTP(rw, req)
+	rw.writeTrailer()
+}
+
+// grpcWebResponseWriter passes the response of a gRPC call on to a gRPC-Web
+// client as it is written.
+type grpcWebResponseWriter struct {
+	w           http.ResponseWriter
+	contentType string
+	text        bool
+	header      http.Header
+	sent        http.Header // header as of the start of the response
+}
+
+func (rw *grpcWebResponseWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *grpcWebResponseWriter) WriteHeader(int) {
+	if rw.sent != nil {
+		return
+	}
+	rw.sent = rw.header.Clone()
+	for k, v := range rw.sent {
+		if k != "Trailer" && k != "Content-Type" && k != "Content-Length" {
+			rw.w.Header()[k] = v
+		}
+	}
+	rw.w.Header().Set("Content-Type", rw.contentType)
+	rw.w.WriteHeader(http.StatusOK)
+}
+
+func (rw *grpcWebResponseWriter) Write(b []byte) (int, error) {
+	rw.WriteHeader(http.StatusOK)
+	if rw.text {
+		if _, err := io.WriteString(rw.w, base64.StdEncoding.EncodeToString(b)); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	return rw.w.Write(b)
+}
+
+func (rw *grpcWebResponseWriter) Flush() {
+	rw.WriteHeader(http.StatusOK)
+	if f, ok := rw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// writeTrailer ends the response with the trailers of the call, as a frame
+// flagged 0x80 holding them in HTTP/1.1 header format.
+func (rw *grpcWebResponseWriter) writeTrailer() {
+	rw.WriteHeader(http.StatusOK)
+	trailer := responseTrailer(rw.sent, rw.header)
+	keys := make([]string, 0, len(trailer))
+	for k := range trailer {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var block bytes.Buffer
+	for _, k := range keys {
+		for _, v := range trailer[k] {
+			fmt.Fprintf(&block, "%s: %s\r\n", strings.ToLower(k), v)
+		}
+	}
+	frame := make([]byte, 5, 5+block.Len())
+	frame[0] = 0x80
+	binary.BigEndian.PutUint32(frame[1:5], uint32(block.Len()))
+	rw.Write(append(frame, block.Bytes()...))
+	rw.Flush()
+}
+
+// connectCodec reports whether r is a unary Connect call and, if so, whether
+// its messages are encoded as "proto" or "json".
+func connectCodec(r *http.Request) (string, bool) {
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		if enc := q.Get("encoding"); q.Has("message") && (enc == "proto" || enc == "json") {
+			return enc, true
+		}
+	case http.MethodPost:
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch mediaType {
+		case "application/proto":
+			return "proto", true
+		case "application/json":
+			return "json", true
+		}
+	}
+	return "", false
+}
+
+// serveConnect runs a unary Connect call as a gRPC call on server.
+func (g *Gateway) serveConnect(server *grpc.Server, codec string, w http.ResponseWriter, r *http.Request) {
+	var method protoreflect.MethodDescriptor
+	if codec == "json" {
+		if method = g.grpcDescriptors.method(r.URL.Path); method == nil {
+			writeConnectError(w, nil, status.Newf(codes.Unimplemented, "unknown method %s", r.URL.Path))
+			return
+		}
+	}
+
+	msg, err := readConnectMessage(w, r)
+	if err != nil {
+		writeConnectError(w, nil, status.Convert(err))
+		return
+	}
+	if method != nil {
+		if msg, err = g.jsonToProto(method.Input(), msg); err != nil {
+			writeConnectError(w, nil, status.Newf(codes.InvalidArgument, "invalid request: %v", err))
+			return
+		}
+	}
+
+	frame := make([]byte, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(msg)))
+	copy(frame[5:], msg)
+
+	req := r.Clone(r.Context())
+	req.Method = http.MethodPost
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/2.0", 2, 0
+	for _, h := range []string{"Content-Length", "Content-Encoding", "Accept-Encoding", "Connect-Protocol-Version", "Connect-Accept-Encoding", "Connect-Timeout-Ms"} {
+		req.Header.Del(h)
+	}
+	req.Header.Set("Content-Type", "application/grpc+proto")
+	req.Header.Set("Te", "trailers")
+	if ms := r.Header.Get("Connect-Timeout-Ms"); ms != "" {
+		req.Header.Set("Grpc-Timeout", ms+"m")
+	}
+	req.Body = io.NopCloser(bytes.NewReader(frame))
+	req.ContentLength = int64(len(frame))
+
+	rec := &grpcResponseRecorder{header: make(http.Header)}
+	server.ServeHTTP(rec, req)
+
+	st := rec.status()
+	if st.Code() != codes.OK {
+		writeConnectError(w, rec, st)
+		return
+	}
+	res, err := rec.message()
+	if err == nil && method != nil {
+		res, err = g.protoToJSON(method.Output(), res)
+	}
+	if err != nil {
+		writeConnectError(w, rec, status.New(codes.Internal, err.Error()))
+		return
+	}
+
+	rec.copyMetadata(w.Header())
+	w.Header().Set("Content-Type", "application/"+codec)
+	w.Header().Set("Content-Length", strconv.Itoa(len(res)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(res)
+}
+
+// readConnectMessage returns the request message of a unary Connect call,
+// decompressed. Messages are capped at maxRequestBodyBytes, compressed or not.
+func readConnectMessage(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	var (
+		msg         []byte
+		compression string
+		err         error
+	)
+	if r.Method == http.MethodGet {
+		q := r.URL.Query()
+		msg = []byte(q.Get("message"))
+		if q.Get("base64") == "1" {
+			msg, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(string(msg), "="))
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid base64 message: %v", err)
+			}
+		}
+		compression = q.Get("compression")
+	} else {
+		if msg, err = io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBodyBytes)); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				return nil, status.Errorf(codes.ResourceExhausted, "request larger than %d bytes", maxRequestBodyBytes)
+			}
+			return nil, status.Errorf(codes.InvalidArgument, "failed to read request: %v", err)
+		}
+		compression = r.Header.Get("Content-Encoding")
+	}
+
+	switch compression {
+	case "", "identity":
+		return msg, nil
+	case "gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(msg))
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid gzip message: %v", err)
+		}
+		defer zr.Close()
+		if msg, err = io.ReadAll(io.LimitReader(zr, maxRequestBodyBytes+1)); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid gzip message: %v", err)
+		}
+		if len(msg) > maxRequestBodyBytes {
+			return nil, status.Errorf(codes.ResourceExhausted, "request larger than %d bytes", maxRequestBodyBytes)
+		}
+		return msg, nil
+	default:
+		return nil, status.Errorf(codes.Unimplemented, "unsupported compression %q", compression)
+	}
+}
+
+func (g *Gateway) jsonToProto(md protoreflect.MessageDescriptor, data []byte) ([]byte, error) {
+	msg := dynamicpb.NewMessage(md)
+	if len(bytes.TrimSpace(data)) > 0 {
+		if err := (protojson.UnmarshalOptions{Resolver: g.grpcDescriptors}).Unmarshal(data, msg); err != nil {
+			return nil, err
+		}
+	}
+	return proto.Marshal(msg)
+}
+
+func (g *Gateway) protoToJSON(md protoreflect.MessageDescriptor, data []byte) ([]byte, error) {
+	msg := dynamicpb.NewMessage(md)
+	if err := (proto.UnmarshalOptions{Resolver: g.grpcDescriptors}).Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+	return protojson.MarshalOptions{Resolver: g.grpcDescriptors}.Marshal(msg)
+}
+
+// connectCodes maps gRPC codes to their Connect names and HTTP statuses.
+var connectCodes = map[codes.Code]struct {
+	name   string
+	status int
+}{
+	codes.Canceled:           {"canceled", 499},
+	codes.Unknown:            {"unknown", http.StatusInternalServerError},
+	codes.InvalidArgument:    {"invalid_argument", http.StatusBadRequest},
+	codes.DeadlineExceeded:   {"deadline_exceeded", http.StatusGatewayTimeout},
+	codes.NotFound:           {"not_found", http.StatusNotFound},
+	codes.AlreadyExists:      {"already_exists", http.StatusConflict},
+	codes.PermissionDenied:   {"permission_denied", http.StatusForbidden},
+	codes.ResourceExhausted:  {"resource_exhausted", http.StatusTooManyRequests},
+	codes.FailedPrecondition: {"failed_precondition", http.StatusBadRequest},
+	codes.Aborted:            {"aborted", http.StatusConflict},
+	codes.OutOfRange:         {"out_of_range", http.StatusBadRequest},
+	codes.Unimplemented:      {"unimplemented", http.StatusNotImplemented},
+	codes.Internal:           {"internal", http.StatusInternalServerError},
+	codes.Unavailable:        {"unavailable", http.StatusServiceUnavailable},
+	codes.DataLoss:           {"data_loss", http.StatusInternalServerError},
+	codes.Unauthenticated:    {"unauthenticated", http.StatusUnauthorized},
+}
+
+type connectErrorDetail struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type connectError struct {
+	Code    string               `json:"code"`
+	Message string               `json:"message,omitempty"`
+	Details []connectErrorDetail `json:"details,omitempty"`
+}
+
+// writeConnectError writes st as a Connect error, along with the metadata of
+// the gRPC response if there was one.
+func writeConnectError(w http.ResponseWriter, rec *grpcResponseRecorder, st *status.Status) {
+	c, ok := connectCodes[st.Code()]
+	if !ok {
+		c = connectCodes[codes.Unknown]
+	}
+	body := connectError{Code: c.name, Message: st.Message()}
+	for _, d := range st.Proto().GetDetails() {
+		body.Details = append(body.Details, connectErrorDetail{
+			Type:  d.GetTypeUrl()[strings.LastIndexByte(d.GetTypeUrl(), '/')+1:],
+			Value: base64.RawStdEncoding.EncodeToString(d.GetValue()),
+		})
+	}
+
+	if rec != nil {
+		rec.copyMetadata(w.Header())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(c.status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// grpcResponseRecorder collects the response of a gRPC call served through
+// grpc.Server.ServeHTTP, telling headers and trailers apart the way net/http
+// would.
+type grpcResponseRecorder struct {
+	header http.Header
+	sent   http.Header // header as of the start of the response
+	body   bytes.Buffer
+}
+
+func (r *grpcResponseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *grpcResponseRecorder) WriteHeader(int) {
+	if r.sent == nil {
+		r.sent = r.header.Clone()
+	}
+}
+
+func (r *grpcResponseRecorder) Write(b []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(b)
+}
+
+func (r *grpcResponseRecorder) Flush() {
+	r.WriteHeader(http.StatusOK)
+}
+
+func (r *grpcResponseRecorder) trailer() http.Header {
+	r.WriteHeader(http.StatusOK)
+	return responseTrailer(r.sent, r.header)
+}
+
+// responseTrailer returns the trailers set on header after the response
+// started with sent: the keys sent declared, and those with the
+// http2.TrailerPrefix.
+func responseTrailer(sent, header http.Header) http.Header {
+	declared := make(map[string]bool)
+	for _, k := range sent.Values("Trailer") {
+		declared[http.CanonicalHeaderKey(k)] = true
+	}
+	trailer := make(http.Header)
+	for k, v := range header {
+		if name, ok := strings.CutPrefix(k, http2.TrailerPrefix); ok {
+			trailer[http.CanonicalHeaderKey(name)] = v
+		} else if declared[k] {
+			trailer[k] = v
+		}
+	}
+	return trailer
+}
+
+func (r *grpcResponseRecorder) status() *status.Status {
+	trailer := r.trailer()
+	if bin := trailer.Get("Grpc-Status-Details-Bin"); bin != "" {
+		if data, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(bin, "=")); err == nil {
+			p := &spb.Status{}
+			if proto.Unmarshal(data, p) == nil {
+				return status.FromProto(p)
+			}
+		}
+	}
+	code, err := strconv.Atoi(trailer.Get("Grpc-Status"))
+	if err != nil {
+		return status.New(codes.Internal, "missing grpc-status in upstream response")
+	}
+	msg, err := url.PathUnescape(trailer.Get("Grpc-Message"))
+	if err != nil {
+		msg = trailer.Get("Grpc-Message")
+	}
+	return status.New(codes.Code(code), msg)
+}
+
+// message returns the single message of a unary response.
+func (r *grpcResponseRecorder) message() ([]byte, error) {
+	b := r.body.Bytes()
+	if len(b) < 5 {
+		return nil, fmt.Errorf("missing response message")
+	}
+	if b[0]&1 != 0 {
+		return nil, fmt.Errorf("compressed response messages are not supported")
+	}
+	n := binary.BigEndian.Uint32(b[1:5])
+	if uint32(len(b)-5) < n {
+		return nil, fmt.Errorf("truncated response message")
+	}
+	return b[5 : 5+n], nil
+}
+
+// copyMetadata sets the response headers of the call on h, and its trailers
+// with the "Trailer-" prefix Connect uses for unary calls.
+func (r *grpcResponseRecorder) copyMetadata(h http.Header) {
+	r.WriteHeader(http.StatusOK)
+	for k, v := range r.sent {
+		if k == "Content-Type" || k == "Trailer" || k == "Date" || strings.HasPrefix(k, "Grpc-") {
+			continue
+		}
+		h[k] = v
+	}
+	for k, v := range r.trailer() {
+		if strings.HasPrefix(k, "Grpc-") {
+			continue
+		}
+		h["Trailer-"+k] = v
+	}
+}
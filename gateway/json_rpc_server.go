@@ -7,25 +7,33 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"math"
 	"net/http"
-	"os"
-	"os/signal"
 	"strconv"
 	"strings"
-	"sync/atomic"
-	"syscall"
 	"time"
 
-	"github.com/decentrio/gateway/config"
-	httpUtils "github.com/decentrio/gateway/utils"
+	"github.com/decentrio/gateway/logging"
+)
+
+// Standard JSON-RPC 2.0 error codes, plus the implementation-defined server
+// errors (-32000 to -32099) used by the gateway.
+const (
+	jsonRPCParseError     = -32700
+	jsonRPCInvalidRequest = -32600
+	jsonRPCMethodNotFound = -32601
+	jsonRPCInvalidParams  = -32602
+	jsonRPCServerError    = -32000 // no node can serve the request
+	jsonRPCUpstreamError  = -32001 // the upstream node could not be reached
+	jsonRPCUnauthorized   = -32002 // the API key is missing or was rejected
+	jsonRPCLimitExceeded  = -32005 // the client went over its rate limit (EIP-1474)
 )
 
 // Error type
 type JSONRPCError struct {
-	Code    int    `json:"code"`
-	Message string `json:"message"`
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
 }
 
 // JSON-RPC request format
@@ -44,11 +52,6 @@ type JSONRPCResponse struct {
 	Error   *JSONRPCError   `json:"error,omitempty"`
 }
 
-var (
-	jsonRPCServers            = make(map[uint16]*http.Server)
-	activeJsonRPCRequestCount int32
-)
-
 var errBlockHashSelector = errors.New("block hash selector provided")
 var nullJSONRPCID = json.RawMessage("null")
 
@@ -75,94 +78,37 @@ func formatIDForLog(id json.RawMessage) string {
 	return string(id)
 }
 
-func Start_JSON_RPC_Server(server *Server) {
-	fmt.Printf("Starting JSON-RPC server on port %d\n", server.Port)
+func (server *Server) startJSONRPC() error {
+	g := server.gw
+	g.log.Info("Starting JSON-RPC server")
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", trackRequestsMiddleware(handleJSONRPC))
+	mux.HandleFunc("/", server.trackRequests(g.handleJSONRPC))
 
 	srv := &http.Server{
-		Addr:    fmt.Sprintf(":%d", server.Port),
-		Handler: mux,
+		Handler: g.instrumentHTTP("jsonrpc", g.withProbes(g.withMiddleware(g.requireAPIKey("jsonrpc", rejectJSONRPC, g.filterMethods("jsonrpc", rejectJSONRPC, g.rateLimit("jsonrpc", rejectJSONRPC, mux)))))),
 	}
 
-	mu.Lock()
-	jsonRPCServers[server.Port] = srv
-	mu.Unlock()
-
-	go func() {
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Error starting JSON-RPC server: %v", err)
-		}
-	}()
-
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
-	<-stop
-
-	Shutdown_JSON_RPC_Server(server)
+	return server.startHTTP(srv, g.cfg.Get().TLS.JSONRPC)
 }
 
-func Shutdown_JSON_RPC_Server(server *Server) {
-	mu.Lock()
-	srv, exists := jsonRPCServers[server.Port]
-	if !exists {
-		mu.Unlock()
-		return
-	}
-	delete(jsonRPCServers, server.Port)
-	mu.Unlock()
-
-	fmt.Printf("Waiting for %d active requests to complete before shutting down JSON-RPC server...\n", atomic.LoadInt32(&activeJsonRPCRequestCount))
-
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	done := make(chan struct{})
-	go func() {
-		wg.Wait()
-		close(done)
-	}()
-
-	select {
-	case <-done:
-		fmt.Println("All active requests completed. Proceeding with shutdown...")
-	case <-ctx.Done():
-		fmt.Println("[WARNING] Timeout waiting for requests. Forcing shutdown...")
-	}
-
-	if err := srv.Shutdown(ctx); err != nil {
-		fmt.Printf("Error shutting down JSON-RPC server: %v\n", err)
-	} else {
-		fmt.Println("JSON-RPC server stopped.")
-	}
-}
-
-func trackRequestsMiddleware(next http.HandlerFunc) http.HandlerFunc {
+func (server *Server) trackRequests(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		atomic.AddInt32(&activeJsonRPCRequestCount, 1)
-		wg.Add(1)
-
-		defer func() {
-			wg.Done()
-			atomic.AddInt32(&activeJsonRPCRequestCount, -1)
-		}()
-
+		server.requests.begin()
+		defer server.requests.end()
 		next(w, r)
 	}
 }
 
-func handleJSONRPC(w http.ResponseWriter, r *http.Request) {
+func (g *Gateway) handleJSONRPC(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(r.Context(), 60*time.Second)
 	defer cancel()
 
-	select {
-	case semaphore <- struct{}{}:
-		defer func() { <-semaphore }()
-	case <-ctx.Done():
+	if !g.acquireSemaphore(ctx) {
 		http.Error(w, "Server busy, please try again later", http.StatusTooManyRequests)
 		return
 	}
+	defer func() { <-g.semaphore }()
 	var req JSONRPCRequest
 	var res JSONRPCResponse
 	if r.Method != http.MethodPost {
@@ -199,7 +145,7 @@ func handleJSONRPC(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(res)
 		return
 	}
-	fmt.Printf("Received JSON-RPC request: Method=%s, ID=%s, Params=%s\n", req.Method, formatIDForLog(req.ID), string(req.Params))
+	g.log.DebugContext(r.Context(), "Received JSON-RPC request", "method", req.Method, "id", formatIDForLog(req.ID))
 	paramsMap := make([]any, len(req.Params))
 	json.Unmarshal(req.Params, &paramsMap)
 	var height uint64 = math.MaxUint64
@@ -211,7 +157,7 @@ func handleJSONRPC(w http.ResponseWriter, r *http.Request) {
 		"eth_getBlockTransactionCountByHash",
 		"eth_getTransactionByBlockHashAndIndex",
 		"eth_getUncleByBlockHashAndIndex":
-		checkRequestManually(w, r)
+		g.checkRequestManually(w, r)
 		return
 	case "eth_newFilter", /// ????
 		"eth_getLogs":
@@ -230,7 +176,7 @@ func handleJSONRPC(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			if errors.Is(err, errBlockHashSelector) {
 				r.Body = io.NopCloser(bytes.NewReader(body))
-				checkRequestManually(w, r)
+				g.checkRequestManually(w, r)
 				return
 			}
 			res = JSONRPCResponse{
@@ -246,7 +192,7 @@ func handleJSONRPC(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			if errors.Is(err, errBlockHashSelector) {
 				r.Body = io.NopCloser(bytes.NewReader(body))
-				checkRequestManually(w, r)
+				g.checkRequestManually(w, r)
 				return
 			}
 			res = JSONRPCResponse{
@@ -265,7 +211,7 @@ func handleJSONRPC(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			if errors.Is(err, errBlockHashSelector) {
 				r.Body = io.NopCloser(bytes.NewReader(body))
-				checkRequestManually(w, r)
+				g.checkRequestManually(w, r)
 				return
 			}
 			res = JSONRPCResponse{
@@ -280,8 +226,7 @@ func handleJSONRPC(w http.ResponseWriter, r *http.Request) {
 		height = 0
 	}
 
-	fmt.Printf("Height: %d\n", height)
-	node := config.GetNodebyHeight(height)
+	node := g.routeByHeight(r.Context(), height)
 	if node == nil {
 		res = JSONRPCResponse{
 			JSONRPC: "2.0",
@@ -292,8 +237,8 @@ func handleJSONRPC(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(res)
 		return
 	}
-	fmt.Println("Node called:", node.JSONRPC)
-	httpUtils.FowardRequest(w, r, node.JSONRPC)
+	g.log.DebugContext(r.Context(), "Node called", "upstream", node.JSONRPC)
+	g.http.FowardRequest(w, r, node.JSONRPC)
 }
 
 func getHeightFromParams(params []any, index int) (uint64, error) {
@@ -368,8 +313,10 @@ func parseHeightFromAny(value any) (uint64, error) {
 	}
 }
 
-func checkRequestManually(w http.ResponseWriter, r *http.Request) {
-	ETH_nodes := config.GetNodesByType("jsonrpc")
+func (g *Gateway) checkRequestManually(w http.ResponseWriter, r *http.Request) {
+	ETH_nodes := g.cfg.Get().NodesByType("jsonrpc")
+	fanoutCtx, fanout := startFanout(r.Context(), len(ETH_nodes))
+	defer fanout.End()
 	var msg JSONRPCResponse
 
 	bodyBytes, err := io.ReadAll(r.Body)
@@ -385,14 +332,14 @@ func checkRequestManually(w http.ResponseWriter, r *http.Request) {
 
 	for _, url := range ETH_nodes {
 		msg = JSONRPCResponse{}
-		new_r := r.Clone(r.Context())
+		new_r := r.Clone(fanoutCtx)
 		new_r.Body = io.NopCloser(bytes.NewReader(bodyBytes))
-		res, err := httpUtils.CheckRequest(new_r, url)
+		res, err := g.http.CheckRequest(new_r, url)
 		if err != nil || res == nil {
 			continue
 		}
 
-		fmt.Println("Node called:", url)
+		logging.SetUpstream(r.Context(), upstreamHost(url))
 		if res.Body != nil {
 			body, err := io.ReadAll(res.Body)
 			res.Body.Close()
@@ -414,7 +361,6 @@ func checkRequestManually(w http.ResponseWriter, r *http.Request) {
 			json.NewEncoder(w).Encode(msg)
 			return
 		} else if msg.Result == nil {
-			fmt.Println("Result is empty")
 			continue
 		}
 	}
@@ -1,297 +1,299 @@
 package gateway
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
-	"log"
 	"math"
-	"net"
 	"net/http"
-	"os"
-	"os/signal"
-	"strings"
+	"strconv"
 	"sync"
 	"sync/atomic"
-	"syscall"
 	"time"
 
 	"github.com/decentrio/gateway/config"
+	"github.com/decentrio/gateway/logging"
+	"github.com/decentrio/gateway/tracing"
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/status"
 )
 
-var (
-	jsonRPCWSServers = make(map[uint16]*http.Server)
-	upgrader         = websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			log.Printf("WebSocket request from: %s", r.Host)
-			return true
-		},
-	}
-	activeJsonRPCWSRequestCount int32
-)
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
 
-func Start_JSON_RPC_WS_Server(server *Server) {
-	fmt.Printf("Starting JSON-RPC WebSocket server on port %d\n", server.Port)
+func (server *Server) startJSONRPCWS() error {
+	g := server.gw
+	g.log.Info("Starting JSON-RPC WebSocket server")
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/websocket", handleWebSocket)
+	mux.HandleFunc("/websocket", server.handleWebSocket)
 
 	srv := &http.Server{
-		Addr:    fmt.Sprintf(":%d", server.Port),
-		Handler: mux,
+		Handler: g.withProbes(g.withMiddleware(g.requireAPIKey("jsonrpc_ws", rejectHTTP, mux))),
 	}
 
-	mu.Lock()
-	jsonRPCWSServers[server.Port] = srv
-	mu.Unlock()
-
-	go func() {
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Error starting JSON-RPC WebSocket server: %v", err)
-		}
-	}()
-
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
-	<-stop
-
-	Shutdown_JSON_RPC_WS_Server(server)
-}
-
-func Shutdown_JSON_RPC_WS_Server(server *Server) {
-	mu.Lock()
-	srv, exists := jsonRPCWSServers[server.Port]
-	if !exists {
-		mu.Unlock()
-		return
-	}
-	delete(jsonRPCWSServers, server.Port)
-	mu.Unlock()
-
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	fmt.Printf("Waiting for %d requests to complete before shutting down JSON-RPC-WebSocket server ...\n", atomic.LoadInt32(&activeJsonRPCWSRequestCount))
-
-	done := make(chan struct{})
-	go func() {
-		wg.Wait()
-		close(done)
-	}()
-
-	select {
-	case <-done:
-		fmt.Println("All active WebSocket requests completed. Proceeding with shutdown...")
-	case <-ctx.Done():
-		fmt.Println("[WARNING] Timeout waiting for WebSocket requests. Forcing shutdown...")
-	}
-
-	if err := srv.Shutdown(ctx); err != nil {
-		fmt.Printf("Error shutting down JSON-RPC WebSocket server: %v\n", err)
-	} else {
-		fmt.Println("JSON-RPC WebSocket server stopped.")
+	server.mu.Lock()
+	server.sessions = make(map[*wsSession]struct{})
+	server.mu.Unlock()
+	if err := server.startHTTP(srv, g.cfg.Get().TLS.JSONRPC_WS); err != nil {
+		server.mu.Lock()
+		server.sessions = nil
+		server.mu.Unlock()
+		return err
 	}
+	return nil
 }
 
-func isWebSocketAvailable(wsURL string) bool {
-	wsURL = strings.TrimPrefix(wsURL, "ws://")
-	wsURL = strings.TrimPrefix(wsURL, "wss://")
-
-	hostPort := strings.Split(wsURL, "/")[0]
-
-	conn, err := net.DialTimeout("tcp", hostPort, 2*time.Second)
-	if err != nil {
-		log.Printf("WebSocket %s is not available: %v", wsURL, err)
-		return false
+// shutdownJSONRPCWS stops the server accepting connections, then drains its
+// sessions: their requests are answered and the clients sent a close frame,
+// until ctx is done.
+func (server *Server) shutdownJSONRPCWS(ctx context.Context) error {
+	server.mu.Lock()
+	sessions := server.sessions
+	server.sessions = nil
+	server.mu.Unlock()
+
+	// Sessions live on hijacked connections, which the HTTP server leaves
+	// alone.
+	err := server.shutdownHTTP(ctx)
+	var wg sync.WaitGroup
+	for session := range sessions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			session.shutdown(ctx)
+		}()
 	}
-	conn.Close()
-	return true
+	wg.Wait()
+	server.gw.wsPool.closeAll()
+	return err
 }
 
-func handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	var node *config.Node
+func (server *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	g := server.gw
+	g.log.DebugContext(r.Context(), "WebSocket request", "host", r.Host)
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("WebSocket upgrade failed: %v", err)
+		g.log.WarnContext(r.Context(), "WebSocket upgrade failed", "err", err)
 		http.Error(w, "WebSocket upgrade failed", http.StatusInternalServerError)
 		return
 	}
-	defer conn.Close()
 
-	fmt.Println("New WebSocket connection established.")
-	atomic.AddInt32(&activeJsonRPCWSRequestCount, 1)
-	wg.Add(1)
+	session := newWSSession(g, conn)
+	session.client = g.clientIP(r.RemoteAddr, r.Header.Get)
+	session.remote = trace.SpanContextFromContext(tracing.Extract(context.Background(), propagation.HeaderCarrier(r.Header)))
+	session.limit = g.wsRateLimiter(r)
+	go session.writePump()
+
+	server.mu.Lock()
+	serving := server.sessions != nil
+	if serving {
+		server.sessions[session] = struct{}{}
+	}
+	server.mu.Unlock()
+	if !serving {
+		// The server shut down during the handshake.
+		session.shutdown(r.Context())
+		return
+	}
+
+	g.log.Debug("New WebSocket connection established", "client", session.client)
+	server.requests.begin()
 	defer func() {
-		wg.Done()
-		atomic.AddInt32(&activeJsonRPCWSRequestCount, -1)
+		server.requests.end()
+		server.mu.Lock()
+		delete(server.sessions, session)
+		server.mu.Unlock()
 	}()
 
 	for {
-		node = nil
 		_, message, err := conn.ReadMessage()
 		if err != nil {
 			if websocket.IsCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure, websocket.CloseNormalClosure, 1005) {
-				log.Printf("WebSocket closed by client: %v", err)
+				g.log.Debug("WebSocket closed by client", "client", session.client, "err", err)
 			} else {
-				log.Printf("Error reading WebSocket message: %v", err)
+				g.log.Warn("Error reading WebSocket message", "client", session.client, "err", err)
 			}
 			break
 		}
 
-		var req JSONRPCRequest
-		err = json.Unmarshal(message, &req)
-		if err != nil {
-			log.Printf("Invalid JSON-RPC WebSocket request: %v", err)
+		if session.draining.Load() {
+			req, _ := parseWSRequest(message)
+			session.replyError(session.ctx, req.ID, jsonRPCServerError, "Server is shutting down")
 			continue
 		}
+		// Requests are handled concurrently so that a slow call does not hold
+		// up the rest of the connection. Clients match replies by id.
+		if !session.dispatch(func() { g.handleWSMessage(session, message) }) {
+			break
+		}
+	}
 
-		fmt.Printf("Received JSON-RPC WS request: Method=%s, Params=%v, ID=%d\n", req.Method, req.Params, req.ID)
+	session.close()
+	session.wait()
+}
 
-		paramsMap := make([]any, len(req.Params))
-		json.Unmarshal(req.Params, &paramsMap)
-		var height uint64 = math.MaxUint64
+func (g *Gateway) handleWSMessage(session *wsSession, message []byte) {
+	req, rpcErr := parseWSRequest(message)
+	method := req.Method
+	if rpcErr != nil {
+		method = "invalid"
+	}
 
-		switch req.Method {
-		case "eth_getTransactionByHash", // tx hash in params
-			"eth_getTransactionReceipt",
-			"eth_getBlockByHash", // block hash in params
-			"eth_getBlockTransactionCountByHash",
-			"eth_getTransactionByBlockHashAndIndex",
-			"eth_getUncleByBlockHashAndIndex":
-			checkRequestManuallyWebSocket(conn, req)
-			continue
+	// Every message is logged as a request of its own, with the code of the
+	// error the gateway answered with, if any.
+	logReq := logging.NewRequest(logging.RequestID(""), "jsonrpc_ws", session.client, method)
+	sent := new(atomic.Int64)
+	ctx := context.WithValue(logging.NewContext(session.ctx, logReq), wsReplyBytesKey{}, sent)
+	// A session can outlive any trace, so each message starts a trace of its
+	// own, linked to the one the session was opened in.
+	opts := []trace.SpanStartOption{trace.WithNewRoot()}
+	if session.remote.IsValid() {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: session.remote}))
+	}
+	ctx, span := startServerSpan(ctx, "jsonrpc_ws", logReq, opts...)
+	result := "ok"
+	defer func() {
+		g.metrics.ObserveRequest("jsonrpc_ws", method, result, logReq.Elapsed())
+		g.logAccess(logReq, result, sent.Load())
+		span.SetName("jsonrpc_ws " + method)
+		span.SetAttributes(attribute.String("gateway.method", method), attribute.String("gateway.status", result))
+		if result != "ok" {
+			span.SetStatus(codes.Error, result)
+		}
+		span.End()
+	}()
+	fail := func(code int, message string) {
+		result = strconv.Itoa(code)
+		session.replyError(ctx, req.ID, code, message)
+	}
 
-		case "eth_newFilter", "eth_getLogs":
-			respJSON := fmt.Sprintf(`{"jsonrpc":"2.0","error":"Method not supported yet","id":%d}`, req.ID)
-			conn.WriteMessage(websocket.TextMessage, []byte(respJSON))
-			continue
+	if rpcErr != nil {
+		g.log.DebugContext(ctx, "Invalid JSON-RPC WebSocket request", "err", rpcErr.Message)
+		fail(rpcErr.Code, rpcErr.Message)
+		return
+	}
 
-		case "eth_getBalance", "eth_getTransactionCount", "eth_getCode", "eth_call":
-			height, err = getHeightFromParams(paramsMap, 1)
-		case "eth_getStorageAt":
-			height, err = getHeightFromParams(paramsMap, 2)
-		case "eth_getBlockTransactionCountByNumber", "eth_getBlockByNumber",
-			"eth_getTransactionByBlockNumberAndIndex", "eth_getUncleByBlockNumberAndIndex":
-			height, err = getHeightFromParams(paramsMap, 0)
-		default:
-			height = 0
-		}
+	g.log.DebugContext(ctx, "Received JSON-RPC WS request", "method", req.Method, "id", formatIDForLog(req.ID))
 
-		if err != nil {
-			if errors.Is(err, errBlockHashSelector) {
-				checkRequestManuallyWebSocket(conn, req)
-				continue
-			}
-			respJSON := fmt.Sprintf(`{"jsonrpc":"2.0","error":"%s","id":%d}`, err.Error(), req.ID)
-			conn.WriteMessage(websocket.TextMessage, []byte(respJSON))
-			continue
-		}
-		if node == nil {
-			if defaultNode := config.GetNodebyHeight(0); defaultNode != nil {
-				node = defaultNode
-			}
+	if err := g.checkMethod("jsonrpc_ws", req.Method); err != nil {
+		fail(jsonRPCMethodNotFound, status.Convert(err).Message())
+		return
+	}
+	if session.limit != nil {
+		if err := session.limit(req.Method); err != nil {
+			fail(jsonRPCLimitExceeded, status.Convert(err).Message())
+			return
 		}
+	}
 
-		if height > 0 {
-			node = config.GetNodebyHeight(height)
-			if node == nil {
-				respJSON := fmt.Sprintf(`{"jsonrpc":"2.0","error":"Node not found","id":%d}`, req.ID)
-				conn.WriteMessage(websocket.TextMessage, []byte(respJSON))
-				continue
-			}
-		}
-		fmt.Printf("Height: %d\n", height)
+	paramsMap := make([]any, len(req.Params))
+	json.Unmarshal(req.Params, &paramsMap)
+	var height uint64 = math.MaxUint64
+	var err error
+
+	switch req.Method {
+	case "eth_getTransactionByHash", // tx hash in params
+		"eth_getTransactionReceipt",
+		"eth_getBlockByHash", // block hash in params
+		"eth_getBlockTransactionCountByHash",
+		"eth_getTransactionByBlockHashAndIndex",
+		"eth_getUncleByBlockHashAndIndex":
+		g.checkRequestManuallyWebSocket(ctx, session, req)
+		return
 
-		if node != nil {
-			fmt.Printf("Forwarding to Node: %s\n", node.JSONRPC_WS)
+	case "eth_newFilter", "eth_getLogs":
+		fail(jsonRPCMethodNotFound, "Method not supported yet")
+		return
 
-			if !isWebSocketAvailable(node.JSONRPC_WS) {
-				log.Printf("WebSocket unavailable: %s", node.JSONRPC_WS)
-				respJSON := fmt.Sprintf(`{"jsonrpc":"2.0","error":"WebSocket node unavailable","id":%d}`, req.ID)
-				conn.WriteMessage(websocket.TextMessage, []byte(respJSON))
-				continue
-			}
-			dialURL := strings.TrimPrefix(node.JSONRPC_WS, "ws://")
-			dialURL = strings.TrimPrefix(dialURL, "wss://")
-			hostPort := strings.Split(dialURL, "/")[0]
+	case "eth_subscribe":
+		if err := session.subscribe(ctx, req); err != nil {
+			g.log.WarnContext(ctx, "Failed to subscribe", "err", err)
+			fail(jsonRPCServerError, err.Error())
+		}
+		return
 
-			nodeConn, _, err := websocket.DefaultDialer.Dial("ws://"+hostPort, nil)
-			// nodeConn, _, err := websocket.DefaultDialer.Dial(node.JSONRPC_WS, nil)
-			if err != nil {
-				log.Printf("Failed to connect to jsonRPC WebSocket: %v", err)
-				respJSON := fmt.Sprintf(`{"jsonrpc":"2.0","error":"Failed to connect to jsonRPC WebSocket","id":%d}`, req.ID)
-				conn.WriteMessage(websocket.TextMessage, []byte(respJSON))
-				continue
-			}
-			defer nodeConn.Close()
+	case "eth_unsubscribe":
+		session.unsubscribe(ctx, req)
+		return
 
-			err = nodeConn.WriteMessage(websocket.TextMessage, message)
-			if err != nil {
-				log.Printf("Error forwarding message to node: %v", err)
-				continue
-			}
+	case "eth_getBalance", "eth_getTransactionCount", "eth_getCode", "eth_call":
+		height, err = getHeightFromParams(paramsMap, 1)
+	case "eth_getStorageAt":
+		height, err = getHeightFromParams(paramsMap, 2)
+	case "eth_getBlockTransactionCountByNumber", "eth_getBlockByNumber",
+		"eth_getTransactionByBlockNumberAndIndex", "eth_getUncleByBlockNumberAndIndex":
+		height, err = getHeightFromParams(paramsMap, 0)
+	default:
+		height = 0
+	}
 
-			_, response, err := nodeConn.ReadMessage()
-			if err != nil {
-				log.Printf("Error reading response from node: %v", err)
-				respJSON := fmt.Sprintf(`{"jsonrpc":"2.0","error":"Failed to read response from node","id":%d}`, req.ID)
-				conn.WriteMessage(websocket.TextMessage, []byte(respJSON))
-				continue
-			}
+	if err != nil {
+		if errors.Is(err, errBlockHashSelector) {
+			g.checkRequestManuallyWebSocket(ctx, session, req)
+			return
+		}
+		fail(jsonRPCInvalidParams, err.Error())
+		return
+	}
 
-			// fmt.Printf("Received response from node: %s\n", string(response))
+	node := g.routeByHeight(ctx, height)
+	if node == nil {
+		fail(jsonRPCServerError, "Node not found")
+		return
+	}
+	g.log.DebugContext(ctx, "Forwarding to node", "upstream", node.JSONRPC_WS)
 
-			err = conn.WriteMessage(websocket.TextMessage, response)
-			if err != nil {
-				log.Printf("Error sending response back to client: %v", err)
-			}
-		}
+	if err := session.forward(ctx, node, req); err != nil {
+		result = "error"
 	}
 }
 
-func checkRequestManuallyWebSocket(conn *websocket.Conn, request JSONRPCRequest) {
-	ETH_nodes := config.GetNodesByType("jsonrpc_ws")
+func (g *Gateway) checkRequestManuallyWebSocket(ctx context.Context, session *wsSession, request JSONRPCRequest) {
+	ETH_nodes := g.cfg.Get().Upstream
+	ctx, fanout := startFanout(ctx, len(ETH_nodes))
+	defer fanout.End()
 	var wg sync.WaitGroup
 	var bestNode atomic.Value
-	responseChan := make(chan map[string]interface{}, len(ETH_nodes))
+	responseChan := make(chan *wsUpstreamMessage, len(ETH_nodes))
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	callCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 
-	for _, url := range ETH_nodes {
+	for _, node := range ETH_nodes {
+		if node.JSONRPC_WS == "" || !node.Enabled() {
+			continue
+		}
 		wg.Add(1)
-		go func(nodeURL string) {
+		go func(node config.Node) {
 			defer wg.Done()
+			nodeURL := node.JSONRPC_WS
 
-			ws, _, err := websocket.DefaultDialer.Dial(nodeURL, nil)
+			conn, err := g.wsPool.get(&node)
 			if err != nil {
-				log.Printf("Failed to connect to node %s: %v", nodeURL, err)
+				g.log.WarnContext(ctx, "Failed to connect to node", "upstream", upstreamHost(nodeURL), "err", err)
 				return
 			}
-			defer ws.Close()
 
-			err = ws.WriteJSON(request)
+			res, err := conn.call(callCtx, request.Method, request.Params, nil)
 			if err != nil {
-				log.Printf("Failed to send request to node %s: %v", nodeURL, err)
+				g.log.WarnContext(ctx, "Failed to get response from node", "upstream", upstreamHost(nodeURL), "err", err)
 				return
 			}
 
-			var res map[string]interface{}
-			err = ws.ReadJSON(&res)
-			if err != nil {
-				log.Printf("Failed to read response from node %s: %v", nodeURL, err)
-				return
-			}
-
-			if result, ok := res["result"]; ok && result != nil {
+			if len(res.Result) > 0 && string(res.Result) != "null" {
 				bestNode.Store(nodeURL)
 				responseChan <- res
 			} else {
-				log.Printf("Node %s responded but has no valid result", nodeURL)
+				g.log.DebugContext(ctx, "Node responded but has no valid result", "upstream", upstreamHost(nodeURL))
 			}
-		}(url)
+		}(node)
 	}
 
 	go func() {
@@ -299,25 +301,69 @@ func checkRequestManuallyWebSocket(conn *websocket.Conn, request JSONRPCRequest)
 		close(responseChan)
 	}()
 
-	var bestResponse map[string]interface{}
+	var err error
 	select {
-	case bestResponse = <-responseChan:
+	case bestResponse, ok := <-responseChan:
+		if !ok {
+			g.log.WarnContext(ctx, "No valid response from nodes")
+			err = session.replyError(ctx, request.ID, jsonRPCServerError, "No valid response from nodes")
+			break
+		}
 		if nodeURL, ok := bestNode.Load().(string); ok {
-			fmt.Println("Node called:", nodeURL)
+			logging.SetUpstream(ctx, upstreamHost(nodeURL))
+		}
+		err = session.reply(ctx, upstreamResponse(request.ID, bestResponse))
+	case <-callCtx.Done():
+		g.log.WarnContext(ctx, "Timeout: no valid response from nodes")
+		err = session.replyError(ctx, request.ID, jsonRPCServerError, "No valid response from nodes")
+	}
+
+	if err != nil {
+		g.log.DebugContext(ctx, "Failed to send response to client", "err", err)
+	}
+}
+
+// parseWSRequest decodes a single JSON-RPC request. Malformed messages are
+// reported as a JSON-RPC error, along with whatever id could be recovered.
+func parseWSRequest(message []byte) (JSONRPCRequest, *JSONRPCError) {
+	var req JSONRPCRequest
+	if !json.Valid(message) {
+		return req, &JSONRPCError{Code: jsonRPCParseError, Message: "Parse error"}
+	}
+
+	trimmed := bytes.TrimSpace(message)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		return req, &JSONRPCError{Code: jsonRPCInvalidRequest, Message: "Invalid request: batch requests are not supported"}
+	}
+
+	if err := json.Unmarshal(message, &req); err != nil {
+		var partial struct {
+			ID json.RawMessage `json:"id"`
 		}
-	case <-ctx.Done():
-		log.Println("Timeout: No valid response from nodes")
-		bestResponse = map[string]interface{}{
-			"jsonrpc": "2.0",
-			"id":      request.ID,
-			"error": map[string]interface{}{
-				"code":    -32000,
-				"message": "No valid response from nodes",
-			},
+		json.Unmarshal(message, &partial)
+		req = JSONRPCRequest{}
+		if validJSONRPCID(partial.ID) {
+			req.ID = partial.ID
 		}
+		return req, &JSONRPCError{Code: jsonRPCInvalidRequest, Message: "Invalid request: " + err.Error()}
+	}
+	if !validJSONRPCID(req.ID) {
+		req.ID = nil
+		return req, &JSONRPCError{Code: jsonRPCInvalidRequest, Message: "Invalid request: id must be a string, number or null"}
 	}
+	if req.Method == "" {
+		return req, &JSONRPCError{Code: jsonRPCInvalidRequest, Message: "Invalid request: missing method"}
+	}
+	return req, nil
+}
 
-	if err := conn.WriteJSON(bestResponse); err != nil {
-		log.Println("Failed to send response to client:", err)
+func validJSONRPCID(id json.RawMessage) bool {
+	if len(id) == 0 {
+		return true
+	}
+	switch id[0] {
+	case '"', 'n', '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		return true
 	}
+	return false
 }
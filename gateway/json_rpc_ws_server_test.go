@@ -0,0 +1,749 @@
+package gateway_test
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+
+	"github.com/decentrio/gateway/config"
+)
+
+// fakeChain is a block height shared by fake nodes, advancing on its own.
+type fakeChain struct {
+	height atomic.Uint64
+}
+
+func newFakeChain(t *testing.T) *fakeChain {
+	chain := &fakeChain{}
+	chain.height.Store(100)
+	ticker := time.NewTicker(10 * time.Millisecond)
+	t.Cleanup(ticker.Stop)
+	go func() {
+		for range ticker.C {
+			chain.height.Add(1)
+		}
+	}()
+	return chain
+}
+
+// fakeWSNode is a minimal Ethereum node. Over WebSocket it answers
+// eth_subscribe with a fixed id and then pushes a newHeads notification, or
+// two logs, for every block of the chain until it is unsubscribed. Over HTTP
+// it serves the calls used to backfill missed blocks.
+type fakeWSNode struct {
+	server *httptest.Server
+	chain  *fakeChain
+	dials  int32
+	closed int32
+	subs   int32
+	unsubs int32
+
+	// subscribeDelay holds back the eth_subscribe reply, letting the chain
+	// move on in the meantime.
+	subscribeDelay time.Duration
+	// notifications, when set, is the number of notifications pushed before
+	// the node goes quiet.
+	notifications int
+
+	mu    sync.Mutex
+	conns []*websocket.Conn
+}
+
+func newFakeWSNode(t *testing.T, chain *fakeChain) *fakeWSNode {
+	node := &fakeWSNode{chain: chain}
+	upgrader := websocket.Upgrader{}
+	node.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !websocket.IsWebSocketUpgrade(r) {
+			node.serveHTTP(w, r)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		defer atomic.AddInt32(&node.closed, 1)
+		atomic.AddInt32(&node.dials, 1)
+		node.mu.Lock()
+		node.conns = append(node.conns, conn)
+		node.mu.Unlock()
+
+		out := make(chan any, 64)
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			for {
+				select {
+				case msg := <-out:
+					conn.WriteJSON(msg)
+				case <-stop:
+					return
+				}
+			}
+		}()
+
+		var unsubscribed chan struct{}
+		for {
+			var req struct {
+				ID     json.RawMessage `json:"id"`
+				Method string          `json:"method"`
+				Params []any           `json:"params"`
+			}
+			if err := conn.ReadJSON(&req); err != nil {
+				return
+			}
+			switch req.Method {
+			case "eth_subscribe":
+				atomic.AddInt32(&node.subs, 1)
+				time.Sleep(node.subscribeDelay)
+				out <- map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": "0xsub"}
+				unsubscribed = make(chan struct{})
+				topic, _ := req.Params[0].(string)
+				go node.stream(topic, out, stop, unsubscribed)
+			case "eth_unsubscribe":
+				atomic.AddInt32(&node.unsubs, 1)
+				if unsubscribed != nil {
+					close(unsubscribed)
+					unsubscribed = nil
+				}
+				out <- map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": true}
+			case "eth_getTransactionByHash":
+				// A slow call, answered without holding up the connection.
+				go func(id json.RawMessage) {
+					time.Sleep(300 * time.Millisecond)
+					out <- map[string]any{"jsonrpc": "2.0", "id": id, "result": map[string]any{"hash": "0x01"}}
+				}(req.ID)
+			default:
+				out <- map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": fmt.Sprintf("0x%x", chain.height.Load())}
+			}
+		}
+	}))
+	t.Cleanup(node.server.Close)
+	return node
+}
+
+// kill takes the node down, dropping its WebSocket connections.
+func (n *fakeWSNode) kill() {
+	n.server.Close()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, conn := range n.conns {
+		conn.Close()
+	}
+}
+
+func (n *fakeWSNode) stream(topic string, out chan<- any, stop, unsubscribed <-chan struct{}) {
+	last := n.chain.height.Load()
+	sent := 0
+	for {
+		select {
+		case <-stop:
+			return
+		case <-unsubscribed:
+			return
+		case <-time.After(2 * time.Millisecond):
+		}
+		for head := n.chain.height.Load(); last < head; {
+			last++
+			results := []any{map[string]any{"number": fmt.Sprintf("0x%x", last)}}
+			if topic == "logs" {
+				results = fakeLogs(last)
+			}
+			for _, result := range results {
+				if n.notifications > 0 && sent == n.notifications {
+					return
+				}
+				sent++
+				out <- map[string]any{
+					"jsonrpc": "2.0",
+					"method":  "eth_subscription",
+					"params":  map[string]any{"subscription": "0xsub", "result": result},
+				}
+			}
+		}
+	}
+}
+
+// fakeLogs returns the two logs of a block.
+func fakeLogs(block uint64) []any {
+	var logs []any
+	for index := range 2 {
+		logs = append(logs, map[string]any{
+			"blockNumber": fmt.Sprintf("0x%x", block),
+			"blockHash":   fmt.Sprintf("0xb%x", block),
+			"logIndex":    fmt.Sprintf("0x%x", index),
+		})
+	}
+	return logs
+}
+
+func (n *fakeWSNode) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID     json.RawMessage `json:"id"`
+		Method string          `json:"method"`
+		Params []any           `json:"params"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var result any
+	switch req.Method {
+	case "eth_blockNumber":
+		result = fmt.Sprintf("0x%x", n.chain.height.Load())
+	case "eth_getBlockByNumber":
+		result = map[string]any{"number": req.Params[0]}
+	case "eth_getLogs":
+		filter := req.Params[0].(map[string]any)
+		from, _ := strconv.ParseUint(strings.TrimPrefix(filter["fromBlock"].(string), "0x"), 16, 64)
+		to, _ := strconv.ParseUint(strings.TrimPrefix(filter["toBlock"].(string), "0x"), 16, 64)
+		logs := []any{}
+		for block := from; block <= to; block++ {
+			logs = append(logs, fakeLogs(block)...)
+		}
+		result = logs
+	}
+	json.NewEncoder(w).Encode(map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": result})
+}
+
+func (n *fakeWSNode) url() string {
+	return "ws" + strings.TrimPrefix(n.server.URL, "http")
+}
+
+func freePort(t *testing.T) uint16 {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer lis.Close()
+	return uint16(lis.Addr().(*net.TCPAddr).Port)
+}
+
+func startWSGateway(t *testing.T, nodes ...*fakeWSNode) string {
+	return startWSGatewayWithUpstream(t, wsUpstream(nodes...)...)
+}
+
+func wsUpstream(nodes ...*fakeWSNode) []config.Node {
+	var upstream []config.Node
+	for _, n := range nodes {
+		upstream = append(upstream, config.Node{JSONRPC: n.server.URL, JSONRPC_WS: n.url(), Blocks: []uint64{1, 0}})
+	}
+	return upstream
+}
+
+func startWSGatewayWithUpstream(t *testing.T, upstream ...config.Node) string {
+	return startWSGatewayWithConfig(t, &config.Config{Upstream: upstream})
+}
+
+func startWSGatewayWithConfig(t *testing.T, cfg *config.Config) string {
+	gw := startGateway(t, cfg, listenOn(t, "jsonrpc_ws"))
+	server := &gw.JSON_RPC_WS_Server
+
+	addr := fmt.Sprintf("127.0.0.1:%d", server.Port)
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	}, 2*time.Second, 10*time.Millisecond)
+
+	return "ws://" + addr + "/websocket"
+}
+
+func TestWebSocketSubscriptionStreams(t *testing.T) {
+	node := newFakeWSNode(t, newFakeChain(t))
+	gwURL := startWSGateway(t, node)
+
+	client, _, err := websocket.DefaultDialer.Dial(gwURL, nil)
+	require.NoError(t, err)
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	require.NoError(t, client.WriteJSON(map[string]any{
+		"jsonrpc": "2.0", "id": 1, "method": "eth_subscribe", "params": []any{"newHeads"},
+	}))
+
+	var reply struct {
+		ID     int    `json:"id"`
+		Result string `json:"result"`
+	}
+	require.NoError(t, client.ReadJSON(&reply))
+	require.Equal(t, 1, reply.ID)
+	require.NotEmpty(t, reply.Result)
+
+	for i := 0; i < 3; i++ {
+		var notification struct {
+			Method string `json:"method"`
+			Params struct {
+				Subscription string `json:"subscription"`
+			} `json:"params"`
+		}
+		require.NoError(t, client.ReadJSON(&notification))
+		require.Equal(t, "eth_subscription", notification.Method)
+		require.Equal(t, reply.Result, notification.Params.Subscription)
+	}
+
+	// Plain requests keep working alongside the subscription.
+	require.NoError(t, client.WriteJSON(map[string]any{
+		"jsonrpc": "2.0", "id": 2, "method": "eth_blockNumber", "params": []any{},
+	}))
+
+	require.NoError(t, client.WriteJSON(map[string]any{
+		"jsonrpc": "2.0", "id": 3, "method": "eth_unsubscribe", "params": []any{reply.Result},
+	}))
+
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&node.unsubs) == 1 }, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestWebSocketSubscriptionsAreShared(t *testing.T) {
+	node := newFakeWSNode(t, newFakeChain(t))
+	gwURL := startWSGateway(t, node)
+
+	subscribe := func(id int) (*websocket.Conn, string) {
+		client, _, err := websocket.DefaultDialer.Dial(gwURL, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() { client.Close() })
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		require.NoError(t, client.WriteJSON(map[string]any{
+			"jsonrpc": "2.0", "id": id, "method": "eth_subscribe", "params": []any{"newHeads"},
+		}))
+		var reply struct {
+			Result string `json:"result"`
+		}
+		require.NoError(t, client.ReadJSON(&reply))
+		require.NotEmpty(t, reply.Result)
+		return client, reply.Result
+	}
+
+	first, firstID := subscribe(1)
+	second, secondID := subscribe(2)
+	require.NotEqual(t, firstID, secondID)
+	require.Equal(t, int32(1), atomic.LoadInt32(&node.subs))
+
+	for client, subID := range map[*websocket.Conn]string{first: firstID, second: secondID} {
+		var notification struct {
+			Params struct {
+				Subscription string `json:"subscription"`
+			} `json:"params"`
+		}
+		require.NoError(t, client.ReadJSON(&notification))
+		require.Equal(t, subID, notification.Params.Subscription)
+	}
+
+	require.NoError(t, first.WriteJSON(map[string]any{
+		"jsonrpc": "2.0", "id": 3, "method": "eth_unsubscribe", "params": []any{firstID},
+	}))
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, int32(0), atomic.LoadInt32(&node.unsubs))
+
+	// The upstream subscription goes away with its last client, and so does
+	// the connection it used.
+	second.Close()
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&node.unsubs) == 1 }, 2*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&node.closed) == atomic.LoadInt32(&node.dials) }, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestWebSocketUpstreamsClosedOnShutdown(t *testing.T) {
+	node := newFakeWSNode(t, newFakeChain(t))
+	gw := startGateway(t, &config.Config{Upstream: wsUpstream(node)}, listenOn(t, "jsonrpc_ws"))
+
+	client, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://127.0.0.1:%d/websocket", gw.JSON_RPC_WS_Server.Port), nil)
+	require.NoError(t, err)
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	require.NoError(t, client.WriteJSON(map[string]any{
+		"jsonrpc": "2.0", "id": 1, "method": "eth_subscribe", "params": []any{"newHeads"},
+	}))
+	var reply struct {
+		Result string `json:"result"`
+	}
+	require.NoError(t, client.ReadJSON(&reply))
+	require.NotEmpty(t, reply.Result)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, gw.Shutdown(ctx))
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&node.closed) == atomic.LoadInt32(&node.dials) }, 2*time.Second, 10*time.Millisecond)
+	require.Equal(t, int32(1), atomic.LoadInt32(&node.subs), "subscriptions are not moved on shutdown")
+}
+
+func TestWebSocketSubscriptionsSkipNodesWithoutWebSocket(t *testing.T) {
+	node := newFakeWSNode(t, newFakeChain(t))
+	logs, withLogs := captureLogs(t)
+	gw := startGateway(t, &config.Config{Upstream: append(
+		[]config.Node{{JSONRPC: node.server.URL, Blocks: []uint64{1, 0}}},
+		wsUpstream(node)...,
+	)}, listenOn(t, "jsonrpc_ws"), withLogs)
+
+	client, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://127.0.0.1:%d/websocket", gw.JSON_RPC_WS_Server.Port), nil)
+	require.NoError(t, err)
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for id := 1; id <= 5; id++ {
+		require.NoError(t, client.WriteJSON(map[string]any{
+			"jsonrpc": "2.0", "id": id, "method": "eth_subscribe", "params": []any{"newHeads", map[string]any{"n": id}},
+		}))
+	}
+	for replies := 0; replies < 5; {
+		var reply struct {
+			ID     int    `json:"id"`
+			Result string `json:"result"`
+		}
+		require.NoError(t, client.ReadJSON(&reply))
+		if reply.ID != 0 {
+			require.NotEmpty(t, reply.Result)
+			replies++
+		}
+	}
+	require.NotContains(t, logs.String(), "Failed to subscribe")
+}
+
+func TestWebSocketSubscriptionFailover(t *testing.T) {
+	chain := newFakeChain(t)
+	primary := newFakeWSNode(t, chain)
+	backup := newFakeWSNode(t, chain)
+	backup.subscribeDelay = 100 * time.Millisecond
+	gwURL := startWSGateway(t, primary, backup)
+
+	client, _, err := websocket.DefaultDialer.Dial(gwURL, nil)
+	require.NoError(t, err)
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	require.NoError(t, client.WriteJSON(map[string]any{
+		"jsonrpc": "2.0", "id": 1, "method": "eth_subscribe", "params": []any{"newHeads"},
+	}))
+	var reply struct {
+		Result string `json:"result"`
+	}
+	require.NoError(t, client.ReadJSON(&reply))
+
+	readHead := func() uint64 {
+		var notification struct {
+			Params struct {
+				Subscription string `json:"subscription"`
+				Result       struct {
+					Number string `json:"number"`
+				} `json:"result"`
+			} `json:"params"`
+		}
+		require.NoError(t, client.ReadJSON(&notification))
+		require.Equal(t, reply.Result, notification.Params.Subscription)
+		head, err := strconv.ParseUint(strings.TrimPrefix(notification.Params.Result.Number, "0x"), 16, 64)
+		require.NoError(t, err)
+		return head
+	}
+
+	last := readHead()
+	for i := 0; i < 3; i++ {
+		head := readHead()
+		require.Equal(t, last+1, head)
+		last = head
+	}
+
+	primary.kill()
+
+	// Blocks produced while the subscription moves are backfilled, in order
+	// and without duplicates.
+	for i := 0; i < 20; i++ {
+		head := readHead()
+		require.Equal(t, last+1, head)
+		last = head
+	}
+	require.Equal(t, int32(1), atomic.LoadInt32(&backup.subs))
+}
+
+func TestWebSocketLogsFailover(t *testing.T) {
+	chain := newFakeChain(t)
+	primary := newFakeWSNode(t, chain)
+	// The primary goes quiet halfway through a block.
+	primary.notifications = 5
+	backup := newFakeWSNode(t, chain)
+	gwURL := startWSGateway(t, primary, backup)
+
+	client, _, err := websocket.DefaultDialer.Dial(gwURL, nil)
+	require.NoError(t, err)
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	require.NoError(t, client.WriteJSON(map[string]any{
+		"jsonrpc": "2.0", "id": 1, "method": "eth_subscribe", "params": []any{"logs", map[string]any{}},
+	}))
+	var reply struct {
+		Result string `json:"result"`
+	}
+	require.NoError(t, client.ReadJSON(&reply))
+
+	readLog := func() string {
+		var notification struct {
+			Params struct {
+				Result struct {
+					BlockHash string `json:"blockHash"`
+					LogIndex  string `json:"logIndex"`
+				} `json:"result"`
+			} `json:"params"`
+		}
+		require.NoError(t, client.ReadJSON(&notification))
+		return notification.Params.Result.BlockHash + "/" + notification.Params.Result.LogIndex
+	}
+
+	var logs []string
+	for range 5 {
+		logs = append(logs, readLog())
+	}
+	primary.kill()
+
+	// The rest of the block cut short is backfilled, and what was delivered
+	// of it is not repeated.
+	for range 20 {
+		logs = append(logs, readLog())
+	}
+	var first uint64
+	_, err = fmt.Sscanf(logs[0], "0xb%x/", &first)
+	require.NoError(t, err)
+	for i, log := range logs {
+		require.Equal(t, fmt.Sprintf("0xb%x/0x%x", first+uint64(i/2), i%2), log)
+	}
+}
+
+func TestWebSocketErrorReplies(t *testing.T) {
+	node := newFakeWSNode(t, newFakeChain(t))
+	gwURL := startWSGateway(t, node)
+
+	client, _, err := websocket.DefaultDialer.Dial(gwURL, nil)
+	require.NoError(t, err)
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	testcases := []struct {
+		name    string
+		message string
+		expID   string
+		expCode int
+	}{
+		{
+			name:    "parse error",
+			message: `{"jsonrpc":"2.0","method":`,
+			expID:   `null`,
+			expCode: -32700,
+		},
+		{
+			name:    "missing method",
+			message: `{"jsonrpc":"2.0","id":"abc"}`,
+			expID:   `"abc"`,
+			expCode: -32600,
+		},
+		{
+			name:    "batch",
+			message: `[{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"}]`,
+			expID:   `null`,
+			expCode: -32600,
+		},
+		{
+			name:    "unsupported method with string id",
+			message: `{"jsonrpc":"2.0","id":"req-1","method":"eth_getLogs","params":[]}`,
+			expID:   `"req-1"`,
+			expCode: -32601,
+		},
+		{
+			name:    "invalid height",
+			message: `{"jsonrpc":"2.0","id":7,"method":"eth_getBlockByNumber","params":["0xzz",false]}`,
+			expID:   `7`,
+			expCode: -32602,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.NoError(t, client.WriteMessage(websocket.TextMessage, []byte(tc.message)))
+
+			var reply struct {
+				JSONRPC string          `json:"jsonrpc"`
+				ID      json.RawMessage `json:"id"`
+				Error   struct {
+					Code    int    `json:"code"`
+					Message string `json:"message"`
+				} `json:"error"`
+			}
+			require.NoError(t, client.ReadJSON(&reply))
+			require.Equal(t, "2.0", reply.JSONRPC)
+			require.JSONEq(t, tc.expID, string(reply.ID))
+			require.Equal(t, tc.expCode, reply.Error.Code)
+			require.NotEmpty(t, reply.Error.Message)
+		})
+	}
+}
+
+func TestWebSocketRequestsArePipelined(t *testing.T) {
+	node := newFakeWSNode(t, newFakeChain(t))
+	gwURL := startWSGateway(t, node)
+
+	client, _, err := websocket.DefaultDialer.Dial(gwURL, nil)
+	require.NoError(t, err)
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	require.NoError(t, client.WriteJSON(map[string]any{
+		"jsonrpc": "2.0", "id": "slow", "method": "eth_getTransactionByHash", "params": []any{"0x01"},
+	}))
+	require.NoError(t, client.WriteJSON(map[string]any{
+		"jsonrpc": "2.0", "id": "fast", "method": "eth_blockNumber", "params": []any{},
+	}))
+
+	var ids []string
+	for i := 0; i < 2; i++ {
+		var reply struct {
+			ID string `json:"id"`
+		}
+		require.NoError(t, client.ReadJSON(&reply))
+		ids = append(ids, reply.ID)
+	}
+	require.Equal(t, []string{"fast", "slow"}, ids)
+}
+
+func TestWebSocketUpstreamConnectionsArePooled(t *testing.T) {
+	node := newFakeWSNode(t, newFakeChain(t))
+	gwURL := startWSGateway(t, node)
+
+	for c := 0; c < 3; c++ {
+		client, _, err := websocket.DefaultDialer.Dial(gwURL, nil)
+		require.NoError(t, err)
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		for i := 0; i < 5; i++ {
+			// Clients may reuse the same ids, they are rewritten upstream.
+			require.NoError(t, client.WriteJSON(map[string]any{
+				"jsonrpc": "2.0", "id": i, "method": "eth_blockNumber", "params": []any{},
+			}))
+		}
+		seen := map[int]bool{}
+		for i := 0; i < 5; i++ {
+			var reply struct {
+				ID     int    `json:"id"`
+				Result string `json:"result"`
+			}
+			require.NoError(t, client.ReadJSON(&reply))
+			require.NotEmpty(t, reply.Result)
+			seen[reply.ID] = true
+		}
+		require.Len(t, seen, 5)
+		client.Close()
+	}
+
+	require.Equal(t, int32(1), atomic.LoadInt32(&node.dials))
+}
+
+func TestWebSocketUpstreamURLAndHeaders(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ws/v1" || r.URL.Query().Get("key") != "secret" || r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			var req struct {
+				ID json.RawMessage `json:"id"`
+			}
+			if err := conn.ReadJSON(&req); err != nil {
+				return
+			}
+			conn.WriteJSON(map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": "0x1"})
+		}
+	})
+
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	selfSigned := httptest.NewTLSServer(handler)
+	defer selfSigned.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: selfSigned.Certificate().Raw}), 0o600))
+
+	testcases := []struct {
+		name   string
+		node   config.Node
+		expErr bool
+	}{
+		{
+			name: "path, query and headers are sent",
+			node: config.Node{
+				JSONRPC_WS:         "ws" + strings.TrimPrefix(plain.URL, "http") + "/ws/v1?key=secret",
+				JSONRPC_WS_Headers: map[string]string{"Authorization": "Bearer token"},
+			},
+		},
+		{
+			name:   "missing header is rejected upstream",
+			node:   config.Node{JSONRPC_WS: "ws" + strings.TrimPrefix(plain.URL, "http") + "/ws/v1?key=secret"},
+			expErr: true,
+		},
+		{
+			name: "untrusted certificate is rejected",
+			node: config.Node{
+				JSONRPC_WS:         "wss" + strings.TrimPrefix(selfSigned.URL, "https") + "/ws/v1?key=secret",
+				JSONRPC_WS_Headers: map[string]string{"Authorization": "Bearer token"},
+			},
+			expErr: true,
+		},
+		{
+			name: "certificate verified against ca_file",
+			node: config.Node{
+				JSONRPC_WS:         "wss" + strings.TrimPrefix(selfSigned.URL, "https") + "/ws/v1?key=secret",
+				JSONRPC_WS_Headers: map[string]string{"Authorization": "Bearer token"},
+				TLS:                config.NodeTLS{JSONRPC_WS: config.TLS{CAFile: caFile}},
+			},
+		},
+		{
+			name: "ws upgraded to wss when enabled",
+			node: config.Node{
+				JSONRPC_WS:         "ws" + strings.TrimPrefix(selfSigned.URL, "https") + "/ws/v1?key=secret",
+				JSONRPC_WS_Headers: map[string]string{"Authorization": "Bearer token"},
+				TLS:                config.NodeTLS{JSONRPC_WS: config.TLS{Enable: true, CAFile: caFile}},
+			},
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.node.Blocks = []uint64{1, 0}
+			gwURL := startWSGatewayWithUpstream(t, tc.node)
+
+			client, _, err := websocket.DefaultDialer.Dial(gwURL, nil)
+			require.NoError(t, err)
+			defer client.Close()
+			client.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+			require.NoError(t, client.WriteJSON(map[string]any{
+				"jsonrpc": "2.0", "id": 1, "method": "eth_blockNumber", "params": []any{},
+			}))
+			var reply struct {
+				Result string          `json:"result"`
+				Error  json.RawMessage `json:"error"`
+			}
+			require.NoError(t, client.ReadJSON(&reply))
+			if tc.expErr {
+				require.NotEmpty(t, reply.Error)
+			} else {
+				require.Empty(t, reply.Error)
+				require.Equal(t, "0x1", reply.Result)
+			}
+		})
+	}
+}
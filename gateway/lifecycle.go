@@ -0,0 +1,172 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/decentrio/gateway/config"
+)
+
+// inflight counts the requests a server is handling, so that draining a
+// server waits for its own requests only.
+type inflight struct {
+	mu   sync.Mutex
+	n    int
+	idle chan struct{} // closed once n drops back to 0
+}
+
+func (f *inflight) begin() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.n == 0 {
+		f.idle = make(chan struct{})
+	}
+	f.n++
+}
+
+func (f *inflight) end() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.n--
+	if f.n == 0 {
+		close(f.idle)
+	}
+}
+
+func (f *inflight) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.n
+}
+
+// wait blocks until no request is left or ctx is done.
+func (f *inflight) wait(ctx context.Context) error {
+	f.mu.Lock()
+	if f.n == 0 {
+		f.mu.Unlock()
+		return nil
+	}
+	idle := f.idle
+	f.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// listen returns the listeners given to the server with WithListener, or else
+// binds its addresses. If one of them cannot be bound, the ones already are
+// closed again.
+func (s *Server) listen() ([]net.Listener, error) {
+	listeners := s.listeners
+	if listeners == nil {
+		for _, addr := range s.addrs {
+			lis, err := bind(addr)
+			if err != nil {
+				for _, l := range listeners {
+					l.Close()
+				}
+				return nil, err
+			}
+			listeners = append(listeners, lis)
+		}
+	}
+	for _, lis := range listeners {
+		if s.Port = listenerPort(lis); s.Port != 0 {
+			break
+		}
+	}
+	for _, lis := range listeners {
+		s.gw.log.Info("Listening", "server", s.Name, "address", lis.Addr().String())
+	}
+	return listeners, nil
+}
+
+// bind listens on a listen address. The socket file left behind by a Unix
+// socket that was not closed is removed first.
+func bind(addr string) (net.Listener, error) {
+	network, address, err := config.ParseListenAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" {
+		if info, err := os.Stat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if conn, err := net.Dial("unix", address); err == nil {
+				conn.Close()
+				return nil, fmt.Errorf("listen unix %s: socket in use", address)
+			}
+			os.Remove(address)
+		}
+	}
+	return net.Listen(network, address)
+}
+
+// startHTTP serves srv on the listeners of server in the background, over TLS
+// when settings are given, keeping srv until shut down. Errors binding the
+// addresses are returned; a listener failing later on is logged and left
+// unbound, failing the liveness probe.
+func (s *Server) startHTTP(srv *http.Server, settings *config.ListenerTLS) error {
+	g := s.gw
+	if settings != nil {
+		tlsConfig, err := newServerTLSConfig(g.log, settings)
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig = tlsConfig
+	}
+	listeners, err := s.listen()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.http = srv
+	s.mu.Unlock()
+
+	for _, lis := range listeners {
+		g.setListener(s.Name, lis, true)
+		go func() {
+			var err error
+			if settings == nil {
+				err = srv.Serve(lis)
+			} else {
+				err = srv.ServeTLS(lis, "", "")
+			}
+			if err == http.ErrServerClosed {
+				g.removeListener(lis)
+				return
+			}
+			g.log.Error("Server stopped serving", "server", s.Name, "address", lis.Addr().String(), "err", err)
+			g.setListener(s.Name, lis, false)
+		}()
+	}
+	return nil
+}
+
+// shutdownHTTP stops the HTTP server of s accepting connections and waits
+// until its requests are done or ctx is, closing the connections left then.
+func (s *Server) shutdownHTTP(ctx context.Context) error {
+	s.mu.Lock()
+	srv := s.http
+	s.http = nil
+	s.mu.Unlock()
+	if srv == nil {
+		return nil
+	}
+
+	log := s.gw.log
+	log.Info("Draining server", "server", s.Name, "active", s.requests.count())
+	if err := srv.Shutdown(ctx); err != nil {
+		srv.Close()
+		log.Warn("Timeout draining server, closing its connections", "server", s.Name)
+		return fmt.Errorf("%s server: %w", s.Name, err)
+	}
+	log.Info("Server stopped", "server", s.Name)
+	return nil
+}
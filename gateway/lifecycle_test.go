@@ -0,0 +1,174 @@
+package gateway_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+
+	"github.com/decentrio/gateway/config"
+	"github.com/decentrio/gateway/gateway"
+)
+
+func TestGatewayStartReportsBindErrors(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer taken.Close()
+
+	cfg := &config.Config{
+		Upstream: []config.Node{{RPC: "http://127.0.0.1:1", API: "http://127.0.0.1:1", Blocks: []uint64{1, 0}}},
+		Ports: config.Ports{
+			RPC: freePort(t),
+			API: uint16(taken.Addr().(*net.TCPAddr).Port),
+		},
+	}
+	gw, err := gateway.New(cfg)
+	require.NoError(t, err)
+
+	err = gw.Start()
+	require.ErrorContains(t, err, fmt.Sprintf("failed to start api server: listen tcp :%d", cfg.Ports.API))
+
+	// The RPC server started before the failure is shut down again.
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.Ports.RPC))
+	require.NoError(t, err)
+	lis.Close()
+}
+
+func TestGatewayListenAddresses(t *testing.T) {
+	upstream := namedUpstream(t, "a")
+	socket := filepath.Join(t.TempDir(), "api.sock")
+	// A socket file left behind by a gateway that did not shut down cleanly.
+	stale, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	port := freePort(t)
+	gw := startGateway(t, &config.Config{
+		Upstream: []config.Node{{API: upstream.URL, Blocks: []uint64{1, 0}}},
+		Ports:    config.Ports{API: freePort(t)},
+		Listen:   config.Listen{API: []string{fmt.Sprintf("127.0.0.1:%d", port), "unix://" + socket}},
+	})
+	require.Equal(t, port, gw.API_Server.Port)
+	require.Equal(t, "a", getBody(t, fmt.Sprintf("http://127.0.0.1:%d/params", port)))
+
+	unixClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	res, err := unixClient.Get("http://gateway/params")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Equal(t, "a", string(body))
+
+	// The listen list replaces the port.
+	_, err = http.Get(fmt.Sprintf("http://127.0.0.1:%d/params", gw.Config().Ports.API))
+	require.Error(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, gw.Shutdown(ctx))
+	_, err = os.Stat(socket)
+	require.True(t, os.IsNotExist(err), "the socket file is removed on shutdown")
+}
+
+func TestGatewayRunDrainsEachServer(t *testing.T) {
+	arrived, release := make(chan struct{}), make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(arrived)
+			<-release
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	cfg := &config.Config{
+		Upstream: []config.Node{{RPC: upstream.URL, API: upstream.URL, Blocks: []uint64{1, 0}}},
+		Ports:    config.Ports{RPC: freePort(t), API: freePort(t)},
+	}
+	gw, err := gateway.New(cfg)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() { stopped <- gw.Run(ctx) }()
+
+	rpcURL := fmt.Sprintf("http://127.0.0.1:%d/status", cfg.Ports.RPC)
+	for _, url := range []string{rpcURL, fmt.Sprintf("http://127.0.0.1:%d/params", cfg.Ports.API)} {
+		require.Eventually(t, func() bool {
+			res, err := http.Get(url)
+			if err == nil {
+				res.Body.Close()
+			}
+			return err == nil
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	slow := make(chan string)
+	go func() {
+		res, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/slow", cfg.Ports.API))
+		if err != nil {
+			slow <- err.Error()
+			return
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		slow <- string(body)
+	}()
+	<-arrived
+	cancel()
+
+	// The RPC server, with nothing in flight, stops right away while the API
+	// server keeps draining its slow request.
+	require.Eventually(t, func() bool {
+		_, err := http.Get(rpcURL)
+		return err != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	select {
+	case err := <-stopped:
+		t.Fatalf("gateway stopped before its requests were done: %v", err)
+	default:
+	}
+
+	close(release)
+	require.Equal(t, "ok", <-slow)
+	require.NoError(t, <-stopped)
+}
+
+func TestWebSocketSessionsClosedOnShutdown(t *testing.T) {
+	node := newFakeWSNode(t, newFakeChain(t))
+	gw := startGateway(t, &config.Config{Upstream: []config.Node{{JSONRPC: node.server.URL, JSONRPC_WS: node.url(), Blocks: []uint64{1, 0}}}}, listenOn(t, "jsonrpc_ws"))
+	server := &gw.JSON_RPC_WS_Server
+
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://127.0.0.1:%d/websocket", server.Port), nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.WriteJSON(map[string]any{"jsonrpc": "2.0", "id": 1, "method": "eth_blockNumber"}))
+	var reply map[string]any
+	require.NoError(t, conn.ReadJSON(&reply))
+
+	closed := make(chan error)
+	go func() {
+		_, _, err := conn.ReadMessage()
+		closed <- err
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, server.Shutdown(ctx, server))
+
+	err = <-closed
+	require.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "unexpected error: %v", err)
+}
@@ -0,0 +1,158 @@
+package gateway_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	tmservice "github.com/cosmos/cosmos-sdk/client/grpc/tmservice"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/decentrio/gateway/config"
+	"github.com/decentrio/gateway/gateway"
+	"github.com/decentrio/gateway/logging"
+)
+
+// syncBuffer is a log destination safe for the gateway's goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// accessLines returns the access log lines written so far.
+func (b *syncBuffer) accessLines(t *testing.T) []map[string]any {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var lines []map[string]any
+	scanner := bufio.NewScanner(bytes.NewReader(b.buf.Bytes()))
+	for scanner.Scan() {
+		var line map[string]any
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &line))
+		if line["msg"] == "access" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// captureLogs returns the option making a gateway log to the buffer returned.
+func captureLogs(t *testing.T) (*syncBuffer, gateway.Option) {
+	out := &syncBuffer{}
+	handler, err := logging.NewHandler(out, config.LogOptions{Format: "json"})
+	require.NoError(t, err)
+	return out, gateway.WithLogger(slog.New(handler))
+}
+
+func TestAccessLogOverHTTP(t *testing.T) {
+	forwarded := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded <- r.Header.Get("X-Request-ID")
+		w.Write([]byte(`{"block":{}}`))
+	}))
+	defer upstream.Close()
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+
+	logs, withLogs := captureLogs(t)
+	gw := startGateway(t, &config.Config{
+		Upstream: []config.Node{{API: upstream.URL, Blocks: []uint64{1, 0}}},
+	}, listenOn(t, "api"), withLogs)
+	api := &gw.API_Server
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://127.0.0.1:%d/cosmos/bank/v1beta1/supply", api.Port), nil)
+	require.NoError(t, err)
+	req.Header.Set("X-Request-ID", "req-42")
+	req.Header.Set("x-cosmos-block-height", "42")
+	var res *http.Response
+	require.Eventually(t, func() bool {
+		res, err = http.DefaultClient.Do(req)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "req-42", res.Header.Get("X-Request-ID"))
+	require.Equal(t, "req-42", <-forwarded)
+
+	lines := logs.accessLines(t)
+	require.Len(t, lines, 1)
+	line := lines[0]
+	require.Equal(t, "req-42", line["request_id"])
+	require.Equal(t, "127.0.0.1", line["client"])
+	require.Equal(t, "api", line["protocol"])
+	require.Equal(t, "/cosmos/bank/v1beta1/supply", line["method"])
+	require.EqualValues(t, 42, line["height"])
+	require.Equal(t, upstreamURL.Host, line["upstream"])
+	require.Equal(t, "200", line["status"])
+	require.EqualValues(t, len(`{"block":{}}`), line["bytes"])
+	require.Contains(t, line, "latency")
+}
+
+type requestIDTmNode struct {
+	tmservice.UnimplementedServiceServer
+}
+
+func (*requestIDTmNode) GetBlockByHeight(ctx context.Context, _ *tmservice.GetBlockByHeightRequest) (*tmservice.GetBlockByHeightResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	grpc.SetHeader(ctx, metadata.Pairs("x-upstream-request-id", md.Get("x-request-id")[0]))
+	return &tmservice.GetBlockByHeightResponse{}, nil
+}
+
+func TestRequestIDOverGRPC(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := grpc.NewServer()
+	tmservice.RegisterServiceServer(srv, &requestIDTmNode{})
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	logs, withLogs := captureLogs(t)
+	client := tmservice.NewServiceClient(startGRPCGateway(t, &config.Config{Upstream: []config.Node{
+		{GRPC: lis.Addr().String(), Blocks: []uint64{1, 0}},
+	}}, withLogs))
+
+	// Calls without an id get one of the gateway's.
+	var header metadata.MD
+	_, err = client.GetBlockByHeight(context.Background(), &tmservice.GetBlockByHeightRequest{Height: 7}, grpc.Header(&header))
+	require.NoError(t, err)
+	generated := header.Get("x-request-id")
+	require.Len(t, generated, 1)
+	require.Equal(t, generated, header.Get("x-upstream-request-id"))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-request-id", "call-7")
+	_, err = client.GetBlockByHeight(ctx, &tmservice.GetBlockByHeightRequest{Height: 7}, grpc.Header(&header))
+	require.NoError(t, err)
+	require.Equal(t, []string{"call-7"}, header.Get("x-upstream-request-id"))
+
+	lines := logs.accessLines(t)
+	require.Len(t, lines, 2)
+	require.Equal(t, "call-7", lines[1]["request_id"])
+	require.Equal(t, "grpc", lines[1]["protocol"])
+	require.Equal(t, "/cosmos.base.tendermint.v1beta1.Service/GetBlockByHeight", lines[1]["method"])
+	require.EqualValues(t, 7, lines[1]["height"])
+	require.Equal(t, lis.Addr().String(), lines[1]["upstream"])
+	require.Equal(t, "OK", lines[1]["status"])
+}
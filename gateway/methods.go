@@ -0,0 +1,98 @@
+package gateway
+
+import (
+	"context"
+	"net/http"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/decentrio/gateway/config"
+)
+
+// methodRules returns the method rules of the server of protocol, or nil when
+// it forwards everything.
+func (g *Gateway) methodRules(protocol string) *config.MethodRules {
+	cfg := g.cfg.Get()
+	if cfg == nil {
+		return nil
+	}
+	switch protocol {
+	case "rpc":
+		return cfg.Methods.RPC
+	case "api":
+		return cfg.Methods.API
+	case "grpc":
+		return cfg.Methods.GRPC
+	case "jsonrpc":
+		return cfg.Methods.JSONRPC
+	case "jsonrpc_ws":
+		return cfg.Methods.JSONRPC_WS
+	}
+	return nil
+}
+
+// checkMethod fails with Unimplemented when method may not be called on the
+// server of protocol.
+func (g *Gateway) checkMethod(protocol, method string) error {
+	rules := g.methodRules(protocol)
+	if rules == nil || methodAllowed(rules, method) {
+		return nil
+	}
+	return status.Errorf(codes.Unimplemented, "method not allowed: %s", method)
+}
+
+func methodAllowed(rules *config.MethodRules, method string) bool {
+	for _, pattern := range rules.Deny {
+		if matchGlob(pattern, method) {
+			return false
+		}
+	}
+	if len(rules.Allow) == 0 {
+		return true
+	}
+	for _, pattern := range rules.Allow {
+		if matchGlob(pattern, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterMethods refuses the requests of the server of protocol that call a
+// method it may not forward. A batch is refused as a whole.
+func (g *Gateway) filterMethods(protocol string, reject rejectFunc, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if g.methodRules(protocol) == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		methods, err := httpRequestMethods(w, protocol, r)
+		if err != nil {
+			rejectBody(w, err)
+			return
+		}
+		for _, method := range methods {
+			if err := g.checkMethod(protocol, method); err != nil {
+				reject(w, r, status.Convert(err))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (g *Gateway) methodUnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if err := g.checkMethod("grpc", info.FullMethod); err != nil && !isHealthMethod(info.FullMethod) {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (g *Gateway) methodStreamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := g.checkMethod("grpc", info.FullMethod); err != nil && !isHealthMethod(info.FullMethod) {
+		return err
+	}
+	return handler(srv, ss)
+}
@@ -0,0 +1,157 @@
+package gateway_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/decentrio/gateway/config"
+	"github.com/decentrio/gateway/gateway"
+)
+
+func TestMethodRulesOverHTTP(t *testing.T) {
+	var forwarded atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The gateway polls /status for the tip of the node on its own.
+		if r.URL.Path != "/status" {
+			forwarded.Add(1)
+		}
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{}}`))
+	}))
+	defer upstream.Close()
+
+	gw := startGateway(t, &config.Config{
+		Upstream: []config.Node{{RPC: upstream.URL, JSONRPC: upstream.URL, Blocks: []uint64{1, 0}}},
+		Methods: config.ServerMethods{
+			RPC:     &config.MethodRules{Deny: []string{"dump_consensus_state", "broadcast_*"}},
+			JSONRPC: &config.MethodRules{Allow: []string{"eth_*", "net_version"}, Deny: []string{"eth_sign*"}},
+		},
+	}, listenOn(t, "rpc"), listenOn(t, "jsonrpc"))
+	rpc, jsonrpc := &gw.RPC_Server, &gw.JSON_RPC_Server
+
+	do := func(method string, port uint16, path, body string) *http.Response {
+		var res *http.Response
+		require.Eventually(t, func() bool {
+			req, err := http.NewRequest(method, fmt.Sprintf("http://127.0.0.1:%d%s", port, path), bytes.NewReader([]byte(body)))
+			require.NoError(t, err)
+			res, err = http.DefaultClient.Do(req)
+			return err == nil
+		}, 5*time.Second, 10*time.Millisecond)
+		t.Cleanup(func() { res.Body.Close() })
+		return res
+	}
+	jsonRPCError := func(res *http.Response) *gateway.JSONRPCError {
+		var body gateway.JSONRPCResponse
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+		return body.Error
+	}
+
+	res := do(http.MethodGet, rpc.Port, "/dump_consensus_state", "")
+	require.Equal(t, http.StatusForbidden, res.StatusCode)
+	res = do(http.MethodPost, rpc.Port, "/", `{"jsonrpc":"2.0","id":1,"method":"broadcast_evidence","params":{}}`)
+	require.Equal(t, http.StatusForbidden, res.StatusCode)
+	require.Equal(t, -32601, jsonRPCError(res).Code)
+	// CometBFT runs the route of the path, not the method of the body.
+	res = do(http.MethodPost, rpc.Port, "/dump_consensus_state", `{"jsonrpc":"2.0","id":1,"method":"status","params":{}}`)
+	require.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	for _, body := range []string{
+		`{"jsonrpc":"2.0","id":1,"method":"debug_traceTransaction","params":[]}`,
+		`{"jsonrpc":"2.0","id":1,"method":"eth_signTransaction","params":[]}`,
+		`[{"jsonrpc":"2.0","id":1,"method":"eth_chainId"},{"jsonrpc":"2.0","id":2,"method":"admin_peers"}]`,
+	} {
+		rpcErr := jsonRPCError(do(http.MethodPost, jsonrpc.Port, "/", body))
+		require.NotNil(t, rpcErr, body)
+		require.Equal(t, -32601, rpcErr.Code)
+		require.Contains(t, rpcErr.Message, "method not allowed")
+	}
+	require.Zero(t, forwarded.Load(), "blocked calls never reach an upstream")
+
+	require.Nil(t, jsonRPCError(do(http.MethodPost, jsonrpc.Port, "/", `{"jsonrpc":"2.0","id":1,"method":"net_version","params":[]}`)))
+	require.NotZero(t, forwarded.Load())
+}
+
+func TestMethodRulesOverRPCWebSocket(t *testing.T) {
+	received := make(chan string, 10)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/websocket" {
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{}}`))
+			return
+		}
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			var req gateway.JSONRPCRequest
+			if err := conn.ReadJSON(&req); err != nil {
+				return
+			}
+			received <- req.Method
+			conn.WriteJSON(gateway.JSONRPCResponse{JSONRPC: "2.0", ID: req.ID, Result: map[string]any{}})
+		}
+	}))
+	defer upstream.Close()
+
+	gw := startGateway(t, &config.Config{
+		Upstream: []config.Node{{RPC: upstream.URL, Blocks: []uint64{1, 0}}},
+		Methods:  config.ServerMethods{RPC: &config.MethodRules{Deny: []string{"dump_consensus_state"}}},
+	}, listenOn(t, "rpc"))
+
+	client, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://127.0.0.1:%d/websocket", gw.RPC_Server.Port), nil)
+	require.NoError(t, err)
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var reply gateway.JSONRPCResponse
+	require.NoError(t, client.WriteJSON(map[string]any{"jsonrpc": "2.0", "id": 1, "method": "dump_consensus_state", "params": map[string]any{}}))
+	require.NoError(t, client.ReadJSON(&reply))
+	require.NotNil(t, reply.Error)
+	require.Equal(t, -32601, reply.Error.Code)
+	require.JSONEq(t, "1", string(reply.ID))
+
+	require.NoError(t, client.WriteJSON(map[string]any{"jsonrpc": "2.0", "id": 2, "method": "status", "params": map[string]any{}}))
+	reply = gateway.JSONRPCResponse{}
+	require.NoError(t, client.ReadJSON(&reply))
+	require.Nil(t, reply.Error)
+	require.Equal(t, "status", <-received, "blocked calls never reach the node")
+}
+
+func TestMethodRulesOverGRPC(t *testing.T) {
+	var forwarded atomic.Int32
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := grpc.NewServer(grpc.UnknownServiceHandler(func(_ any, stream grpc.ServerStream) error {
+		if method, _ := grpc.Method(stream.Context()); method != "/gateway.test.Query/Block" {
+			return status.Error(codes.Unimplemented, "reflection is not served")
+		}
+		forwarded.Add(1)
+		return stream.RecvMsg(&emptypb.Empty{})
+	}))
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn := startGRPCGateway(t, &config.Config{
+		Upstream: []config.Node{{GRPC: lis.Addr().String(), Blocks: []uint64{1, 0}}},
+		Methods:  config.ServerMethods{GRPC: &config.MethodRules{Deny: []string{"/gateway.test.Query/*"}}},
+	})
+	err = conn.Invoke(context.Background(), "/gateway.test.Query/Block", &emptypb.Empty{}, &emptypb.Empty{})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+	require.Contains(t, status.Convert(err).Message(), "method not allowed")
+	require.Zero(t, forwarded.Load())
+}
@@ -0,0 +1,285 @@
+package gateway
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+
+	"github.com/decentrio/gateway/health"
+	"github.com/decentrio/gateway/logging"
+	"github.com/decentrio/gateway/metrics"
+	"github.com/decentrio/gateway/pool"
+	"github.com/decentrio/gateway/tracing"
+)
+
+// registerGauges adds the gauges reading the state of the gateway to its
+// metrics.
+func (g *Gateway) registerGauges() {
+	for _, server := range []*Server{&g.RPC_Server, &g.API_Server, &g.GRPC_Server, &g.JSON_RPC_Server} {
+		g.metrics.GaugeFunc("gateway_inflight_requests", "Requests being handled.", prometheus.Labels{"server": server.Name}, func() float64 {
+			return float64(server.requests.count())
+		})
+	}
+	g.metrics.GaugeFunc("gateway_ws_sessions", "Open client WebSocket sessions.", nil, func() float64 {
+		return float64(g.JSON_RPC_WS_Server.requests.count())
+	})
+	g.metrics.GaugeFunc("gateway_ws_subscriptions", "Client subscriptions on WebSocket sessions.", nil, func() float64 {
+		g.wsHub.mu.Lock()
+		defer g.wsHub.mu.Unlock()
+		return float64(len(g.wsHub.byID))
+	})
+	g.metrics.GaugeFunc("gateway_ws_upstream_subscriptions", "Upstream subscriptions shared by the clients.", nil, func() float64 {
+		g.wsHub.mu.Lock()
+		defer g.wsHub.mu.Unlock()
+		return float64(len(g.wsHub.byKey))
+	})
+	g.metrics.GaugeFunc("gateway_ws_pool_connections", "Pooled WebSocket connections to upstream nodes.", nil, func() float64 {
+		g.wsPool.mu.Lock()
+		defer g.wsPool.mu.Unlock()
+		var n int
+		for _, conns := range g.wsPool.conns {
+			n += len(conns)
+		}
+		return float64(n)
+	})
+	g.metrics.GaugeFunc("gateway_semaphore_in_use", "Slots of the request semaphore taken.", nil, func() float64 {
+		return float64(len(g.semaphore))
+	})
+	g.metrics.GaugeFunc("gateway_semaphore_capacity", "Size of the request semaphore.", nil, func() float64 {
+		return float64(cap(g.semaphore))
+	})
+}
+
+func (server *Server) startMetrics() error {
+	g := server.gw
+	g.log.Info("Starting metrics server")
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", g.metrics.Handler())
+
+	srv := &http.Server{
+		Handler: g.withProbes(mux),
+	}
+
+	return server.startHTTP(srv, nil)
+}
+
+// instrumentHTTP records the requests of the server of protocol in the metrics,
+// the access log and a trace continuing the one of the caller, if any. Each
+// request gets an ID, taken from the client's X-Request-ID header when it has
+// one, which is passed on to upstreams and returned in the response.
+func (g *Gateway) instrumentHTTP(protocol string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Bodies are read up front, paths only once an API key in them has
+		// been stripped.
+		var methods []string
+		var bodyErr error
+		if protocol == "jsonrpc" || r.Method == http.MethodPost && protocol == "rpc" {
+			methods, bodyErr = peekJSONRPCMethods(w, r)
+		}
+
+		id := logging.RequestID(r.Header.Get(logging.RequestIDHeader))
+		r.Header.Set(logging.RequestIDHeader, id)
+		w.Header().Set(logging.RequestIDHeader, id)
+		req := logging.NewRequest(id, protocol, g.clientIP(r.RemoteAddr, r.Header.Get), "")
+		ctx := logging.NewContext(metrics.WithServer(r.Context(), protocol), req)
+		ctx, span := startServerSpan(tracing.Extract(ctx, propagation.HeaderCarrier(r.Header)), protocol, req)
+		defer span.End()
+
+		rec := &metrics.StatusRecorder{ResponseWriter: w}
+		if bodyErr != nil {
+			rejectBody(rec, bodyErr)
+		} else {
+			next.ServeHTTP(rec, r.WithContext(ctx))
+		}
+
+		if methods == nil {
+			methods, _ = httpRequestMethods(w, protocol, r)
+		}
+		req.Method = "batch"
+		if len(methods) == 1 {
+			req.Method = methods[0]
+		}
+		if rec.Status == 0 {
+			rec.Status = http.StatusOK
+		}
+		status := strconv.Itoa(rec.Status)
+		method := req.Method
+		if protocol == "api" {
+			method = metricPath(method)
+		}
+		g.metrics.ObserveRequest(protocol, method, status, req.Elapsed())
+		g.logAccess(req, status, rec.Bytes)
+
+		span.SetName(protocol + " " + method)
+		span.SetAttributes(attribute.String("gateway.method", method), attribute.Int("http.response.status_code", rec.Status))
+		if rec.Status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rec.Status))
+		}
+	})
+}
+
+// logAccess writes the access log line of req, unless the access log is
+// turned off.
+func (g *Gateway) logAccess(req *logging.Request, status string, bytes int64) {
+	if g.cfg.Get().Log.AccessLogEnabled() {
+		req.Done(g.log, status, bytes)
+	}
+}
+
+// metricPath replaces the heights, hashes and addresses in a REST path so that
+// calls to the same route share a label.
+func metricPath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if _, err := strconv.ParseUint(segment, 10, 64); err == nil || len(segment) >= 20 {
+			segments[i] = "{param}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// grpcRequestContext sets up the request of a gRPC call like instrumentHTTP,
+// with the request ID in the x-request-id metadata, which the proxy and the
+// registered services forward upstream, and the trace context in the
+// traceparent metadata.
+func (g *Gateway) grpcRequestContext(ctx context.Context, fullMethod string) (context.Context, *logging.Request) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	md = md.Copy()
+	var id string
+	if values := md.Get(logging.RequestIDMetadata); len(values) > 0 {
+		id = values[0]
+	}
+	id = logging.RequestID(id)
+	md.Set(logging.RequestIDMetadata, id)
+	grpc.SetHeader(ctx, metadata.Pairs(logging.RequestIDMetadata, id))
+
+	var remoteAddr string
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		remoteAddr = p.Addr.String()
+	}
+	header := func(key string) string {
+		if values := md.Get(key); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	req := logging.NewRequest(id, "grpc", g.clientIP(remoteAddr, header), fullMethod)
+	ctx = metadata.NewIncomingContext(metrics.WithServer(ctx, "grpc"), md)
+	ctx = logging.NewContext(tracing.Extract(ctx, tracing.MetadataCarrier(md)), req)
+	ctx, span := startServerSpan(ctx, "grpc", req, trace.WithAttributes(attribute.String("gateway.method", fullMethod)))
+	span.SetName(strings.TrimPrefix(fullMethod, "/"))
+	return ctx, req
+}
+
+// grpcDone records a finished gRPC call.
+func (g *Gateway) grpcDone(ctx context.Context, req *logging.Request, err error) {
+	code := status.Code(err).String()
+	g.metrics.ObserveRequest("grpc", req.Method, code, req.Elapsed())
+	var bytes int64
+	if sent, ok := ctx.Value(grpcSentBytesKey{}).(*atomic.Int64); ok {
+		bytes = sent.Load()
+	}
+	g.logAccess(req, code, bytes)
+
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.Int("rpc.grpc.status_code", int(status.Code(err))))
+	tracing.End(span, err)
+}
+
+func (g *Gateway) metricsUnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ctx, r := g.grpcRequestContext(ctx, info.FullMethod)
+	res, err := handler(ctx, req)
+	g.grpcDone(ctx, r, err)
+	return res, err
+}
+
+func (g *Gateway) metricsStreamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, r := g.grpcRequestContext(ss.Context(), info.FullMethod)
+	err := handler(srv, &contextServerStream{ServerStream: ss, ctx: ctx})
+	g.grpcDone(ctx, r, err)
+	return err
+}
+
+type grpcSentBytesKey struct{}
+
+// grpcStatsHandler counts the bytes sent back on each call, for the access
+// log.
+type grpcStatsHandler struct{}
+
+func (grpcStatsHandler) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return context.WithValue(ctx, grpcSentBytesKey{}, new(atomic.Int64))
+}
+
+func (grpcStatsHandler) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	if out, ok := s.(*stats.OutPayload); ok {
+		if sent, ok := ctx.Value(grpcSentBytesKey{}).(*atomic.Int64); ok {
+			sent.Add(int64(out.WireLength))
+		}
+	}
+}
+
+func (grpcStatsHandler) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (grpcStatsHandler) HandleConn(context.Context, stats.ConnStats) {}
+
+type grpcUpstreamKey struct{}
+
+// grpcUpstream is filled in by the proxy director with the node it picked.
+type grpcUpstream struct {
+	addr string
+	call *health.Call
+}
+
+// observeGRPCUpstream records the upstream call made by the transparent proxy
+// handler.
+func (g *Gateway) observeGRPCUpstream(handler grpc.StreamHandler) grpc.StreamHandler {
+	return func(srv any, stream grpc.ServerStream) error {
+		picked := &grpcUpstream{}
+		ctx := context.WithValue(stream.Context(), grpcUpstreamKey{}, picked)
+		start := time.Now()
+		err := handler(srv, &contextServerStream{ServerStream: stream, ctx: ctx})
+		if picked.addr != "" {
+			g.metrics.ObserveUpstream("grpc", picked.addr, status.Code(err).String(), time.Since(start))
+			picked.call.Done(pool.UpstreamFailure(err))
+			logging.SetUpstream(ctx, picked.addr)
+		}
+		return err
+	}
+}
+
+// endpointAddr returns the address an upstream endpoint of protocol is known
+// by in metrics and health: the host of a URL, or a gRPC address as is.
+func endpointAddr(protocol, endpoint string) string {
+	if protocol == "grpc" {
+		return endpoint
+	}
+	return upstreamHost(endpoint)
+}
+
+// upstreamHost returns the host of an upstream URL, which unlike the URL
+// carries no credentials.
+func upstreamHost(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "invalid"
+	}
+	return u.Host
+}
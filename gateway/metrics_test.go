@@ -0,0 +1,93 @@
+package gateway_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/decentrio/gateway/config"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+
+	gw := startGateway(t, &config.Config{
+		Upstream: []config.Node{{API: upstream.URL, Blocks: []uint64{1, 0}}},
+	}, listenOn(t, "api"), listenOn(t, "metrics"))
+	api, metricsServer := &gw.API_Server, &gw.Metrics_Server
+
+	get := func(port uint16, path string) string {
+		var res *http.Response
+		require.Eventually(t, func() bool {
+			res, err = http.Get(fmt.Sprintf("http://127.0.0.1:%d%s", port, path))
+			return err == nil
+		}, 5*time.Second, 10*time.Millisecond)
+		defer res.Body.Close()
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	get(api.Port, "/cosmos/base/tendermint/v1beta1/blocks/42")
+	scrape := get(metricsServer.Port, "/metrics")
+
+	for _, line := range []string{
+		`gateway_requests_total{method="/cosmos/base/tendermint/v1beta1/blocks/{param}",server="api",status="200"} 1`,
+		fmt.Sprintf(`gateway_upstream_requests_total{server="api",status="200",upstream=%q} 1`, upstreamURL.Host),
+		fmt.Sprintf(`gateway_routed_requests_total{range="1-latest",server="api",upstream=%q} 1`, upstreamURL.Host),
+		`gateway_inflight_requests{server="api"} 0`,
+		`gateway_semaphore_capacity 2000`,
+		`gateway_grpc_pool_connections`,
+		`gateway_ws_subscriptions`,
+	} {
+		require.Contains(t, scrape, line)
+	}
+}
+
+func TestInflightJSONRPCRequests(t *testing.T) {
+	arrived, release := make(chan struct{}), make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(arrived)
+		<-release
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	gw := startGateway(t, &config.Config{
+		Upstream: []config.Node{{RPC: upstream.URL, Blocks: []uint64{1, 0}}},
+	}, listenOn(t, "rpc"), listenOn(t, "metrics"))
+	rpc, metricsServer := &gw.RPC_Server, &gw.Metrics_Server
+
+	done := make(chan error)
+	go func() {
+		res, err := http.Post(fmt.Sprintf("http://127.0.0.1:%d/", rpc.Port), "application/json",
+			strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"status","params":{}}`))
+		if err == nil {
+			res.Body.Close()
+		}
+		done <- err
+	}()
+	<-arrived
+
+	res, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/metrics", metricsServer.Port))
+	require.NoError(t, err)
+	scrape, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	close(release)
+	require.NoError(t, err)
+	require.NoError(t, <-done)
+	require.Contains(t, string(scrape), `gateway_inflight_requests{server="rpc"} 1`)
+}
@@ -0,0 +1,92 @@
+package gateway
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+
+	"google.golang.org/grpc"
+
+	"github.com/decentrio/gateway/config"
+)
+
+// Router picks the nodes able to serve a height, in the order they should be
+// tried. Height 0 asks for the nodes serving the latest blocks.
+type Router interface {
+	Route(cfg *config.Config, height uint64) []*config.Node
+}
+
+// RouterFunc lets an ordinary function be used as a Router.
+type RouterFunc func(cfg *config.Config, height uint64) []*config.Node
+
+func (f RouterFunc) Route(cfg *config.Config, height uint64) []*config.Node {
+	return f(cfg, height)
+}
+
+// Option configures a gateway created with New.
+type Option func(g *Gateway)
+
+// WithLogger makes the gateway log to logger instead of the default logger.
+// The request ID of each request is added to its records.
+func WithLogger(logger *slog.Logger) Option {
+	return func(g *Gateway) {
+		g.log = logger
+	}
+}
+
+// WithRouter replaces the routing of requests by height, which by default
+// follows the blocks and weights of the configured upstreams.
+func WithRouter(router Router) Option {
+	return func(g *Gateway) {
+		g.router = router
+	}
+}
+
+// WithTransport makes the gateway reach its HTTP upstreams with transport.
+// Upstreams with TLS settings of their own get a clone of it.
+func WithTransport(transport *http.Transport) Option {
+	return func(g *Gateway) {
+		g.transport = transport
+	}
+}
+
+// WithListener makes server ("rpc", "grpc", "api", "jsonrpc", "jsonrpc_ws",
+// "metrics" or "admin") serve lis instead of binding its configured
+// addresses, enabling it even when it has none. Given several times, the
+// server serves every listener. Listeners are closed on shutdown.
+func WithListener(server string, lis net.Listener) Option {
+	return func(g *Gateway) {
+		g.injected[server] = append(g.injected[server], lis)
+	}
+}
+
+// WithMiddleware wraps the handlers of the RPC, API, JSON-RPC and JSON-RPC
+// WebSocket servers in middleware, the first one outermost. Middleware runs
+// after the request has been given its ID, metrics and trace, and before the
+// API key, method rules and rate limits are checked.
+func WithMiddleware(middleware ...func(http.Handler) http.Handler) Option {
+	return func(g *Gateway) {
+		g.middleware = append(g.middleware, middleware...)
+	}
+}
+
+// WithInterceptors adds interceptors to the gRPC server, run in the same place
+// as the middleware of WithMiddleware. Either may be nil.
+func WithInterceptors(unary grpc.UnaryServerInterceptor, stream grpc.StreamServerInterceptor) Option {
+	return func(g *Gateway) {
+		if unary != nil {
+			g.unaryInterceptors = append(g.unaryInterceptors, unary)
+		}
+		if stream != nil {
+			g.streamInterceptors = append(g.streamInterceptors, stream)
+		}
+	}
+}
+
+// withMiddleware wraps next in the middleware given to the gateway.
+func (g *Gateway) withMiddleware(next http.Handler) http.Handler {
+	for i := len(g.middleware) - 1; i >= 0; i-- {
+		next = g.middleware[i](next)
+	}
+	return next
+}
@@ -0,0 +1,312 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/decentrio/gateway/config"
+	"github.com/decentrio/gateway/health"
+	"github.com/decentrio/gateway/metrics"
+)
+
+const (
+	defaultMaxTipAge   = time.Minute
+	defaultTipInterval = 10 * time.Second
+)
+
+// listener is an address a server of the gateway listens on.
+type listener struct {
+	Server  string `json:"server"`
+	Address string `json:"address"`
+	Port    uint16 `json:"port,omitempty"`
+	Bound   bool   `json:"bound"`
+}
+
+// setListener records that server listens on lis, and whether it is still
+// serving it.
+func (g *Gateway) setListener(server string, lis net.Listener, bound bool) {
+	g.listenersMu.Lock()
+	defer g.listenersMu.Unlock()
+	addr := lis.Addr().String()
+	g.listeners[addr] = listener{Server: server, Address: addr, Port: listenerPort(lis), Bound: bound}
+}
+
+func (g *Gateway) removeListener(lis net.Listener) {
+	g.listenersMu.Lock()
+	defer g.listenersMu.Unlock()
+	delete(g.listeners, lis.Addr().String())
+}
+
+// removeListeners forgets every listener of server.
+func (g *Gateway) removeListeners(server string) {
+	g.listenersMu.Lock()
+	defer g.listenersMu.Unlock()
+	for addr, l := range g.listeners {
+		if l.Server == server {
+			delete(g.listeners, addr)
+		}
+	}
+}
+
+func (g *Gateway) currentListeners() []listener {
+	g.listenersMu.Lock()
+	defer g.listenersMu.Unlock()
+	list := make([]listener, 0, len(g.listeners))
+	for _, l := range g.listeners {
+		list = append(list, l)
+	}
+	slices.SortFunc(list, func(a, b listener) int {
+		if a.Port != b.Port {
+			return int(a.Port) - int(b.Port)
+		}
+		return strings.Compare(a.Address, b.Address)
+	})
+	return list
+}
+
+// rangeCheck is the readiness of the nodes serving a height range over a
+// protocol.
+type rangeCheck struct {
+	Protocol string `json:"protocol"`
+	Range    string `json:"range"`
+	// Healthy lists the enabled nodes of the range whose endpoint is healthy.
+	Healthy []string `json:"healthy"`
+	Ready   bool     `json:"ready"`
+}
+
+// tipCheck is the freshness of the latest block seen from the nodes.
+type tipCheck struct {
+	Height uint64 `json:"height"`
+	Age    string `json:"age"`
+	Ready  bool   `json:"ready"`
+}
+
+type readiness struct {
+	Ready     bool         `json:"ready"`
+	Listeners []listener   `json:"listeners"`
+	Ranges    []rangeCheck `json:"ranges"`
+	// Tip is left out while no block has been seen or the check is disabled.
+	Tip *tipCheck `json:"tip,omitempty"`
+}
+
+func allBound(list []listener) bool {
+	for _, l := range list {
+		if !l.Bound {
+			return false
+		}
+	}
+	return true
+}
+
+// endpointHealthy reports whether calls over protocol may be sent to addr.
+func (g *Gateway) endpointHealthy(protocol, addr string) bool {
+	if protocol == "grpc" {
+		return g.pool.Healthy(addr)
+	}
+	return g.health.Available(addr)
+}
+
+// checkReadiness tells whether the gateway can serve requests: its listeners
+// are bound, every height range configured for the protocols it serves has a
+// healthy node, and the chain tip seen from the nodes keeps moving.
+func (g *Gateway) checkReadiness() readiness {
+	cfg := g.cfg.Get()
+	r := readiness{Listeners: g.currentListeners()}
+	r.Ready = allBound(r.Listeners)
+
+	for _, l := range r.Listeners {
+		if !slices.Contains(upstreamProtocols, l.Server) {
+			continue
+		}
+		var checks []rangeCheck
+		for i := range cfg.Upstream {
+			node := &cfg.Upstream[i]
+			endpoint := node.Endpoint(l.Server)
+			if endpoint == "" {
+				continue
+			}
+			j := slices.IndexFunc(checks, func(c rangeCheck) bool { return c.Range == node.HeightRange() })
+			if j < 0 {
+				checks = append(checks, rangeCheck{Protocol: l.Server, Range: node.HeightRange(), Healthy: []string{}})
+				j = len(checks) - 1
+			}
+			if node.Enabled() && g.endpointHealthy(l.Server, endpointAddr(l.Server, endpoint)) {
+				checks[j].Healthy = append(checks[j].Healthy, cfg.NodeName(i))
+				checks[j].Ready = true
+			}
+		}
+		for _, c := range checks {
+			r.Ready = r.Ready && c.Ready
+		}
+		r.Ranges = append(r.Ranges, checks...)
+	}
+
+	if r.Tip = g.checkTip(cfg); r.Tip != nil {
+		r.Ready = r.Ready && r.Tip.Ready
+	}
+	return r
+}
+
+// protocolReady tells whether the gateway can serve requests over protocol.
+func (r readiness) protocolReady(protocol string) bool {
+	if !allBound(r.Listeners) || (r.Tip != nil && !r.Tip.Ready) {
+		return false
+	}
+	for _, c := range r.Ranges {
+		if c.Protocol == protocol && !c.Ready {
+			return false
+		}
+	}
+	return true
+}
+
+// checkTip finds the latest block seen from the enabled nodes, and whether it
+// was seen within health.max_tip_age.
+func (g *Gateway) checkTip(cfg *config.Config) *tipCheck {
+	maxAge := cfg.Health.MaxTipAge
+	if maxAge == 0 {
+		maxAge = defaultMaxTipAge
+	}
+	if maxAge < 0 {
+		return nil
+	}
+
+	var tip health.Status
+	for i := range cfg.Upstream {
+		node := &cfg.Upstream[i]
+		if !node.Enabled() {
+			continue
+		}
+		for _, protocol := range upstreamProtocols {
+			if endpoint := node.Endpoint(protocol); endpoint != "" {
+				if status := g.health.Get(endpointAddr(protocol, endpoint)); status.Tip > tip.Tip {
+					tip = status
+				}
+			}
+		}
+	}
+	if tip.Tip == 0 {
+		return nil
+	}
+	age := time.Since(tip.TipAt)
+	return &tipCheck{Height: tip.Tip, Age: age.Round(time.Second).String(), Ready: age <= maxAge}
+}
+
+func writeProbe(w http.ResponseWriter, ok bool, v any) {
+	code := http.StatusOK
+	if !ok {
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// withProbes answers the liveness (/healthz) and readiness (/readyz) probes
+// ahead of next, without API key, method rules or rate limits.
+func (g *Gateway) withProbes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		switch r.URL.Path {
+		case "/healthz":
+			list := g.currentListeners()
+			writeProbe(w, allBound(list), map[string]any{"alive": allBound(list), "listeners": list})
+		case "/readyz":
+			ready := g.checkReadiness()
+			writeProbe(w, ready.Ready, ready)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// watchTips asks the nodes serving the latest blocks for their height every
+// health.tip_interval until stop is closed, so that the readiness probe
+// notices a chain that no longer moves even when no client follows it.
+func (g *Gateway) watchTips(stop <-chan struct{}) {
+	interval := g.cfg.Get().Health.TipInterval
+	if interval == 0 {
+		interval = defaultTipInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		g.pollTips(interval)
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (g *Gateway) pollTips(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(metrics.WithServer(context.Background(), "health"), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, node := range g.cfg.Get().LatestNodes() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			endpoint, height, err := g.nodeTip(ctx, node)
+			switch {
+			case endpoint == "":
+			case err != nil:
+				g.log.Debug("Failed to get the height of upstream", "upstream", upstreamHost(endpoint), "err", err)
+			default:
+				g.health.ObserveTip(upstreamHost(endpoint), height)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// nodeTip asks node for its latest height, over CometBFT RPC or else
+// Ethereum JSON-RPC. The endpoint asked is empty if the node has neither.
+func (g *Gateway) nodeTip(ctx context.Context, node *config.Node) (string, uint64, error) {
+	switch {
+	case node.RPC != "":
+		body, err := g.http.GetJSON(ctx, node.RPC, "/status")
+		if err != nil {
+			return node.RPC, 0, err
+		}
+		var status struct {
+			Result struct {
+				SyncInfo struct {
+					LatestBlockHeight string `json:"latest_block_height"`
+				} `json:"sync_info"`
+			} `json:"result"`
+		}
+		if err := json.Unmarshal(body, &status); err != nil {
+			return node.RPC, 0, err
+		}
+		height, err := strconv.ParseUint(status.Result.SyncInfo.LatestBlockHeight, 10, 64)
+		return node.RPC, height, err
+	case node.JSONRPC != "":
+		body, err := g.http.PostJSON(ctx, node.JSONRPC, []byte(`{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber","params":[]}`))
+		if err != nil {
+			return node.JSONRPC, 0, err
+		}
+		var res struct {
+			Result string `json:"result"`
+		}
+		if err := json.Unmarshal(body, &res); err != nil {
+			return node.JSONRPC, 0, err
+		}
+		height, err := strconv.ParseUint(strings.TrimPrefix(res.Result, "0x"), 16, 64)
+		return node.JSONRPC, height, err
+	}
+	return "", 0, nil
+}
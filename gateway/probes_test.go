@@ -0,0 +1,146 @@
+package gateway_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	"github.com/decentrio/gateway/config"
+)
+
+func TestHealthAndReadinessProbes(t *testing.T) {
+	var failing atomic.Bool
+	archive := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer archive.Close()
+	latest := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer latest.Close()
+	latestURL, err := url.Parse(latest.URL)
+	require.NoError(t, err)
+
+	gw := startGateway(t, &config.Config{
+		Upstream: []config.Node{
+			{Name: "archive", RPC: archive.URL, Blocks: []uint64{1, 100}},
+			{Name: "latest", RPC: latest.URL, Blocks: []uint64{101, 0}},
+		},
+		Auth:   testAuth(),
+		Health: config.HealthOptions{MaxTipAge: 200 * time.Millisecond},
+	}, listenOn(t, "rpc"))
+	server := &gw.RPC_Server
+
+	get := func(path string) (int, map[string]any) {
+		var res *http.Response
+		require.Eventually(t, func() bool {
+			var err error
+			res, err = http.Get(fmt.Sprintf("http://127.0.0.1:%d%s", server.Port, path))
+			return err == nil
+		}, 5*time.Second, 10*time.Millisecond)
+		defer res.Body.Close()
+		var body map[string]any
+		json.NewDecoder(res.Body).Decode(&body)
+		return res.StatusCode, body
+	}
+
+	// Probes need no API key.
+	code, body := get("/healthz")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, []any{map[string]any{
+		"server": "rpc", "address": fmt.Sprintf("127.0.0.1:%d", server.Port), "port": float64(server.Port), "bound": true,
+	}}, body["listeners"])
+
+	code, body = get("/readyz")
+	require.Equal(t, http.StatusOK, code, body)
+	require.Equal(t, []any{
+		map[string]any{"protocol": "rpc", "range": "1-100", "healthy": []any{"archive"}, "ready": true},
+		map[string]any{"protocol": "rpc", "range": "101-latest", "healthy": []any{"latest"}, "ready": true},
+	}, body["ranges"])
+	require.Nil(t, body["tip"])
+
+	t.Run("range without a healthy node", func(t *testing.T) {
+		failing.Store(true)
+		for range 5 {
+			code, _ := get("/block?height=50&api_key=alice-key")
+			require.Equal(t, http.StatusServiceUnavailable, code)
+		}
+		code, body := get("/readyz")
+		require.Equal(t, http.StatusServiceUnavailable, code)
+		require.Equal(t, map[string]any{"protocol": "rpc", "range": "1-100", "healthy": []any{}, "ready": false}, body["ranges"].([]any)[0])
+
+		failing.Store(false)
+		gw.Health().Reset(archive.Listener.Addr().String())
+		code, _ = get("/readyz")
+		require.Equal(t, http.StatusOK, code)
+	})
+
+	t.Run("stale tip", func(t *testing.T) {
+		gw.Health().ObserveTip(latestURL.Host, 42)
+		code, body := get("/readyz")
+		require.Equal(t, http.StatusOK, code)
+		require.Equal(t, 42.0, body["tip"].(map[string]any)["height"])
+
+		time.Sleep(300 * time.Millisecond)
+		// The same height again does not make the tip any fresher.
+		gw.Health().ObserveTip(latestURL.Host, 42)
+		code, body = get("/readyz")
+		require.Equal(t, http.StatusServiceUnavailable, code)
+		require.Equal(t, false, body["tip"].(map[string]any)["ready"])
+
+		gw.Health().ObserveTip(latestURL.Host, 43)
+		code, _ = get("/readyz")
+		require.Equal(t, http.StatusOK, code)
+	})
+}
+
+func TestGRPCHealthService(t *testing.T) {
+	node := startFakeGRPCNode(t, "node", testQueryFile())
+	gw := startGateway(t, &config.Config{
+		Upstream: []config.Node{{GRPC: node, Blocks: []uint64{1, 0}}},
+		Auth:     testAuth(),
+	}, listenOn(t, "grpc"))
+	conn := dialGRPCGateway(t, gw)
+	client := healthpb.NewHealthClient(conn)
+	ctx := context.Background()
+
+	check := func(service string) healthpb.HealthCheckResponse_ServingStatus {
+		res, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+		require.NoError(t, err)
+		return res.Status
+	}
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, check(""))
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, check("gateway.test.Query"))
+	_, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: "unknown.Service"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	watch, err := client.Watch(ctx, &healthpb.HealthCheckRequest{Service: ""})
+	require.NoError(t, err)
+	res, err := watch.Recv()
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, res.Status)
+
+	for range 5 {
+		gw.Health().Begin(node).Done(errors.New("unavailable"))
+	}
+	res, err = watch.Recv()
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, res.Status)
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, check("gateway.test.Query"))
+}
@@ -0,0 +1,305 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/decentrio/gateway/config"
+)
+
+const (
+	// rateLimitSweepInterval is how often buckets that have refilled are dropped.
+	rateLimitSweepInterval = time.Minute
+	// maxRequestBodyBytes caps the JSON-RPC bodies read by the gateway, well
+	// above the 1MB CometBFT accepts by default.
+	maxRequestBodyBytes = 10 << 20
+)
+
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*tokenBucket)}
+}
+
+type tokenBucket struct {
+	tokens      float64
+	rate, burst float64
+	last        time.Time
+}
+
+// take removes cost tokens from the bucket of client. When there are not
+// enough, nothing is taken and take returns how long until there will be.
+func (l *rateLimiter) take(client string, rate, burst, cost float64, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.swept) > rateLimitSweepInterval {
+		for id, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst {
+				delete(l.buckets, id)
+			}
+		}
+		l.swept = now
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[client] = b
+	}
+	b.rate, b.burst = rate, burst
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	// A request costing more than the bucket holds waits for a full bucket.
+	cost = math.Min(cost, burst)
+	if b.tokens >= cost {
+		b.tokens -= cost
+		return 0, true
+	}
+	return time.Duration((cost - b.tokens) / rate * float64(time.Second)), false
+}
+
+func (g *Gateway) rateLimitOptions() *config.RateLimitOptions {
+	cfg := g.cfg.Get()
+	if cfg == nil || !cfg.RateLimit.Enabled || cfg.RateLimit.Rate <= 0 {
+		return nil
+	}
+	return &cfg.RateLimit
+}
+
+// clientLimit returns the bucket id of the client of ctx and its limits.
+// remoteAddr and header describe the connection the request came from.
+func (g *Gateway) clientLimit(opts *config.RateLimitOptions, ctx context.Context, remoteAddr string, header func(string) string) (client string, rate, burst float64) {
+	rate, burst = opts.Rate, opts.Burst
+	if name, ok := apiKeyName(ctx); ok {
+		client = "key:" + name
+		if auth := g.authOptions(); auth != nil {
+			for _, k := range auth.Keys {
+				if k.Name == name && k.Rate > 0 {
+					rate, burst = k.Rate, k.Burst
+				}
+			}
+		}
+	} else {
+		client = "ip:" + g.clientIP(remoteAddr, header)
+	}
+	if burst <= 0 {
+		burst = math.Max(rate, 1)
+	}
+	return client, rate, burst
+}
+
+// clientIP returns the address of the client, taken from the configured
+// client_ip_header when the gateway runs behind a proxy. The entries on the
+// left of the header are whatever the client sent, so the one added by the
+// outermost trusted proxy is used: trusted_proxies places from the right.
+func (g *Gateway) clientIP(remoteAddr string, header func(string) string) string {
+	ip := remoteAddr
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		ip = host
+	}
+	cfg := g.cfg.Get()
+	if cfg == nil || cfg.RateLimit.ClientIPHeader == "" {
+		return ip
+	}
+	var forwarded []string
+	for _, entry := range strings.Split(header(cfg.RateLimit.ClientIPHeader), ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			forwarded = append(forwarded, entry)
+		}
+	}
+	if len(forwarded) == 0 {
+		return ip
+	}
+	hops := max(cfg.RateLimit.TrustedProxies, 1)
+	// With fewer entries than proxies, the left-most is the best there is.
+	return forwarded[max(len(forwarded)-hops, 0)]
+}
+
+// matchGlob reports whether name matches pattern, with the syntax of
+// path.Match. Invalid patterns match nothing.
+func matchGlob(pattern, name string) bool {
+	ok, err := path.Match(pattern, name)
+	return err == nil && ok
+}
+
+// httpRequestMethods returns the methods called by a request to the server of
+// protocol: the route or path for URI requests, the JSON-RPC methods of the
+// body otherwise. A CometBFT POST to a route other than / runs that route
+// whatever its body says, so the route counts as well.
+func httpRequestMethods(w http.ResponseWriter, protocol string, r *http.Request) ([]string, error) {
+	switch {
+	case protocol == "api":
+		return []string{r.URL.Path}, nil
+	case protocol == "rpc" && r.Method != http.MethodPost:
+		return []string{strings.TrimPrefix(r.URL.Path, "/")}, nil
+	case protocol == "rpc" && r.URL.Path != "/":
+		methods, err := peekJSONRPCMethods(w, r)
+		return append(methods, strings.TrimPrefix(r.URL.Path, "/")), err
+	default:
+		return peekJSONRPCMethods(w, r)
+	}
+}
+
+// peekJSONRPCMethods returns the methods of a JSON-RPC request or batch,
+// leaving the body in place for the handler. Bodies over maxRequestBodyBytes
+// are not read.
+func peekJSONRPCMethods(w http.ResponseWriter, r *http.Request) ([]string, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBodyBytes))
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	return jsonRPCMethods(body), nil
+}
+
+// rejectBody answers a request whose body could not be read.
+func rejectBody(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, "Invalid request body", http.StatusBadRequest)
+}
+
+// jsonRPCMethods returns the methods of a JSON-RPC request or batch.
+func jsonRPCMethods(body []byte) []string {
+	type call struct {
+		Method string `json:"method"`
+	}
+	var batch []call
+	if json.Unmarshal(body, &batch) == nil && len(batch) > 0 {
+		methods := make([]string, len(batch))
+		for i, c := range batch {
+			methods[i] = c.Method
+		}
+		return methods
+	}
+	var single call
+	json.Unmarshal(body, &single)
+	return []string{single.Method}
+}
+
+func rateLimitError(wait time.Duration) *status.Status {
+	st := status.Newf(codes.ResourceExhausted, "rate limit exceeded, retry after %s", retryAfter(wait))
+	if detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(wait)}); err == nil {
+		return detailed
+	}
+	return st
+}
+
+// retryAfter rounds wait up to whole seconds, as in a Retry-After header.
+func retryAfter(wait time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(wait.Seconds())))
+}
+
+// rateLimit charges the requests of the server of protocol to their client
+// before handing them to next, refusing them once the client is over its
+// limit.
+func (g *Gateway) rateLimit(protocol string, reject rejectFunc, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		opts := g.rateLimitOptions()
+		if opts == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		methods, err := httpRequestMethods(w, protocol, r)
+		if err != nil {
+			rejectBody(w, err)
+			return
+		}
+		var cost float64
+		for _, method := range methods {
+			cost += opts.Cost(method)
+		}
+		client, rate, burst := g.clientLimit(opts, r.Context(), r.RemoteAddr, r.Header.Get)
+		if wait, ok := g.limiter.take(client, rate, burst, cost, time.Now()); !ok {
+			w.Header().Set("Retry-After", retryAfter(wait))
+			reject(w, r, rateLimitError(wait))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// wsRateLimiter returns a function charging the JSON-RPC calls of a
+// WebSocket session opened by r, or nil when rate limiting is off.
+func (g *Gateway) wsRateLimiter(r *http.Request) func(method string) error {
+	opts := g.rateLimitOptions()
+	if opts == nil {
+		return nil
+	}
+	client, rate, burst := g.clientLimit(opts, r.Context(), r.RemoteAddr, r.Header.Get)
+	return func(method string) error {
+		if wait, ok := g.limiter.take(client, rate, burst, opts.Cost(method), time.Now()); !ok {
+			return rateLimitError(wait).Err()
+		}
+		return nil
+	}
+}
+
+// grpcRateLimit charges the call of ctx to its client.
+func (g *Gateway) grpcRateLimit(ctx context.Context, fullMethod string) error {
+	opts := g.rateLimitOptions()
+	if opts == nil || isHealthMethod(fullMethod) {
+		return nil
+	}
+	var remoteAddr string
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		remoteAddr = p.Addr.String()
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	header := func(key string) string {
+		if values := md.Get(key); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	client, rate, burst := g.clientLimit(opts, ctx, remoteAddr, header)
+	if wait, ok := g.limiter.take(client, rate, burst, opts.Cost(fullMethod), time.Now()); !ok {
+		// Honoured by gRPC clients with retries enabled.
+		grpc.SetTrailer(ctx, metadata.Pairs("grpc-retry-pushback-ms", fmt.Sprint(wait.Milliseconds())))
+		return rateLimitError(wait).Err()
+	}
+	return nil
+}
+
+func (g *Gateway) rateLimitUnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if err := g.grpcRateLimit(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (g *Gateway) rateLimitStreamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := g.grpcRateLimit(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
@@ -0,0 +1,182 @@
+package gateway_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/decentrio/gateway/config"
+	"github.com/decentrio/gateway/gateway"
+)
+
+func TestRateLimitOverHTTP(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	gw := startGateway(t, &config.Config{
+		Upstream: []config.Node{{API: upstream.URL, Blocks: []uint64{1, 0}}},
+		RateLimit: config.RateLimitOptions{
+			Enabled:        true,
+			Rate:           0.01,
+			Burst:          3,
+			Costs:          map[string]float64{"/cosmos/tx/v1beta1/*": 3},
+			ClientIPHeader: "X-Forwarded-For",
+			TrustedProxies: 2,
+		},
+	}, listenOn(t, "api"))
+	server := &gw.API_Server
+
+	// Requests reach the gateway through two proxies, the outer one adding the
+	// client's address and the inner one 192.0.2.1.
+	get := func(path, client string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://127.0.0.1:%d%s", server.Port, path), nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Forwarded-For", client+", 192.0.2.1")
+		var res *http.Response
+		require.Eventually(t, func() bool {
+			res, err = http.DefaultClient.Do(req)
+			return err == nil
+		}, 5*time.Second, 10*time.Millisecond)
+		t.Cleanup(func() { res.Body.Close() })
+		return res
+	}
+
+	require.Equal(t, http.StatusOK, get("/cosmos/tx/v1beta1/txs", "198.51.100.1").StatusCode)
+
+	res := get("/cosmos/base/tendermint/v1beta1/blocks/latest", "198.51.100.1")
+	require.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+	require.Equal(t, "100", res.Header.Get("Retry-After"))
+	var body struct {
+		Code codes.Code `json:"code"`
+	}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+	require.Equal(t, codes.ResourceExhausted, body.Code)
+
+	// Addresses the client adds itself are left of those of the proxies.
+	res = get("/cosmos/base/tendermint/v1beta1/blocks/latest", "198.51.100.2, 198.51.100.1")
+	require.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+
+	require.Equal(t, http.StatusOK, get("/cosmos/base/tendermint/v1beta1/blocks/latest", "198.51.100.2").StatusCode, "clients have their own buckets")
+}
+
+func TestRateLimitPerAPIKeyOverJSONRPC(t *testing.T) {
+	auth := testAuth()
+	auth.Keys[0].Rate, auth.Keys[0].Burst = 0.01, 2
+	gw := startGateway(t, &config.Config{
+		Auth:      auth,
+		RateLimit: config.RateLimitOptions{Enabled: true, Rate: 0.01, Burst: 1},
+	}, listenOn(t, "jsonrpc"))
+	server := &gw.JSON_RPC_Server
+
+	post := func(body string) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://127.0.0.1:%d", server.Port), bytes.NewReader([]byte(body)))
+		require.NoError(t, err)
+		req.Header.Set("X-API-Key", "alice-key")
+		var res *http.Response
+		require.Eventually(t, func() bool {
+			res, err = http.DefaultClient.Do(req)
+			return err == nil
+		}, 5*time.Second, 10*time.Millisecond)
+		t.Cleanup(func() { res.Body.Close() })
+		return res
+	}
+
+	// The key's burst of 2 replaces the default one; a batch costs its calls.
+	res := post(`[{"jsonrpc":"2.0","id":1,"method":"eth_chainId"},{"jsonrpc":"2.0","id":2,"method":"eth_chainId"}]`)
+	require.NotEqual(t, http.StatusTooManyRequests, res.StatusCode)
+
+	res = post(`{"jsonrpc":"2.0","id":3,"method":"eth_chainId"}`)
+	require.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+	require.NotEmpty(t, res.Header.Get("Retry-After"))
+	var body gateway.JSONRPCResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+	require.NotNil(t, body.Error)
+	require.Equal(t, -32005, body.Error.Code)
+}
+
+func TestOversizeJSONRPCBody(t *testing.T) {
+	gw := startGateway(t, &config.Config{
+		RateLimit: config.RateLimitOptions{Enabled: true, Rate: 100},
+	}, listenOn(t, "jsonrpc"))
+
+	body := fmt.Sprintf(`{"jsonrpc":"2.0","id":1,"method":"eth_chainId","params":["%s"]}`, bytes.Repeat([]byte("a"), 10<<20))
+	res, err := http.Post(fmt.Sprintf("http://127.0.0.1:%d", gw.JSON_RPC_Server.Port), "application/json", bytes.NewReader([]byte(body)))
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode)
+}
+
+func TestRateLimitOverWebSocket(t *testing.T) {
+	gwURL := startWSGatewayWithConfig(t, &config.Config{
+		Upstream: wsUpstream(newFakeWSNode(t, newFakeChain(t))),
+		RateLimit: config.RateLimitOptions{
+			Enabled:        true,
+			Rate:           0.01,
+			Burst:          1,
+			ClientIPHeader: "X-Real-IP",
+		},
+	})
+
+	client, _, err := websocket.DefaultDialer.Dial(gwURL, http.Header{"X-Real-IP": {"198.51.100.3"}})
+	require.NoError(t, err)
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var reply gateway.JSONRPCResponse
+	require.NoError(t, client.WriteJSON(map[string]any{"jsonrpc": "2.0", "id": 1, "method": "eth_blockNumber", "params": []any{}}))
+	require.NoError(t, client.ReadJSON(&reply))
+	require.Nil(t, reply.Error)
+
+	require.NoError(t, client.WriteJSON(map[string]any{"jsonrpc": "2.0", "id": 2, "method": "eth_blockNumber", "params": []any{}}))
+	require.NoError(t, client.ReadJSON(&reply))
+	require.NotNil(t, reply.Error)
+	require.Equal(t, -32005, reply.Error.Code)
+}
+
+func TestRateLimitOverGRPC(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := grpc.NewServer(grpc.UnknownServiceHandler(func(_ any, stream grpc.ServerStream) error {
+		if method, _ := grpc.Method(stream.Context()); method != "/gateway.test.Query/Block" {
+			return status.Error(codes.Unimplemented, "reflection is not served")
+		}
+		if err := stream.RecvMsg(&emptypb.Empty{}); err != nil {
+			return err
+		}
+		return stream.SendMsg(&emptypb.Empty{})
+	}))
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn := startGRPCGateway(t, &config.Config{
+		Upstream:  []config.Node{{GRPC: lis.Addr().String(), Blocks: []uint64{1, 0}}},
+		RateLimit: config.RateLimitOptions{Enabled: true, Rate: 0.01, Burst: 1},
+	})
+	call := func() error {
+		return conn.Invoke(context.Background(), "/gateway.test.Query/Block", &emptypb.Empty{}, &emptypb.Empty{})
+	}
+
+	require.NoError(t, call())
+	st := status.Convert(call())
+	require.Equal(t, codes.ResourceExhausted, st.Code())
+	require.Len(t, st.Details(), 1)
+	retry, ok := st.Details()[0].(*errdetails.RetryInfo)
+	require.True(t, ok)
+	require.Greater(t, retry.RetryDelay.AsDuration(), time.Duration(0))
+}
@@ -4,29 +4,29 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"fmt"
 	"io"
 	"net/http"
 	"strconv"
-	"sync/atomic"
 	"time"
 
 	"github.com/cometbft/cometbft/rpc/jsonrpc/types"
 	"github.com/decentrio/gateway/config"
-	httpUtils "github.com/decentrio/gateway/utils"
+	"github.com/decentrio/gateway/logging"
 )
 
-var (
-	rpcServers            = make(map[uint16]*http.Server)
-	activeRPCRequestCount int32
-)
+func (server *Server) startRPC() error {
+	g := server.gw
+	g.log.Info("Starting RPC server")
 
-func Start_RPC_Server(server *Server) {
-	fmt.Printf("Starting RPC server on port %d\n", server.Port)
+	// Relayed WebSocket connections are closed when the server shuts down.
+	closing, closeWebSockets := context.WithCancel(context.Background())
 
 	mux := http.NewServeMux()
+	mux.HandleFunc("/websocket", func(w http.ResponseWriter, r *http.Request) {
+		server.handleRPCWebSocket(w, r, closing)
+	})
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Printf("Received RPC query: %s, method: %s\n", r.URL.Path, r.Method)
+		g.log.DebugContext(r.Context(), "Received RPC query", "path", r.URL.Path, "method", r.Method)
 		switch r.Method {
 		case "GET":
 			server.handleRPCRequest(w, r)
@@ -39,74 +39,27 @@ func Start_RPC_Server(server *Server) {
 	)
 
 	srv := &http.Server{
-		Addr:    fmt.Sprintf(":%d", server.Port),
-		Handler: mux,
-	}
-
-	mu.Lock()
-	rpcServers[server.Port] = srv
-	mu.Unlock()
-
-	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		fmt.Printf("Failed to start RPC server: %v\n", err)
+		Handler: g.instrumentHTTP("rpc", g.withProbes(g.withMiddleware(g.requireAPIKey("rpc", rejectRPC, g.filterMethods("rpc", rejectRPC, g.rateLimit("rpc", rejectRPC, mux)))))),
 	}
-}
-
-func Shutdown_RPC_Server(server *Server) {
-	mu.Lock()
-	srv, exists := rpcServers[server.Port]
-	if !exists {
-		mu.Unlock()
-		return
-	}
-	delete(rpcServers, server.Port)
-	mu.Unlock()
-
-	fmt.Printf("Waiting for %d active requests to complete before shutting down RPC server...\n", atomic.LoadInt32(&activeRPCRequestCount))
-
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
 
-	done := make(chan struct{})
-	go func() {
-		wg.Wait()
-		close(done)
-	}()
-
-	select {
-	case <-done:
-		fmt.Println("All active requests completed. Proceeding with shutdown...")
-	case <-ctx.Done():
-		fmt.Println("[WARNING] Timeout waiting for requests. Forcing shutdown...")
-	}
+	srv.RegisterOnShutdown(closeWebSockets)
 
-	if err := srv.Shutdown(ctx); err != nil {
-		fmt.Printf("Error shutting down RPC server: %v\n", err)
-	} else {
-		fmt.Println("RPC server stopped.")
-	}
+	return server.startHTTP(srv, g.cfg.Get().TLS.RPC)
 }
 
 func (server *Server) handleRPCRequest(w http.ResponseWriter, r *http.Request) {
+	g := server.gw
 	ctx, cancel := context.WithTimeout(r.Context(), 1*time.Second)
 	defer cancel()
 
-	select {
-	case semaphore <- struct{}{}:
-		defer func() { <-semaphore }()
-	case <-ctx.Done():
+	if !g.acquireSemaphore(ctx) {
 		http.Error(w, "Server busy, please try again later", http.StatusTooManyRequests)
 		return
 	}
-	atomic.AddInt32(&activeRPCRequestCount, 1)
-	wg.Add(1)
+	defer func() { <-g.semaphore }()
+	server.requests.begin()
+	defer server.requests.end()
 
-	defer func() {
-		wg.Done()
-		atomic.AddInt32(&activeRPCRequestCount, -1)
-	}()
-
-	fmt.Printf("Received RPC query: %s\n", r.URL.Path)
 	var node *config.Node
 
 	switch r.URL.Path {
@@ -126,16 +79,13 @@ func (server *Server) handleRPCRequest(w http.ResponseWriter, r *http.Request) {
 		"/subscribe",
 		"/unsubscribe",
 		"/unsubscribe_all",
-		"/websocket",
 		"/":
-		node = config.GetNodebyHeight(0)
+		node = g.routeByHeight(r.Context(), 0)
 		if node == nil {
 			http.Error(w, "Node not found", http.StatusNotFound)
 			return
-		} else {
-			fmt.Println("Node called:", node.RPC)
 		}
-		httpUtils.FowardRequest(w, r, node.RPC)
+		g.http.FowardRequest(w, r, node.RPC)
 		return
 
 	case "/abci_query",
@@ -152,27 +102,22 @@ func (server *Server) handleRPCRequest(w http.ResponseWriter, r *http.Request) {
 				http.Error(w, "Invalid height", http.StatusBadRequest)
 				return
 			}
-			node = config.GetNodebyHeight(h)
+			node = g.routeByHeight(r.Context(), h)
 			if node == nil {
 				http.Error(w, "Node not found", http.StatusNotFound)
 				return
-			} else {
-				fmt.Println("Node called:", node.RPC)
 			}
 		} else {
-			node = config.GetNodebyHeight(0)
+			node = g.routeByHeight(r.Context(), 0)
 			if node == nil {
 				http.Error(w, "Node not found", http.StatusNotFound)
 				return
-			} else {
-				fmt.Println("Node called:", node.RPC)
 			}
 		}
 
-		httpUtils.FowardRequest(w, r, node.RPC)
+		g.http.FowardRequest(w, r, node.RPC)
 		return
 	case "/blockchain":
-		fmt.Print(r.URL.Query())
 		var height string
 		if r.URL.Query().Has("maxheight") {
 			height = r.URL.Query().Get("maxheight")
@@ -182,21 +127,18 @@ func (server *Server) handleRPCRequest(w http.ResponseWriter, r *http.Request) {
 			height = "0"
 		}
 
-		fmt.Println("height" + height)
 		h, err := strconv.ParseUint(height, 10, 64)
 		if err != nil {
 			http.Error(w, "Invalid height", http.StatusBadRequest)
 			return
 		}
-		node = config.GetNodebyHeight(h)
+		node = g.routeByHeight(r.Context(), h)
 		if node == nil {
 			http.Error(w, "Node not found", http.StatusNotFound)
 			return
-		} else {
-			fmt.Println("Node called:", node.RPC)
 		}
 
-		httpUtils.FowardRequest(w, r, node.RPC)
+		g.http.FowardRequest(w, r, node.RPC)
 		return
 
 	case "/block_by_hash",
@@ -205,10 +147,12 @@ func (server *Server) handleRPCRequest(w http.ResponseWriter, r *http.Request) {
 		"/header_by_hash",
 		"/tx",
 		"/tx_search":
-		RPC_nodes := config.GetNodesByType("rpc")
+		RPC_nodes := g.cfg.Get().NodesByType("rpc")
+		fanoutCtx, fanout := startFanout(r.Context(), len(RPC_nodes))
+		defer fanout.End()
 		var msg string = "" // msg to return to client
 		for _, url := range RPC_nodes {
-			res, err := httpUtils.CheckRequest(r, url)
+			res, err := g.http.CheckRequest(r.WithContext(fanoutCtx), url)
 			if err != nil {
 				continue
 			}
@@ -218,7 +162,7 @@ func (server *Server) handleRPCRequest(w http.ResponseWriter, r *http.Request) {
 			}
 			if res.StatusCode == http.StatusOK {
 				// node returned a 200 response
-				fmt.Println("Node called:", url)
+				logging.SetUpstream(r.Context(), upstreamHost(url))
 
 				for key, values := range res.Header {
 					for _, value := range values {
@@ -234,7 +178,7 @@ func (server *Server) handleRPCRequest(w http.ResponseWriter, r *http.Request) {
 				}
 				break
 			} else {
-				fmt.Println("Node called:", url)
+				logging.SetUpstream(r.Context(), upstreamHost(url))
 
 				body, err := io.ReadAll(res.Body)
 				res.Body.Close()
@@ -258,16 +202,17 @@ func (server *Server) handleRPCRequest(w http.ResponseWriter, r *http.Request) {
 }
 
 func (server *Server) handleJSONRPCRequest(w http.ResponseWriter, r *http.Request) {
+	g := server.gw
 	ctx, cancel := context.WithTimeout(r.Context(), 60*time.Second)
 	defer cancel()
 
-	select {
-	case semaphore <- struct{}{}:
-		defer func() { <-semaphore }()
-	case <-ctx.Done():
+	if !g.acquireSemaphore(ctx) {
 		http.Error(w, "Server busy, please try again later", http.StatusTooManyRequests)
 		return
 	}
+	defer func() { <-g.semaphore }()
+	server.requests.begin()
+	defer server.requests.end()
 
 	var req = types.RPCRequest{}
 	var res = types.RPCResponse{}
@@ -289,8 +234,6 @@ func (server *Server) handleJSONRPCRequest(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	fmt.Printf("Method: %s, Params: %s\n", req.Method, req.Params)
-
 	var params map[string]interface{}
 	err = json.Unmarshal(req.Params, &params)
 	if err != nil {
@@ -298,7 +241,6 @@ func (server *Server) handleJSONRPCRequest(w http.ResponseWriter, r *http.Reques
 		json.NewEncoder(w).Encode(res)
 		return
 	}
-	fmt.Println(params)
 
 	if height, found := params["height"].(string); found {
 		// handle requests that have height parameter
@@ -312,17 +254,15 @@ func (server *Server) handleJSONRPCRequest(w http.ResponseWriter, r *http.Reques
 			return
 		}
 
-		fmt.Printf("Height: %d\n", h)
-
-		node := config.GetNodebyHeight(h)
+		node := g.routeByHeight(r.Context(), h)
 		if node == nil {
 			res = types.RPCMethodNotFoundError(req.ID)
 			json.NewEncoder(w).Encode(res)
 			return
 		}
-		fmt.Println("Node called:", node.RPC)
+		g.log.DebugContext(r.Context(), "Node called", "upstream", node.RPC)
 		r.ContentLength = int64(len(body))
-		httpUtils.FowardRequest(w, r, node.RPC)
+		g.http.FowardRequest(w, r, node.RPC)
 		return
 	} else {
 		switch req.Method {
@@ -345,15 +285,15 @@ func (server *Server) handleJSONRPCRequest(w http.ResponseWriter, r *http.Reques
 			"unsubscribe",
 			"unsubscribe_all":
 			// cases that should return latest node
-			node := config.GetNodebyHeight(0)
+			node := g.routeByHeight(r.Context(), 0)
 			if node == nil {
 				res = types.RPCMethodNotFoundError(req.ID)
 				json.NewEncoder(w).Encode(res)
 				return
 			}
-			fmt.Println("Node called:", node.RPC)
+			g.log.DebugContext(r.Context(), "Node called", "upstream", node.RPC)
 			r.ContentLength = int64(len(body))
-			httpUtils.FowardRequest(w, r, node.RPC)
+			g.http.FowardRequest(w, r, node.RPC)
 			return
 		case "block_by_hash",
 			"block_search",
@@ -361,7 +301,9 @@ func (server *Server) handleJSONRPCRequest(w http.ResponseWriter, r *http.Reques
 			"header_by_hash",
 			"tx",
 			"tx_search":
-			RPC_nodes := config.GetNodesByType("rpc")
+			RPC_nodes := g.cfg.Get().NodesByType("rpc")
+			fanoutCtx, fanout := startFanout(r.Context(), len(RPC_nodes))
+			defer fanout.End()
 
 			bodyBytes, err := io.ReadAll(r.Body)
 			if err != nil {
@@ -372,15 +314,15 @@ func (server *Server) handleJSONRPCRequest(w http.ResponseWriter, r *http.Reques
 
 			var msg string = "" // msg to return to client
 			for _, url := range RPC_nodes {
-				new_r := r.Clone(r.Context())
+				new_r := r.Clone(fanoutCtx)
 				new_r.Body = io.NopCloser(bytes.NewReader(bodyBytes))
-				res, err := httpUtils.CheckRequest(new_r, url)
+				res, err := g.http.CheckRequest(new_r, url)
 				if err != nil || res == nil {
 					continue
 				}
 
 				if res.StatusCode == http.StatusOK {
-					fmt.Println("Node called:", url)
+					logging.SetUpstream(r.Context(), upstreamHost(url))
 
 					for key, values := range res.Header {
 						for _, value := range values {
@@ -396,7 +338,7 @@ func (server *Server) handleJSONRPCRequest(w http.ResponseWriter, r *http.Reques
 					}
 					break
 				} else if res.StatusCode == http.StatusInternalServerError {
-					fmt.Println("Node called:", url)
+					logging.SetUpstream(r.Context(), upstreamHost(url))
 
 					body, err := io.ReadAll(res.Body)
 					res.Body.Close()
@@ -426,21 +368,19 @@ func (server *Server) handleJSONRPCRequest(w http.ResponseWriter, r *http.Reques
 					return
 				}
 
-				fmt.Printf("Height: %d\n", h)
-
-				node := config.GetNodebyHeight(h)
+				node := g.routeByHeight(r.Context(), h)
 				if node == nil {
 					res = types.RPCMethodNotFoundError(req.ID)
 					json.NewEncoder(w).Encode(res)
 					return
 				}
-				fmt.Println("Node called:", node.RPC)
+				g.log.DebugContext(r.Context(), "Node called", "upstream", node.RPC)
 				r.ContentLength = int64(len(body))
-				httpUtils.FowardRequest(w, r, node.RPC)
+				g.http.FowardRequest(w, r, node.RPC)
 				return
 			}
 		default:
-			fmt.Println("Invalid method:", req.Method)
+			g.log.DebugContext(r.Context(), "Invalid method", "method", req.Method)
 			res = types.RPCInvalidRequestError(req.ID, types.RPCError{})
 			json.NewEncoder(w).Encode(res)
 			return
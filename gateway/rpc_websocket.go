@@ -0,0 +1,164 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc/status"
+
+	"github.com/decentrio/gateway/config"
+)
+
+// handleRPCWebSocket relays a CometBFT WebSocket connection to a node serving
+// the latest blocks. The gateway ends the connection itself, so that every
+// call sent on it is checked against the method rules and charged to the
+// rate limit of the client, as RPC requests over HTTP are. Connections are
+// closed once closing is done.
+func (server *Server) handleRPCWebSocket(w http.ResponseWriter, r *http.Request, closing context.Context) {
+	g := server.gw
+	node := g.routeByHeight(r.Context(), 0)
+	if node == nil {
+		http.Error(w, "Node not found", http.StatusNotFound)
+		return
+	}
+	upstream, err := g.dialRPCWebSocket(r.Context(), node)
+	if err != nil {
+		g.log.WarnContext(r.Context(), "Failed to connect to RPC WebSocket", "upstream", upstreamHost(node.RPC), "err", err)
+		http.Error(w, "Upstream error", http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		g.log.WarnContext(r.Context(), "WebSocket upgrade failed", "err", err)
+		return
+	}
+	defer conn.Close()
+	server.requests.begin()
+	defer server.requests.end()
+
+	// Replies and rejections are written from two goroutines.
+	var writeMu sync.Mutex
+	stop := context.AfterFunc(closing, func() {
+		writeMu.Lock()
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"), time.Now().Add(wsCloseWait))
+		writeMu.Unlock()
+		conn.Close()
+	})
+	defer stop()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer conn.Close()
+		for {
+			messageType, message, err := upstream.ReadMessage()
+			if err != nil {
+				return
+			}
+			writeMu.Lock()
+			err = conn.WriteMessage(messageType, message)
+			writeMu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	limit := g.wsRateLimiter(r)
+	for {
+		messageType, message, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		if st := g.checkRPCWebSocketCall(message, limit); st != nil {
+			var req JSONRPCRequest
+			if json.Unmarshal(message, &req) != nil || req.ID == nil {
+				req.ID = cloneRawMessage(nullJSONRPCID)
+			}
+			writeMu.Lock()
+			err = conn.WriteJSON(JSONRPCResponse{
+				JSONRPC: "2.0",
+				ID:      req.ID,
+				Error:   &JSONRPCError{Code: jsonRPCErrorCode(st), Message: st.Message()},
+			})
+			writeMu.Unlock()
+			if err != nil {
+				break
+			}
+			continue
+		}
+		if err := upstream.WriteMessage(messageType, message); err != nil {
+			break
+		}
+	}
+	upstream.Close()
+	<-done
+}
+
+// checkRPCWebSocketCall returns why a message sent on a CometBFT WebSocket
+// may not be forwarded, or nil when it may.
+func (g *Gateway) checkRPCWebSocketCall(message []byte, limit func(method string) error) *status.Status {
+	methods := jsonRPCMethods(message)
+	for _, method := range methods {
+		if err := g.checkMethod("rpc", method); err != nil {
+			return status.Convert(err)
+		}
+	}
+	if limit == nil {
+		return nil
+	}
+	for _, method := range methods {
+		if err := limit(method); err != nil {
+			return status.Convert(err)
+		}
+	}
+	return nil
+}
+
+// dialRPCWebSocket opens a WebSocket connection to the /websocket route of
+// the node's RPC endpoint, with the node's RPC TLS settings.
+func (g *Gateway) dialRPCWebSocket(ctx context.Context, node *config.Node) (*websocket.Conn, error) {
+	u, err := url.Parse(node.RPC)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rpc url %q: %w", node.RPC, err)
+	}
+	settings := node.TLS.RPC
+	switch {
+	case u.Scheme == "https" || settings.Enable:
+		u.Scheme = "wss"
+	case u.Scheme == "http":
+		u.Scheme = "ws"
+	default:
+		return nil, fmt.Errorf("invalid rpc url %q: unsupported scheme", node.RPC)
+	}
+	u = u.JoinPath("websocket")
+
+	dialer := wsDialer
+	if settings != (config.TLS{}) {
+		tlsConfig, err := settings.ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+		withTLS := *wsDialer
+		withTLS.TLSClientConfig = tlsConfig
+		dialer = &withTLS
+	}
+
+	call := g.health.Begin(u.Host)
+	conn, res, err := dialer.DialContext(ctx, u.String(), nil)
+	call.Done(err)
+	if err != nil {
+		if res != nil {
+			return nil, fmt.Errorf("%w (status %s)", err, res.Status)
+		}
+		return nil, err
+	}
+	return conn, nil
+}
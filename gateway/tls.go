@@ -0,0 +1,120 @@
+package gateway
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+
+	"github.com/decentrio/gateway/config"
+)
+
+// newServerTLSConfig builds the TLS config of a listener. The certificate and
+// client CAs are looked up on every handshake and reloaded when their files
+// change.
+func newServerTLSConfig(log *slog.Logger, settings *config.ListenerTLS) (*tls.Config, error) {
+	minVersion, err := settings.MinTLSVersion()
+	if err != nil {
+		return nil, err
+	}
+	reloader := &certReloader{settings: *settings, log: log}
+	if _, _, err := reloader.current(); err != nil {
+		return nil, err
+	}
+
+	base := &tls.Config{
+		MinVersion: minVersion,
+		NextProtos: []string{"h2", "http/1.1"},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, _, err := reloader.current()
+			return cert, err
+		},
+	}
+	if settings.ClientCAFile != "" {
+		base.ClientAuth = tls.RequireAndVerifyClientCert
+		base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			_, clientCAs, err := reloader.current()
+			if err != nil {
+				return nil, err
+			}
+			c := base.Clone()
+			c.GetConfigForClient = nil
+			c.ClientCAs = clientCAs
+			return c, nil
+		}
+	}
+	return base, nil
+}
+
+// certReloader keeps the certificate and client CAs of a listener, loading
+// them again whenever one of their files is modified. If the new files cannot
+// be loaded, e.g. in the middle of a rotation, the previous ones stay in use.
+type certReloader struct {
+	settings config.ListenerTLS
+	log      *slog.Logger
+
+	mu        sync.Mutex
+	stamp     string
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+func (r *certReloader) current() (*tls.Certificate, *x509.CertPool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stamp := fileStamp(r.settings.CertFile, r.settings.KeyFile, r.settings.ClientCAFile)
+	if r.cert != nil && stamp == r.stamp {
+		return r.cert, r.clientCAs, nil
+	}
+
+	cert, clientCAs, err := r.load()
+	if err != nil {
+		if r.cert != nil {
+			r.log.Error("Failed to reload TLS certificate, keeping the previous one", "cert", r.settings.CertFile, "err", err)
+			return r.cert, r.clientCAs, nil
+		}
+		return nil, nil, err
+	}
+	if r.cert != nil {
+		r.log.Info("Reloaded TLS certificate", "cert", r.settings.CertFile)
+	}
+	r.stamp, r.cert, r.clientCAs = stamp, cert, clientCAs
+	return cert, clientCAs, nil
+}
+
+func (r *certReloader) load() (*tls.Certificate, *x509.CertPool, error) {
+	cert, err := tls.LoadX509KeyPair(r.settings.CertFile, r.settings.KeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	if r.settings.ClientCAFile == "" {
+		return &cert, nil, nil
+	}
+	pem, err := os.ReadFile(r.settings.ClientCAFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read client_ca_file: %w", err)
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(pem) {
+		return nil, nil, fmt.Errorf("no certificates found in client_ca_file %s", r.settings.ClientCAFile)
+	}
+	return &cert, clientCAs, nil
+}
+
+// fileStamp identifies the current version of files by size and modification
+// time.
+func fileStamp(files ...string) string {
+	var stamp string
+	for _, file := range files {
+		if file == "" {
+			continue
+		}
+		if info, err := os.Stat(file); err == nil {
+			stamp += fmt.Sprintf("%s:%d:%d;", file, info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	return stamp
+}
@@ -0,0 +1,145 @@
+package gateway_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/decentrio/gateway/config"
+)
+
+func startTLSAPIGateway(t *testing.T, settings *config.ListenerTLS) string {
+	upstream := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	})}
+	upstreamPort := freePort(t)
+	upstream.Addr = fmt.Sprintf("127.0.0.1:%d", upstreamPort)
+	go upstream.ListenAndServe()
+	t.Cleanup(func() { upstream.Close() })
+
+	gw := startGateway(t, &config.Config{
+		Upstream: []config.Node{{API: "http://" + upstream.Addr, Blocks: []uint64{1, 0}}},
+		TLS:      config.ServerTLS{API: settings},
+	}, listenOn(t, "api"))
+	server := &gw.API_Server
+	return fmt.Sprintf("127.0.0.1:%d", server.Port)
+}
+
+// tlsGet fetches the latest block from the gateway at addr on a new
+// connection and returns the certificate it was served with.
+func tlsGet(addr string, clientConfig *tls.Config) (*x509.Certificate, error) {
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig, DisableKeepAlives: true}}
+	res, err := client.Get("https://" + addr + "/cosmos/base/tendermint/v1beta1/blocks/latest")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return res.TLS.PeerCertificates[0], nil
+}
+
+func TestListenerTLSReloadsRotatedCertificates(t *testing.T) {
+	certFile, keyFile, cert := writeTestCertificate(t)
+	addr := startTLSAPIGateway(t, &config.ListenerTLS{CertFile: certFile, KeyFile: keyFile, MinVersion: "1.3"})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+	var served *x509.Certificate
+	require.Eventually(t, func() bool {
+		var err error
+		served, err = tlsGet(addr, &tls.Config{RootCAs: roots})
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, cert.Leaf.Raw, served.Raw)
+
+	_, err := tlsGet(addr, &tls.Config{RootCAs: roots, MaxVersion: tls.VersionTLS12})
+	require.Error(t, err, "connections below min_version are refused")
+
+	// Rotate the files in place; new connections get the new certificate.
+	newCertFile, newKeyFile, newCert := writeTestCertificate(t)
+	for src, dst := range map[string]string{newKeyFile: keyFile, newCertFile: certFile} {
+		data, err := os.ReadFile(src)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(dst, data, 0o600))
+	}
+	roots.AddCert(newCert.Leaf)
+	served, err = tlsGet(addr, &tls.Config{RootCAs: roots})
+	require.NoError(t, err)
+	require.Equal(t, newCert.Leaf.Raw, served.Raw)
+
+	// A half-written rotation keeps the current certificate in use.
+	require.NoError(t, os.WriteFile(certFile, []byte("not a certificate"), 0o600))
+	served, err = tlsGet(addr, &tls.Config{RootCAs: roots})
+	require.NoError(t, err)
+	require.Equal(t, newCert.Leaf.Raw, served.Raw)
+}
+
+func TestListenerTLSClientCertificates(t *testing.T) {
+	certFile, keyFile, cert := writeTestCertificate(t)
+	_, _, other := writeTestCertificate(t)
+	addr := startTLSAPIGateway(t, &config.ListenerTLS{CertFile: certFile, KeyFile: keyFile, ClientCAFile: certFile})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+	require.Eventually(t, func() bool {
+		_, err := tlsGet(addr, &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{cert}})
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	_, err := tlsGet(addr, &tls.Config{RootCAs: roots})
+	require.Error(t, err, "clients without a certificate are refused")
+	_, err = tlsGet(addr, &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{other}})
+	require.Error(t, err, "clients with an untrusted certificate are refused")
+}
+
+func TestGRPCListenerTLS(t *testing.T) {
+	certFile, keyFile, cert := writeTestCertificate(t)
+	gw := startGateway(t, &config.Config{
+		Upstream: []config.Node{{GRPC: startFakeGRPCNode(t, "pruned"), Blocks: []uint64{100}}},
+		TLS:      config.ServerTLS{GRPC: &config.ListenerTLS{CertFile: certFile, KeyFile: keyFile}},
+	}, listenOn(t, "grpc"))
+	server := &gw.GRPC_Server
+	addr := fmt.Sprintf("127.0.0.1:%d", server.Port)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{RootCAs: roots})))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	var header metadata.MD
+	err = conn.Invoke(context.Background(), "/gateway.test.Query/Block", &emptypb.Empty{}, &emptypb.Empty{}, grpc.Header(&header))
+	require.NoError(t, err)
+	require.Equal(t, []string{"pruned"}, header.Get("x-node"))
+
+	// gRPC-Web over HTTP/1.1 and HTTP/2 share the TLS port with native gRPC.
+	for _, h2 := range []bool{false, true} {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}, ForceAttemptHTTP2: h2}}
+		res, err := client.Post("https://"+addr+"/gateway.test.Query/Block", "application/grpc-web+proto", bytes.NewReader([]byte{0, 0, 0, 0, 0}))
+		require.NoError(t, err)
+		res.Body.Close()
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Equal(t, "pruned", res.Header.Get("x-node"))
+		if h2 {
+			require.Equal(t, 2, res.ProtoMajor)
+		} else {
+			require.Equal(t, 1, res.ProtoMajor)
+		}
+	}
+}
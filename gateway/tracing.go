@@ -0,0 +1,77 @@
+package gateway
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/decentrio/gateway/config"
+	"github.com/decentrio/gateway/logging"
+	"github.com/decentrio/gateway/metrics"
+	"github.com/decentrio/gateway/tracing"
+)
+
+// startServerSpan starts the span of a request to the server of protocol,
+// named once its method is known.
+func startServerSpan(ctx context.Context, protocol string, req *logging.Request, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	opts = append(opts, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		attribute.String("gateway.server", protocol),
+		attribute.String("gateway.request_id", req.ID),
+		attribute.String("client.address", req.Client),
+	))
+	return tracing.Start(ctx, protocol, opts...)
+}
+
+// acquireSemaphore takes a slot of the request semaphore, giving up once ctx
+// is done. The time spent waiting is traced as a span of its own.
+func (g *Gateway) acquireSemaphore(ctx context.Context) bool {
+	_, span := tracing.Start(ctx, "semaphore")
+	defer span.End()
+
+	select {
+	case g.semaphore <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		span.SetStatus(codes.Error, "server busy")
+		return false
+	}
+}
+
+// routeByHeight returns the node serving height to the request of ctx, or nil
+// if there is none. Nodes whose breaker is open for the server's protocol are
+// passed over, unless no other node holds the height.
+func (g *Gateway) routeByHeight(ctx context.Context, height uint64) *config.Node {
+	_, span := tracing.Start(ctx, "route", trace.WithAttributes(attribute.Int64("gateway.height", int64(height))))
+	defer span.End()
+
+	logging.SetHeight(ctx, height)
+	node := g.availableNode(metrics.Server(ctx), g.router.Route(g.cfg.Get(), height))
+	if node == nil {
+		span.SetStatus(codes.Error, "no node for height")
+		return nil
+	}
+	span.SetAttributes(attribute.String("gateway.range", node.HeightRange()))
+	return node
+}
+
+// availableNode returns the first of nodes whose endpoint for protocol has
+// its breaker closed, or else the first of nodes.
+func (g *Gateway) availableNode(protocol string, nodes []*config.Node) *config.Node {
+	for _, node := range nodes {
+		if g.health.Available(endpointAddr(protocol, node.Endpoint(protocol))) {
+			return node
+		}
+	}
+	if len(nodes) > 0 {
+		return nodes[0]
+	}
+	return nil
+}
+
+// startFanout starts the span of a call sent to several upstreams, whose
+// attempts are its children.
+func startFanout(ctx context.Context, upstreams int) (context.Context, trace.Span) {
+	return tracing.Start(ctx, "fanout", trace.WithAttributes(attribute.Int("gateway.upstreams", upstreams)))
+}
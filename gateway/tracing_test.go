@@ -0,0 +1,172 @@
+package gateway_test
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	tmservice "github.com/cosmos/cosmos-sdk/client/grpc/tmservice"
+	"github.com/stretchr/testify/require"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/decentrio/gateway/config"
+	"github.com/decentrio/gateway/tracing"
+)
+
+const (
+	clientTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	clientSpanID  = "00f067aa0ba902b7"
+	clientParent  = "00-" + clientTraceID + "-" + clientSpanID + "-01"
+)
+
+// fakeCollector stands in for an OTLP collector, keeping the spans exported
+// to it.
+type fakeCollector struct {
+	collectortrace.UnimplementedTraceServiceServer
+
+	mu    sync.Mutex
+	spans []*tracepb.Span
+}
+
+func (c *fakeCollector) Export(_ context.Context, req *collectortrace.ExportTraceServiceRequest) (*collectortrace.ExportTraceServiceResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+	return &collectortrace.ExportTraceServiceResponse{}, nil
+}
+
+func (c *fakeCollector) named(name string) []*tracepb.Span {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var spans []*tracepb.Span
+	for _, span := range c.spans {
+		if span.Name == name {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+// startTracing exports the gateway's traces to a fake collector. The returned
+// function flushes them.
+func startTracing(t *testing.T) (*fakeCollector, func()) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	collector := &fakeCollector{}
+	srv := grpc.NewServer()
+	collectortrace.RegisterTraceServiceServer(srv, collector)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	shutdown, err := tracing.Setup(config.TracingOptions{Enabled: true, Endpoint: lis.Addr().String(), Insecure: true})
+	require.NoError(t, err)
+	t.Cleanup(func() { tracing.Setup(config.TracingOptions{}) })
+	return collector, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		require.NoError(t, shutdown(ctx))
+	}
+}
+
+func TestTracingOverHTTP(t *testing.T) {
+	forwarded := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded <- r.Header.Get("traceparent")
+		w.Write([]byte(`{"pool":{}}`))
+	}))
+	defer upstream.Close()
+
+	collector, flush := startTracing(t)
+	gw := startGateway(t, &config.Config{
+		Upstream: []config.Node{{API: upstream.URL, Blocks: []uint64{1, 0}}},
+	}, listenOn(t, "api"))
+	api := &gw.API_Server
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://127.0.0.1:%d/cosmos/staking/v1beta1/pool", api.Port), nil)
+	require.NoError(t, err)
+	req.Header.Set("traceparent", clientParent)
+	req.Header.Set("x-cosmos-block-height", "5")
+	var res *http.Response
+	require.Eventually(t, func() bool {
+		res, err = http.DefaultClient.Do(req)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	sent := strings.Split(<-forwarded, "-")
+	require.Len(t, sent, 4)
+	flush()
+
+	servers := collector.named("api /cosmos/staking/v1beta1/pool")
+	require.Len(t, servers, 1)
+	server := servers[0]
+	require.Equal(t, tracepb.Span_SPAN_KIND_SERVER, server.Kind)
+	require.Equal(t, clientTraceID, hex.EncodeToString(server.TraceId))
+	require.Equal(t, clientSpanID, hex.EncodeToString(server.ParentSpanId))
+
+	for _, name := range []string{"semaphore", "route", "upstream"} {
+		spans := collector.named(name)
+		require.Len(t, spans, 1, name)
+		require.Equal(t, server.SpanId, spans[0].ParentSpanId, name)
+	}
+	// The upstream carries on the trace from the span of the call made to it.
+	upstreamSpan := collector.named("upstream")[0]
+	require.Equal(t, tracepb.Span_SPAN_KIND_CLIENT, upstreamSpan.Kind)
+	require.Equal(t, clientTraceID, sent[1])
+	require.Equal(t, hex.EncodeToString(upstreamSpan.SpanId), sent[2])
+}
+
+type traceTmNode struct {
+	tmservice.UnimplementedServiceServer
+	traceparent chan string
+}
+
+func (n *traceTmNode) GetBlockByHeight(ctx context.Context, _ *tmservice.GetBlockByHeightRequest) (*tmservice.GetBlockByHeightResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	n.traceparent <- strings.Join(md.Get("traceparent"), ",")
+	return &tmservice.GetBlockByHeightResponse{}, nil
+}
+
+func TestTracingOverGRPC(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	node := &traceTmNode{traceparent: make(chan string, 1)}
+	srv := grpc.NewServer()
+	tmservice.RegisterServiceServer(srv, node)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	collector, flush := startTracing(t)
+	client := tmservice.NewServiceClient(startGRPCGateway(t, &config.Config{Upstream: []config.Node{
+		{GRPC: lis.Addr().String(), Blocks: []uint64{1, 0}},
+	}}))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "traceparent", clientParent)
+	_, err = client.GetBlockByHeight(ctx, &tmservice.GetBlockByHeightRequest{Height: 7})
+	require.NoError(t, err)
+	sent := strings.Split(<-node.traceparent, "-")
+	require.Len(t, sent, 4)
+	require.Equal(t, clientTraceID, sent[1])
+	flush()
+
+	servers := collector.named("cosmos.base.tendermint.v1beta1.Service/GetBlockByHeight")
+	require.Len(t, servers, 1)
+	require.Equal(t, tracepb.Span_SPAN_KIND_SERVER, servers[0].Kind)
+	require.Equal(t, clientTraceID, hex.EncodeToString(servers[0].TraceId))
+	require.Equal(t, clientSpanID, hex.EncodeToString(servers[0].ParentSpanId))
+	require.NotEmpty(t, collector.named("route"))
+}
@@ -0,0 +1,171 @@
+package gateway
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/decentrio/gateway/config"
+)
+
+const (
+	wsPoolMaxConnsPerNode = 4
+	// A new connection is only opened once every existing one to the node has
+	// this many calls in flight.
+	wsPoolMaxCallsPerConn = 64
+	wsPoolIdleTimeout     = 5 * time.Minute
+	wsPoolReapInterval    = time.Minute
+)
+
+// wsConnPool keeps warm WebSocket connections to every upstream node. Client
+// requests are multiplexed over them with rewritten ids, so a request costs no
+// handshake once a connection to its node is open.
+type wsConnPool struct {
+	gw *Gateway
+
+	mu      sync.Mutex
+	conns   map[string][]*wsMuxConn  // node JSONRPC_WS url -> connections
+	dialing map[string]chan struct{} // node JSONRPC_WS url -> dial in progress
+}
+
+func newWSConnPool(g *Gateway) *wsConnPool {
+	return &wsConnPool{
+		gw:      g,
+		conns:   make(map[string][]*wsMuxConn),
+		dialing: make(map[string]chan struct{}),
+	}
+}
+
+// get returns the least busy connection to node, dialing a new one when
+// there is none or all of them are saturated. Only one dial per node is in
+// progress at a time, concurrent callers wait for its outcome.
+func (p *wsConnPool) get(node *config.Node) (*wsMuxConn, error) {
+	wsURL := node.JSONRPC_WS
+	for {
+		p.mu.Lock()
+		var best *wsMuxConn
+		for _, c := range p.conns[wsURL] {
+			if best == nil || c.inFlight() < best.inFlight() {
+				best = c
+			}
+		}
+		canDial := len(p.conns[wsURL]) < wsPoolMaxConnsPerNode
+		if best != nil && (best.inFlight() < wsPoolMaxCallsPerConn || !canDial) {
+			p.mu.Unlock()
+			return best, nil
+		}
+		if dialing, ok := p.dialing[wsURL]; ok {
+			p.mu.Unlock()
+			<-dialing
+			if best != nil {
+				return best, nil
+			}
+			p.mu.Lock()
+			dialed := len(p.conns[wsURL]) > 0
+			p.mu.Unlock()
+			if !dialed {
+				return nil, errors.New("websocket node unavailable")
+			}
+			continue
+		}
+		dialing := make(chan struct{})
+		p.dialing[wsURL] = dialing
+		p.mu.Unlock()
+
+		conn, err := p.gw.dialWSMuxConn(node, nil, p.remove)
+
+		p.mu.Lock()
+		delete(p.dialing, wsURL)
+		close(dialing)
+		if err == nil {
+			select {
+			case <-conn.done:
+				// Lost before it could be pooled, remove has already run.
+				err = errWSUpstreamClosed
+			default:
+				p.conns[wsURL] = append(p.conns[wsURL], conn)
+			}
+		}
+		p.mu.Unlock()
+
+		if err != nil {
+			if best != nil {
+				return best, nil
+			}
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// remove forgets a connection once it has been closed.
+func (p *wsConnPool) remove(conn *wsMuxConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	conns := p.conns[conn.url]
+	for i, c := range conns {
+		if c == conn {
+			p.conns[conn.url] = append(conns[:i:i], conns[i+1:]...)
+			break
+		}
+	}
+	if len(p.conns[conn.url]) == 0 {
+		delete(p.conns, conn.url)
+	}
+}
+
+// reapIdle closes connections that have not carried a call for a while, until
+// stop is closed. The connections kept are held open by the ping/pong
+// keepalive.
+func (p *wsConnPool) reapIdle(stop <-chan struct{}) {
+	ticker := time.NewTicker(wsPoolReapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		var idle []*wsMuxConn
+		p.mu.Lock()
+		for _, conns := range p.conns {
+			for _, c := range conns {
+				if c.inFlight() == 0 && time.Since(c.lastUsed()) > wsPoolIdleTimeout {
+					idle = append(idle, c)
+				}
+			}
+		}
+		p.mu.Unlock()
+
+		for _, c := range idle {
+			c.close()
+		}
+	}
+}
+
+// closeNode closes the connections to the node at wsURL, failing the calls
+// still waiting on them.
+func (p *wsConnPool) closeNode(wsURL string) {
+	p.mu.Lock()
+	conns := append([]*wsMuxConn(nil), p.conns[wsURL]...)
+	p.mu.Unlock()
+
+	for _, c := range conns {
+		c.close()
+	}
+}
+
+func (p *wsConnPool) closeAll() {
+	p.mu.Lock()
+	var all []*wsMuxConn
+	for _, conns := range p.conns {
+		all = append(all, conns...)
+	}
+	p.mu.Unlock()
+
+	for _, c := range all {
+		c.close()
+	}
+}
@@ -0,0 +1,376 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/decentrio/gateway/config"
+	"github.com/decentrio/gateway/logging"
+	"github.com/decentrio/gateway/metrics"
+)
+
+const (
+	wsWriteWait      = 10 * time.Second
+	wsPongWait       = 60 * time.Second
+	wsPingPeriod     = 30 * time.Second
+	wsSendBufferSize = 256
+	wsRequestTimeout = 60 * time.Second
+	// wsCloseWait is how long a client is given to answer the close frame
+	// sent on shutdown before its connection is closed.
+	wsCloseWait = time.Second
+
+	// wsMaxInFlightRequests bounds how many requests of one connection are
+	// handled at the same time.
+	wsMaxInFlightRequests = 32
+)
+
+var errWSSessionClosed = errors.New("websocket session closed")
+
+var wsDialer = &websocket.Dialer{
+	Proxy:            http.ProxyFromEnvironment,
+	HandshakeTimeout: 10 * time.Second,
+}
+
+// wsDialerFor returns the dialer to reach the node's WebSocket endpoint with.
+func (g *Gateway) wsDialerFor(node *config.Node) (*websocket.Dialer, error) {
+	settings := node.TLS.JSONRPC_WS
+	if settings == (config.TLS{}) {
+		return wsDialer, nil
+	}
+	if d, ok := g.wsTLSDialers.Load(node.JSONRPC_WS); ok {
+		return d.(*websocket.Dialer), nil
+	}
+	tlsConfig, err := settings.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	dialer := *wsDialer
+	dialer.TLSClientConfig = tlsConfig
+	d, _ := g.wsTLSDialers.LoadOrStore(node.JSONRPC_WS, &dialer)
+	return d.(*websocket.Dialer), nil
+}
+
+// wsSession is a single client WebSocket connection. Every message going back
+// to the client goes through send so that there is only one writer on conn.
+type wsSession struct {
+	gw   *Gateway
+	conn *websocket.Conn
+	send chan []byte
+	done chan struct{}
+	once sync.Once
+
+	slots    chan struct{}
+	inflight inflight
+
+	// goAway is closed when the server shuts down, once the requests being
+	// handled are answered; draining stops new requests meanwhile.
+	goAway     chan struct{}
+	goAwayOnce sync.Once
+	draining   atomic.Bool
+
+	// ctx is cancelled when the session closes, abandoning its upstream calls.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// client is the address the session was opened from.
+	client string
+
+	// remote is the trace context the client opened the session in, which
+	// the span of every message links to.
+	remote trace.SpanContext
+
+	// limit charges a call to the client's rate limit; nil when unlimited.
+	limit func(method string) error
+
+	mu   sync.Mutex
+	subs map[string]struct{} // gateway subscription ids held in the hub
+}
+
+func newWSSession(g *Gateway, conn *websocket.Conn) *wsSession {
+	ctx, cancel := context.WithCancel(metrics.WithServer(context.Background(), "jsonrpc_ws"))
+	return &wsSession{
+		gw:     g,
+		conn:   conn,
+		send:   make(chan []byte, wsSendBufferSize),
+		done:   make(chan struct{}),
+		slots:  make(chan struct{}, wsMaxInFlightRequests),
+		goAway: make(chan struct{}),
+		ctx:    ctx,
+		cancel: cancel,
+		subs:   make(map[string]struct{}),
+	}
+}
+
+// writePump is the only goroutine writing to the client connection.
+func (s *wsSession) writePump() {
+	for {
+		select {
+		case msg := <-s.send:
+			if !s.writeMessage(msg) {
+				return
+			}
+		case <-s.goAway:
+			// Replies queued before the close frame go out first.
+			for len(s.send) > 0 {
+				if !s.writeMessage(<-s.send) {
+					return
+				}
+			}
+			closing := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+			s.conn.WriteControl(websocket.CloseMessage, closing, time.Now().Add(wsWriteWait))
+			select {
+			case <-s.done:
+			case <-time.After(wsCloseWait):
+				s.close()
+			}
+			return
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *wsSession) writeMessage(msg []byte) bool {
+	s.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	if err := s.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+		s.gw.log.Debug("Error sending message to WebSocket client", "err", err)
+		s.close()
+		return false
+	}
+	return true
+}
+
+// shutdown ends the session as its server shuts down: the requests being
+// handled are answered, until ctx is done, and the client is then sent a
+// going away close frame.
+func (s *wsSession) shutdown(ctx context.Context) {
+	s.draining.Store(true)
+	s.inflight.wait(ctx)
+	s.goAwayOnce.Do(func() { close(s.goAway) })
+	select {
+	case <-s.done:
+	case <-ctx.Done():
+		s.close()
+	}
+}
+
+// dispatch runs handle on its own goroutine once one of the connection's
+// request slots is free. It reports false if the session closed while waiting.
+func (s *wsSession) dispatch(handle func()) bool {
+	select {
+	case s.slots <- struct{}{}:
+	case <-s.done:
+		return false
+	}
+
+	s.inflight.begin()
+	go func() {
+		defer func() {
+			<-s.slots
+			s.inflight.end()
+		}()
+		handle()
+	}()
+	return true
+}
+
+// wait blocks until every dispatched request has been handled.
+func (s *wsSession) wait() {
+	s.inflight.wait(context.Background())
+}
+
+// write queues msg for the client. A client that does not keep up with its
+// messages is disconnected rather than allowed to block the upstreams.
+func (s *wsSession) write(msg []byte) error {
+	select {
+	case <-s.done:
+		return errWSSessionClosed
+	default:
+	}
+
+	select {
+	case s.send <- msg:
+		return nil
+	case <-s.done:
+		return errWSSessionClosed
+	default:
+		s.gw.log.Warn("WebSocket client is too slow, closing session", "client", s.client)
+		s.close()
+		return errWSSessionClosed
+	}
+}
+
+func (s *wsSession) writeJSON(v any) error {
+	msg, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.write(msg)
+}
+
+// wsReplyBytesKey holds the *atomic.Int64 counting the bytes answered to a
+// client request, for its access log line.
+type wsReplyBytesKey struct{}
+
+// reply answers the request of ctx with v.
+func (s *wsSession) reply(ctx context.Context, v any) error {
+	msg, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if sent, ok := ctx.Value(wsReplyBytesKey{}).(*atomic.Int64); ok {
+		sent.Add(int64(len(msg)))
+	}
+	return s.write(msg)
+}
+
+// replyError answers the request of ctx, with id, with a JSON-RPC error
+// object.
+func (s *wsSession) replyError(ctx context.Context, id json.RawMessage, code int, message string) error {
+	return s.reply(ctx, JSONRPCResponse{
+		JSONRPC: "2.0",
+		Error:   &JSONRPCError{Code: code, Message: message},
+		ID:      ensureResponseID(id),
+	})
+}
+
+// close tears down the client connection, its pending upstream calls and its
+// share of the hub's subscriptions.
+func (s *wsSession) close() {
+	s.once.Do(func() {
+		close(s.done)
+		s.cancel()
+		s.conn.Close()
+
+		s.mu.Lock()
+		subs := s.subs
+		s.subs = make(map[string]struct{})
+		s.mu.Unlock()
+
+		for id := range subs {
+			s.gw.wsHub.unsubscribe(s, id)
+		}
+	})
+}
+
+// forward sends req to node over a pooled connection and relays the reply
+// to the client under the client's own id.
+func (s *wsSession) forward(ctx context.Context, node *config.Node, req JSONRPCRequest) error {
+	wsURL := node.JSONRPC_WS
+	logging.SetUpstream(ctx, upstreamHost(wsURL))
+	conn, err := s.gw.wsPool.get(node)
+	if err != nil {
+		s.gw.log.ErrorContext(ctx, "Failed to connect to jsonRPC WebSocket", "upstream", upstreamHost(wsURL), "err", err)
+		return s.replyError(ctx, req.ID, jsonRPCUpstreamError, "Failed to connect to jsonRPC WebSocket")
+	}
+
+	callCtx, cancel := context.WithTimeout(ctx, wsRequestTimeout)
+	defer cancel()
+
+	s.gw.metrics.ObserveRoute("jsonrpc_ws", node.HeightRange(), upstreamHost(wsURL))
+	reply, err := conn.call(callCtx, req.Method, req.Params, nil)
+	if err != nil {
+		s.gw.log.WarnContext(ctx, "Error forwarding message to node", "upstream", upstreamHost(wsURL), "err", err)
+		return s.replyError(ctx, req.ID, jsonRPCUpstreamError, "Failed to forward request to node")
+	}
+	return s.reply(ctx, upstreamResponse(req.ID, reply))
+}
+
+// subscribe joins the hub subscription for req and answers with the
+// gateway-side subscription id.
+func (s *wsSession) subscribe(ctx context.Context, req JSONRPCRequest) error {
+	id, err := s.gw.wsHub.subscribe(s, req.Params)
+	if err != nil {
+		return err
+	}
+	// The id is queued before any notification carrying it.
+	err = s.reply(ctx, JSONRPCResponse{JSONRPC: "2.0", ID: ensureResponseID(req.ID), Result: id})
+	s.gw.wsHub.joined(id)
+	return err
+}
+
+// unsubscribe leaves a hub subscription. Unknown ids are answered with false,
+// as a node would.
+func (s *wsSession) unsubscribe(ctx context.Context, req JSONRPCRequest) error {
+	var params []string
+	if err := json.Unmarshal(req.Params, &params); err != nil || len(params) == 0 {
+		return s.replyError(ctx, req.ID, jsonRPCInvalidParams, "Invalid params: expected a subscription id")
+	}
+
+	ok := s.gw.wsHub.unsubscribe(s, params[0])
+	return s.reply(ctx, JSONRPCResponse{JSONRPC: "2.0", ID: ensureResponseID(req.ID), Result: ok})
+}
+
+// addSubscription records a hub subscription owned by the session. It reports
+// false if the session has already been closed.
+func (s *wsSession) addSubscription(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.done:
+		return false
+	default:
+	}
+	s.subs[id] = struct{}{}
+	return true
+}
+
+func (s *wsSession) removeSubscription(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.subs, id)
+}
+
+// dialWebSocketNode opens a WebSocket connection to the node's JSONRPC_WS
+// endpoint exactly as configured: scheme, path and query are kept, wss
+// endpoints get their certificate verified according to the node's TLS settings
+// and the configured headers are sent with the handshake. http(s) URLs are
+// accepted as aliases for ws(s), and ws URLs are upgraded to wss when TLS is
+// enabled for the endpoint.
+func (g *Gateway) dialWebSocketNode(node *config.Node) (*websocket.Conn, error) {
+	u, err := url.Parse(node.JSONRPC_WS)
+	if err != nil {
+		return nil, fmt.Errorf("invalid jsonrpc_ws url %q: %w", node.JSONRPC_WS, err)
+	}
+	switch u.Scheme {
+	case "ws", "wss":
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	default:
+		return nil, fmt.Errorf("invalid jsonrpc_ws url %q: unsupported scheme", node.JSONRPC_WS)
+	}
+	if node.TLS.JSONRPC_WS.Enable {
+		u.Scheme = "wss"
+	}
+	dialer, err := g.wsDialerFor(node)
+	if err != nil {
+		return nil, err
+	}
+
+	header := http.Header{}
+	for key, value := range node.JSONRPC_WS_Headers {
+		header.Set(key, value)
+	}
+
+	conn, res, err := dialer.Dial(u.String(), header)
+	if err != nil {
+		if res != nil {
+			return nil, fmt.Errorf("%w (status %s)", err, res.Status)
+		}
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,725 @@
+package gateway
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/decentrio/gateway/config"
+	"github.com/decentrio/gateway/metrics"
+)
+
+const (
+	wsSubscribeTimeout  = 10 * time.Second
+	wsBackfillTimeout   = 30 * time.Second
+	wsMaxBackfillBlocks = 128
+	wsMaxFailoverDelay  = 30 * time.Second
+)
+
+// wsSubscriptionHub deduplicates identical eth_subscribe calls from every
+// client onto a single upstream subscription and fans its notifications out.
+type wsSubscriptionHub struct {
+	gw *Gateway
+
+	mu         sync.Mutex
+	upstreams  map[string]*wsMuxConn                      // node JSONRPC_WS url -> shared connection
+	byKey      map[string]*wsSharedSubscription           // subscription params -> subscription
+	byID       map[string]*wsSharedSubscription           // gateway subscription id -> subscription
+	byUpstream map[wsUpstreamSubKey]*wsSharedSubscription // upstream subscription -> subscription
+	dialing    map[string]chan struct{}                   // node JSONRPC_WS url -> dial in progress
+}
+
+type wsUpstreamSubKey struct {
+	conn *wsMuxConn
+	id   string
+}
+
+// wsLogKey identifies a log, which a block may hold many of.
+type wsLogKey struct {
+	blockHash string
+	logIndex  string
+}
+
+// wsSharedSubscription is one upstream subscription and the clients listening
+// to it, each under its own gateway-side subscription id.
+type wsSharedSubscription struct {
+	key    string
+	topic  string
+	params json.RawMessage
+
+	node       *config.Node
+	upstream   *wsMuxConn
+	upstreamID string
+	ready      chan struct{}
+	err        error
+
+	// lastBlock is the highest block delivered to clients. While the
+	// subscription is being moved to another node, notifications are queued
+	// until the blocks missed in between have been backfilled.
+	lastBlock   uint64
+	backfilling bool
+	queued      []json.RawMessage
+	// lastLogs holds the logs of lastBlock delivered so far, as the rest of
+	// the block may still be missing when the subscription is moved.
+	lastLogs map[wsLogKey]struct{}
+
+	clients map[string]*wsSession // gateway subscription id -> client
+	// joining holds the clients not yet sent their subscription id, which
+	// get no notifications until then.
+	joining map[string]struct{}
+}
+
+func newWSSubscriptionHub(g *Gateway) *wsSubscriptionHub {
+	return &wsSubscriptionHub{
+		gw:         g,
+		upstreams:  make(map[string]*wsMuxConn),
+		byKey:      make(map[string]*wsSharedSubscription),
+		byID:       make(map[string]*wsSharedSubscription),
+		byUpstream: make(map[wsUpstreamSubKey]*wsSharedSubscription),
+		dialing:    make(map[string]chan struct{}),
+	}
+}
+
+// subscriptionKey identifies identical subscriptions. Params are re-encoded so
+// that whitespace and object key order do not matter.
+func subscriptionKey(params json.RawMessage) (key string, topic string, err error) {
+	var decoded []any
+	if err := json.Unmarshal(params, &decoded); err != nil {
+		return "", "", err
+	}
+	if len(decoded) == 0 {
+		return "", "", errors.New("missing subscription type")
+	}
+	topic, ok := decoded[0].(string)
+	if !ok {
+		return "", "", errors.New("invalid subscription type")
+	}
+	encoded, err := json.Marshal(decoded)
+	if err != nil {
+		return "", "", err
+	}
+	return string(encoded), topic, nil
+}
+
+func newSubscriptionID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return "0x" + hex.EncodeToString(b)
+}
+
+// subscribe registers session for the subscription described by params and
+// returns the gateway-side subscription id. Notifications are held back from
+// the session until joined is called, once the id has been sent to it.
+func (h *wsSubscriptionHub) subscribe(session *wsSession, params json.RawMessage) (string, error) {
+	key, topic, err := subscriptionKey(params)
+	if err != nil {
+		return "", err
+	}
+
+	id := newSubscriptionID()
+
+	h.mu.Lock()
+	sub, existing := h.byKey[key]
+	if !existing {
+		sub = &wsSharedSubscription{
+			key:     key,
+			topic:   topic,
+			params:  json.RawMessage(key),
+			ready:   make(chan struct{}),
+			clients: make(map[string]*wsSession),
+			joining: make(map[string]struct{}),
+		}
+		h.byKey[key] = sub
+	}
+	sub.clients[id] = session
+	sub.joining[id] = struct{}{}
+	h.byID[id] = sub
+	h.mu.Unlock()
+
+	if !existing {
+		sub.err = h.subscribeFirst(sub)
+		if sub.err != nil {
+			h.mu.Lock()
+			if h.byKey[key] == sub {
+				delete(h.byKey, key)
+			}
+			for clientID := range sub.clients {
+				delete(h.byID, clientID)
+			}
+			h.mu.Unlock()
+		}
+		close(sub.ready)
+	}
+
+	<-sub.ready
+	if sub.err != nil {
+		return "", sub.err
+	}
+
+	if !session.addSubscription(id) {
+		// The client went away while the subscription was being set up.
+		h.unsubscribe(session, id)
+		return "", errWSSessionClosed
+	}
+	return id, nil
+}
+
+// joined starts the notifications of the client subscription id.
+func (h *wsSubscriptionHub) joined(id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if sub, ok := h.byID[id]; ok {
+		delete(sub.joining, id)
+	}
+}
+
+// nodes returns the latest nodes with a WebSocket endpoint, in routing order.
+func (h *wsSubscriptionHub) nodes() []*config.Node {
+	var nodes []*config.Node
+	for _, node := range h.gw.router.Route(h.gw.cfg.Get(), 0) {
+		if node.JSONRPC_WS != "" {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// subscribeFirst creates the upstream subscription on the first node that
+// accepts it and records the current head as the starting point for backfills.
+func (h *wsSubscriptionHub) subscribeFirst(sub *wsSharedSubscription) error {
+	nodes := h.nodes()
+	if len(nodes) == 0 {
+		return errors.New("no node available for subscriptions")
+	}
+
+	var err error
+	for _, node := range nodes {
+		var conn *wsMuxConn
+		conn, err = h.subscribeOn(sub, node)
+		if err != nil {
+			h.gw.log.Warn("Failed to subscribe", "topic", sub.topic, "upstream", upstreamHost(node.JSONRPC_WS), "err", err)
+			continue
+		}
+
+		if tracksBlocks(sub.topic) {
+			ctx, cancel := context.WithTimeout(context.Background(), wsSubscribeTimeout)
+			reply, callErr := conn.call(ctx, "eth_blockNumber", nil, nil)
+			cancel()
+			if callErr == nil {
+				if head, ok := parseHexUint(reply.Result); ok {
+					h.mu.Lock()
+					if head > sub.lastBlock {
+						sub.lastBlock = head
+					}
+					h.mu.Unlock()
+				}
+			}
+		}
+		return nil
+	}
+	return err
+}
+
+// subscribeOn creates the upstream subscription for sub on node.
+func (h *wsSubscriptionHub) subscribeOn(sub *wsSharedSubscription, node *config.Node) (*wsMuxConn, error) {
+	conn, err := h.upstream(node)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), wsSubscribeTimeout)
+	defer cancel()
+
+	var upstreamID string
+	reply, err := conn.call(ctx, "eth_subscribe", sub.params, func(m *wsUpstreamMessage) {
+		if err := json.Unmarshal(m.Result, &upstreamID); err != nil || upstreamID == "" {
+			return
+		}
+		h.mu.Lock()
+		sub.node = node
+		sub.upstream = conn
+		sub.upstreamID = upstreamID
+		h.byUpstream[wsUpstreamSubKey{conn, upstreamID}] = sub
+		h.mu.Unlock()
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(reply.Error) > 0 {
+		return nil, fmt.Errorf("upstream rejected subscription: %s", reply.Error)
+	}
+	if upstreamID == "" {
+		return nil, errors.New("upstream returned no subscription id")
+	}
+	return conn, nil
+}
+
+// upstream returns the hub's shared connection to node, dialing it on first use.
+// The dial runs outside the lock, concurrent callers wait for its outcome.
+func (h *wsSubscriptionHub) upstream(node *config.Node) (*wsMuxConn, error) {
+	wsURL := node.JSONRPC_WS
+	for {
+		h.mu.Lock()
+		if conn, ok := h.upstreams[wsURL]; ok {
+			h.mu.Unlock()
+			return conn, nil
+		}
+		if dialing, ok := h.dialing[wsURL]; ok {
+			h.mu.Unlock()
+			<-dialing
+			h.mu.Lock()
+			_, dialed := h.upstreams[wsURL]
+			h.mu.Unlock()
+			if !dialed {
+				return nil, errors.New("websocket node unavailable")
+			}
+			continue
+		}
+		dialing := make(chan struct{})
+		h.dialing[wsURL] = dialing
+		h.mu.Unlock()
+
+		conn, err := h.gw.dialWSMuxConn(node, h.notify, h.upstreamClosed)
+
+		h.mu.Lock()
+		delete(h.dialing, wsURL)
+		close(dialing)
+		if err == nil {
+			select {
+			case <-conn.done:
+				// Lost before it could be stored, upstreamClosed has already run.
+				err = errWSUpstreamClosed
+			default:
+				h.upstreams[wsURL] = conn
+			}
+		}
+		h.mu.Unlock()
+
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// notify fans a notification out to every client of the subscription, each
+// with its own subscription id.
+func (h *wsSubscriptionHub) notify(conn *wsMuxConn, n *wsNotificationParams) {
+	h.mu.Lock()
+	sub, ok := h.byUpstream[wsUpstreamSubKey{conn, n.Subscription}]
+	if !ok {
+		h.mu.Unlock()
+		return
+	}
+	if sub.backfilling {
+		sub.queued = append(sub.queued, n.Result)
+		h.mu.Unlock()
+		return
+	}
+	h.mu.Unlock()
+
+	h.deliver(sub, n.Result)
+}
+
+func (h *wsSubscriptionHub) deliver(sub *wsSharedSubscription, result json.RawMessage) {
+	h.mu.Lock()
+	block, ok := notificationBlock(sub.topic, result)
+	if ok && block > sub.lastBlock {
+		sub.lastBlock = block
+		clear(sub.lastLogs)
+		if sub.topic == "newHeads" {
+			h.gw.metrics.ObserveTip(upstreamHost(sub.node.JSONRPC_WS), block)
+			h.gw.health.ObserveTip(upstreamHost(sub.node.JSONRPC_WS), block)
+		}
+	}
+	if key, isLog := logKey(sub.topic, result); isLog && ok && block == sub.lastBlock {
+		if sub.lastLogs == nil {
+			sub.lastLogs = make(map[wsLogKey]struct{})
+		}
+		sub.lastLogs[key] = struct{}{}
+	}
+	clients := make(map[string]*wsSession, len(sub.clients))
+	for id, session := range sub.clients {
+		if _, joining := sub.joining[id]; !joining {
+			clients[id] = session
+		}
+	}
+	h.mu.Unlock()
+
+	for id, session := range clients {
+		session.writeJSON(wsNotification{
+			JSONRPC: "2.0",
+			Method:  "eth_subscription",
+			Params:  wsNotificationParams{Subscription: id, Result: result},
+		})
+	}
+}
+
+// unsubscribe removes a client's subscription. The upstream subscription is
+// dropped once its last client is gone, and with it the upstream connection
+// if nothing else uses it.
+func (h *wsSubscriptionHub) unsubscribe(session *wsSession, id string) bool {
+	h.mu.Lock()
+	sub, ok := h.byID[id]
+	if !ok || sub.clients[id] != session {
+		h.mu.Unlock()
+		return false
+	}
+	delete(h.byID, id)
+	delete(sub.clients, id)
+	delete(sub.joining, id)
+
+	last := len(sub.clients) == 0
+	if last {
+		if h.byKey[sub.key] == sub {
+			delete(h.byKey, sub.key)
+		}
+		delete(h.byUpstream, wsUpstreamSubKey{sub.upstream, sub.upstreamID})
+	}
+	conn, upstreamID := sub.upstream, sub.upstreamID
+	h.mu.Unlock()
+
+	session.removeSubscription(id)
+
+	if last && conn != nil {
+		go h.dropUpstream(conn, upstreamID)
+	}
+	return true
+}
+
+// dropUpstream cancels the upstream subscription upstreamID, then closes conn
+// once no subscription uses it. Subscriptions being set up or moved may be
+// about to, so the connection is kept while there are any.
+func (h *wsSubscriptionHub) dropUpstream(conn *wsMuxConn, upstreamID string) {
+	h.unsubscribeUpstream(conn, upstreamID)
+
+	h.mu.Lock()
+	for _, sub := range h.byKey {
+		if sub.upstream == conn || sub.upstream == nil {
+			h.mu.Unlock()
+			return
+		}
+	}
+	if h.upstreams[conn.url] == conn {
+		delete(h.upstreams, conn.url)
+	}
+	h.mu.Unlock()
+	conn.close()
+}
+
+func (h *wsSubscriptionHub) unsubscribeUpstream(conn *wsMuxConn, upstreamID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), wsSubscribeTimeout)
+	defer cancel()
+	params, _ := json.Marshal([]string{upstreamID})
+	if _, err := conn.call(ctx, "eth_unsubscribe", params, nil); err != nil {
+		h.gw.log.Warn("Failed to unsubscribe", "subscription", upstreamID, "upstream", upstreamHost(conn.url), "err", err)
+	}
+}
+
+// upstreamClosed forgets a lost upstream connection and moves the
+// subscriptions that lived on it to another node.
+func (h *wsSubscriptionHub) upstreamClosed(conn *wsMuxConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.upstreams[conn.url] == conn {
+		delete(h.upstreams, conn.url)
+	}
+	for _, sub := range h.byKey {
+		if sub.upstream != conn {
+			continue
+		}
+		delete(h.byUpstream, wsUpstreamSubKey{sub.upstream, sub.upstreamID})
+		sub.upstream = nil
+		sub.upstreamID = ""
+		sub.backfilling = true
+		go h.failover(sub, conn.url)
+	}
+}
+
+// closeUpstream closes the hub's connection to the node at wsURL, if any,
+// which moves its subscriptions to other nodes.
+func (h *wsSubscriptionHub) closeUpstream(wsURL string) {
+	h.mu.Lock()
+	conn, ok := h.upstreams[wsURL]
+	h.mu.Unlock()
+	if ok {
+		conn.close()
+	}
+}
+
+// closeAll closes the hub's upstream connections when the gateway shuts down.
+// The subscriptions are forgotten first, so that they are not moved to other
+// nodes as their connections go.
+func (h *wsSubscriptionHub) closeAll() {
+	h.mu.Lock()
+	clear(h.byKey)
+	clear(h.byID)
+	clear(h.byUpstream)
+	conns := make([]*wsMuxConn, 0, len(h.upstreams))
+	for _, conn := range h.upstreams {
+		conns = append(conns, conn)
+	}
+	clear(h.upstreams)
+	h.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.close()
+	}
+}
+
+// active reports whether sub still has clients.
+func (h *wsSubscriptionHub) active(sub *wsSharedSubscription) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.byKey[sub.key] == sub
+}
+
+// failover re-creates sub on a healthy node, keeping every client's
+// subscription id, and fills in the blocks missed during the switch. It gives
+// up once the gateway shuts down.
+func (h *wsSubscriptionHub) failover(sub *wsSharedSubscription, lostURL string) {
+	h.gw.stopMu.Lock()
+	stop := h.gw.stop
+	h.gw.stopMu.Unlock()
+
+	delay := time.Second
+	for h.active(sub) {
+		// Try the lost node last, it may come back by itself.
+		var nodes, lost []*config.Node
+		for _, node := range h.nodes() {
+			if node.JSONRPC_WS == lostURL {
+				lost = append(lost, node)
+			} else {
+				nodes = append(nodes, node)
+			}
+		}
+		nodes = append(nodes, lost...)
+
+		for _, node := range nodes {
+			conn, err := h.subscribeOn(sub, node)
+			if err != nil {
+				h.gw.log.Warn("Failed to move subscription", "topic", sub.topic, "upstream", upstreamHost(node.JSONRPC_WS), "err", err)
+				continue
+			}
+			h.gw.log.Info("Subscription moved", "topic", sub.topic, "from", upstreamHost(lostURL), "to", upstreamHost(node.JSONRPC_WS))
+
+			if !h.active(sub) {
+				// Every client left while the subscription was being moved.
+				h.mu.Lock()
+				delete(h.byUpstream, wsUpstreamSubKey{sub.upstream, sub.upstreamID})
+				upstreamID := sub.upstreamID
+				h.mu.Unlock()
+				h.dropUpstream(conn, upstreamID)
+				return
+			}
+
+			h.backfill(sub, node)
+			h.flush(sub)
+			return
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, wsMaxFailoverDelay)
+	}
+}
+
+// backfill delivers the blocks or logs produced between the last delivered
+// block and the new node's head, fetched over HTTP JSON-RPC. Logs are fetched
+// from the last delivered block on, which may have been cut short.
+func (h *wsSubscriptionHub) backfill(sub *wsSharedSubscription, node *config.Node) {
+	h.mu.Lock()
+	from := sub.lastBlock
+	h.mu.Unlock()
+
+	if !tracksBlocks(sub.topic) || from == 0 || node.JSONRPC == "" {
+		return
+	}
+	if sub.topic == "newHeads" {
+		from++
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), wsBackfillTimeout)
+	defer cancel()
+
+	result, err := h.gw.callJSONRPC(ctx, node.JSONRPC, "eth_blockNumber", []any{})
+	if err != nil {
+		h.gw.log.Warn("Backfill failed", "topic", sub.topic, "upstream", upstreamHost(node.JSONRPC), "err", err)
+		return
+	}
+	head, ok := parseHexUint(result)
+	if !ok || head < from {
+		return
+	}
+	if head-from+1 > wsMaxBackfillBlocks {
+		h.gw.log.Warn("Backfill limited", "topic", sub.topic, "blocks", wsMaxBackfillBlocks)
+		from = head - wsMaxBackfillBlocks + 1
+	}
+
+	var missed []json.RawMessage
+	switch sub.topic {
+	case "newHeads":
+		for block := from; block <= head; block++ {
+			header, err := h.gw.callJSONRPC(ctx, node.JSONRPC, "eth_getBlockByNumber", []any{hexUint(block), false})
+			if err != nil {
+				h.gw.log.Warn("Backfill of block failed", "block", block, "upstream", upstreamHost(node.JSONRPC), "err", err)
+				return
+			}
+			missed = append(missed, header)
+		}
+	case "logs":
+		filter := map[string]any{}
+		var params []json.RawMessage
+		if err := json.Unmarshal(sub.params, &params); err == nil && len(params) > 1 {
+			json.Unmarshal(params[1], &filter)
+		}
+		filter["fromBlock"] = hexUint(from)
+		filter["toBlock"] = hexUint(head)
+
+		logs, err := h.gw.callJSONRPC(ctx, node.JSONRPC, "eth_getLogs", []any{filter})
+		if err != nil {
+			h.gw.log.Warn("Backfill of logs failed", "upstream", upstreamHost(node.JSONRPC), "err", err)
+			return
+		}
+		if err := json.Unmarshal(logs, &missed); err != nil {
+			h.gw.log.Warn("Backfill of logs failed", "upstream", upstreamHost(node.JSONRPC), "err", err)
+			return
+		}
+	}
+
+	for _, result := range missed {
+		if !h.delivered(sub, result) {
+			h.deliver(sub, result)
+		}
+	}
+}
+
+// flush delivers the notifications queued during a failover, skipping those
+// already delivered by the backfill.
+func (h *wsSubscriptionHub) flush(sub *wsSharedSubscription) {
+	for {
+		h.mu.Lock()
+		queued := sub.queued
+		sub.queued = nil
+		if len(queued) == 0 {
+			sub.backfilling = false
+			h.mu.Unlock()
+			return
+		}
+		h.mu.Unlock()
+
+		for _, result := range queued {
+			if !h.delivered(sub, result) {
+				h.deliver(sub, result)
+			}
+		}
+	}
+}
+
+// delivered reports whether a notification of sub has been delivered already.
+// Heads are told apart by their block number, logs by their block hash and
+// index, as a block holds many of them.
+func (h *wsSubscriptionHub) delivered(sub *wsSharedSubscription, result json.RawMessage) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	block, ok := notificationBlock(sub.topic, result)
+	if !ok {
+		return false
+	}
+	if key, isLog := logKey(sub.topic, result); isLog && block == sub.lastBlock {
+		_, seen := sub.lastLogs[key]
+		return seen
+	}
+	return block <= sub.lastBlock
+}
+
+// tracksBlocks reports whether notifications of topic carry a block number
+// that can be used to backfill gaps.
+func tracksBlocks(topic string) bool {
+	return topic == "newHeads" || topic == "logs"
+}
+
+func notificationBlock(topic string, result json.RawMessage) (uint64, bool) {
+	var fields struct {
+		Number      json.RawMessage `json:"number"`
+		BlockNumber json.RawMessage `json:"blockNumber"`
+	}
+	if err := json.Unmarshal(result, &fields); err != nil {
+		return 0, false
+	}
+	switch topic {
+	case "newHeads":
+		return parseHexUint(fields.Number)
+	case "logs":
+		return parseHexUint(fields.BlockNumber)
+	}
+	return 0, false
+}
+
+// logKey returns the key of a notification of the logs topic.
+func logKey(topic string, result json.RawMessage) (wsLogKey, bool) {
+	if topic != "logs" {
+		return wsLogKey{}, false
+	}
+	var fields struct {
+		BlockHash string `json:"blockHash"`
+		LogIndex  string `json:"logIndex"`
+	}
+	if err := json.Unmarshal(result, &fields); err != nil {
+		return wsLogKey{}, false
+	}
+	return wsLogKey{fields.BlockHash, fields.LogIndex}, true
+}
+
+func parseHexUint(raw json.RawMessage) (uint64, bool) {
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil || !strings.HasPrefix(value, "0x") {
+		return 0, false
+	}
+	parsed, err := strconv.ParseUint(strings.TrimPrefix(value, "0x"), 16, 64)
+	if err != nil {
+		return 0, false
+	}
+	return parsed, true
+}
+
+func hexUint(value uint64) string {
+	return "0x" + strconv.FormatUint(value, 16)
+}
+
+// callJSONRPC makes a single JSON-RPC call over HTTP and returns its result.
+func (g *Gateway) callJSONRPC(ctx context.Context, url string, method string, params any) (json.RawMessage, error) {
+	rawParams, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(JSONRPCRequest{JSONRPC: "2.0", ID: json.RawMessage("1"), Method: method, Params: rawParams})
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := g.http.PostJSON(metrics.WithServer(ctx, "jsonrpc_ws"), url, body)
+	if err != nil {
+		return nil, err
+	}
+
+	var reply wsUpstreamMessage
+	if err := json.Unmarshal(res, &reply); err != nil {
+		return nil, err
+	}
+	if len(reply.Error) > 0 {
+		return nil, fmt.Errorf("%s: %s", method, reply.Error)
+	}
+	return reply.Result, nil
+}
@@ -0,0 +1,287 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/decentrio/gateway/config"
+	"github.com/decentrio/gateway/tracing"
+)
+
+var errWSUpstreamClosed = errors.New("upstream websocket closed")
+
+// wsUpstreamMessage is anything an Ethereum node sends over WebSocket: a reply
+// to a call or an eth_subscription notification.
+type wsUpstreamMessage struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Method string          `json:"method,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  json.RawMessage `json:"error,omitempty"`
+}
+
+type wsNotification struct {
+	JSONRPC string               `json:"jsonrpc"`
+	Method  string               `json:"method"`
+	Params  wsNotificationParams `json:"params"`
+}
+
+type wsNotificationParams struct {
+	Subscription string          `json:"subscription"`
+	Result       json.RawMessage `json:"result"`
+}
+
+// upstreamResponse turns a node's reply into the response for the client
+// request with id.
+func upstreamResponse(id json.RawMessage, m *wsUpstreamMessage) JSONRPCResponse {
+	res := JSONRPCResponse{JSONRPC: "2.0", ID: ensureResponseID(id)}
+	if len(m.Error) > 0 {
+		var rpcErr JSONRPCError
+		if err := json.Unmarshal(m.Error, &rpcErr); err != nil {
+			rpcErr = JSONRPCError{Code: jsonRPCUpstreamError, Message: string(m.Error)}
+		}
+		res.Error = &rpcErr
+		return res
+	}
+	if len(m.Result) == 0 {
+		res.Result = json.RawMessage("null")
+	} else {
+		res.Result = m.Result
+	}
+	return res
+}
+
+type wsCall struct {
+	reply   chan *wsUpstreamMessage
+	onReply func(*wsUpstreamMessage)
+}
+
+// wsMuxConn is an upstream WebSocket connection shared by many callers. Calls
+// are sent with gateway-assigned ids so that replies can be matched back to
+// their caller, and notifications are handed to onNotify.
+type wsMuxConn struct {
+	gw   *Gateway
+	url  string
+	conn *websocket.Conn
+
+	writeMu  sync.Mutex
+	nextID   uint64
+	lastCall atomic.Int64 // unix nanoseconds
+
+	mu      sync.Mutex
+	pending map[uint64]*wsCall
+
+	onNotify func(c *wsMuxConn, n *wsNotificationParams)
+	onClose  func(c *wsMuxConn)
+
+	done chan struct{}
+	once sync.Once
+}
+
+func (g *Gateway) dialWSMuxConn(node *config.Node, onNotify func(*wsMuxConn, *wsNotificationParams), onClose func(*wsMuxConn)) (*wsMuxConn, error) {
+	conn, err := g.dialWebSocketNode(node)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &wsMuxConn{
+		gw:       g,
+		url:      node.JSONRPC_WS,
+		conn:     conn,
+		pending:  make(map[uint64]*wsCall),
+		onNotify: onNotify,
+		onClose:  onClose,
+		done:     make(chan struct{}),
+	}
+	c.lastCall.Store(time.Now().UnixNano())
+	go c.readPump()
+	go c.pingPump()
+	return c, nil
+}
+
+func (c *wsMuxConn) readPump() {
+	defer c.close()
+
+	// A node that stops answering pings is treated as lost.
+	c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		_, msg, err := c.conn.ReadMessage()
+		if err != nil {
+			select {
+			case <-c.done:
+			default:
+				c.gw.log.Warn("Upstream WebSocket closed", "upstream", upstreamHost(c.url), "err", err)
+			}
+			return
+		}
+
+		var m wsUpstreamMessage
+		if err := json.Unmarshal(msg, &m); err != nil {
+			c.gw.log.Warn("Invalid message from upstream WebSocket", "upstream", upstreamHost(c.url), "err", err)
+			continue
+		}
+
+		if m.Method == "eth_subscription" {
+			var params wsNotificationParams
+			if err := json.Unmarshal(m.Params, &params); err == nil && c.onNotify != nil {
+				c.onNotify(c, &params)
+			}
+			continue
+		}
+
+		var id uint64
+		if err := json.Unmarshal(m.ID, &id); err != nil {
+			continue
+		}
+		c.mu.Lock()
+		call, ok := c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+		if !ok {
+			continue
+		}
+		// onReply runs before the next message is read, so a subscription is
+		// registered before its first notification can arrive.
+		if call.onReply != nil {
+			call.onReply(&m)
+		}
+		call.reply <- &m
+	}
+}
+
+// call sends method to the node and waits for its reply. onReply, if set, runs
+// on the read pump as soon as the reply arrives.
+func (c *wsMuxConn) call(ctx context.Context, method string, params json.RawMessage, onReply func(*wsUpstreamMessage)) (reply *wsUpstreamMessage, err error) {
+	id := atomic.AddUint64(&c.nextID, 1)
+	c.lastCall.Store(time.Now().UnixNano())
+	if len(params) == 0 {
+		params = json.RawMessage("[]")
+	}
+	msg, err := json.Marshal(JSONRPCRequest{
+		JSONRPC: "2.0",
+		ID:      json.RawMessage(strconv.FormatUint(id, 10)),
+		Method:  method,
+		Params:  params,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	_, span := tracing.StartUpstream(ctx, upstreamHost(c.url), attribute.String("rpc.method", method))
+	upstream := c.gw.health.Begin(upstreamHost(c.url))
+	defer func() {
+		status := "ok"
+		if err != nil {
+			status = "error"
+		} else if len(reply.Error) > 0 {
+			status = "rpc_error"
+		}
+		c.gw.metrics.ObserveUpstream("jsonrpc_ws", upstreamHost(c.url), status, time.Since(start))
+		if errors.Is(err, context.Canceled) {
+			upstream.Done(nil)
+		} else {
+			upstream.Done(err)
+		}
+		span.SetAttributes(attribute.String("gateway.status", status))
+		tracing.End(span, err)
+	}()
+
+	call := &wsCall{reply: make(chan *wsUpstreamMessage, 1), onReply: onReply}
+	c.mu.Lock()
+	select {
+	case <-c.done:
+		c.mu.Unlock()
+		return nil, errWSUpstreamClosed
+	default:
+	}
+	c.pending[id] = call
+	c.mu.Unlock()
+
+	if err := c.write(msg); err != nil {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		c.close()
+		return nil, err
+	}
+
+	select {
+	case reply := <-call.reply:
+		return reply, nil
+	case <-c.done:
+		return nil, errWSUpstreamClosed
+	case <-ctx.Done():
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// inFlight returns the number of calls waiting for a reply.
+func (c *wsMuxConn) inFlight() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pending)
+}
+
+func (c *wsMuxConn) lastUsed() time.Time {
+	return time.Unix(0, c.lastCall.Load())
+}
+
+func (c *wsMuxConn) pingPump() {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.writeMu.Lock()
+			err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait))
+			c.writeMu.Unlock()
+			if err != nil {
+				c.close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *wsMuxConn) write(msg []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return c.conn.WriteMessage(websocket.TextMessage, msg)
+}
+
+func (c *wsMuxConn) close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.writeMu.Lock()
+		c.conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+			time.Now().Add(wsWriteWait))
+		c.writeMu.Unlock()
+		c.conn.Close()
+
+		if c.onClose != nil {
+			c.onClose(c)
+		}
+	})
+}
@@ -0,0 +1,179 @@
+// Package health follows how upstream endpoints answer the calls made to
+// them. An endpoint that keeps failing has its circuit breaker opened, and is
+// only tried again once the breaker has cooled down.
+package health
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Consecutive failures opening the breaker of an endpoint.
+	breakerThreshold = 5
+	// Time an open breaker waits before letting calls through again.
+	breakerCooldown = 30 * time.Second
+)
+
+// Breaker is the state of an endpoint's circuit breaker.
+type Breaker string
+
+const (
+	// BreakerClosed lets calls through.
+	BreakerClosed Breaker = "closed"
+	// BreakerOpen holds calls back, the endpoint being down.
+	BreakerOpen Breaker = "open"
+	// BreakerHalfOpen lets calls through again after the cooldown. The next
+	// outcome closes or reopens the breaker.
+	BreakerHalfOpen Breaker = "half_open"
+)
+
+// Status is what is known of an endpoint.
+type Status struct {
+	Breaker Breaker `json:"breaker"`
+	// Failures is the number of calls that failed in a row.
+	Failures    int       `json:"failures"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastFailure time.Time `json:"last_failure,omitzero"`
+	LastSuccess time.Time `json:"last_success,omitzero"`
+	InFlight    int64     `json:"in_flight"`
+	// Tip is the latest block height seen from the endpoint, 0 if unknown,
+	// and TipAt the time it was first seen.
+	Tip   uint64    `json:"tip,omitempty"`
+	TipAt time.Time `json:"tip_at,omitzero"`
+}
+
+type endpoint struct {
+	inFlight atomic.Int64
+
+	mu          sync.Mutex
+	failures    int
+	openedAt    time.Time // zero while the breaker is closed
+	lastError   string
+	lastFailure time.Time
+	lastSuccess time.Time
+	tip         uint64
+	tipAt       time.Time
+}
+
+// Tracker follows the endpoints reached by a gateway.
+type Tracker struct {
+	endpoints sync.Map // endpoint address -> *endpoint
+}
+
+// NewTracker returns a tracker knowing of no endpoint yet.
+func NewTracker() *Tracker {
+	return &Tracker{}
+}
+
+func (t *Tracker) get(addr string) *endpoint {
+	if e, ok := t.endpoints.Load(addr); ok {
+		return e.(*endpoint)
+	}
+	e, _ := t.endpoints.LoadOrStore(addr, &endpoint{})
+	return e.(*endpoint)
+}
+
+// Call is a call in flight to an endpoint.
+type Call struct {
+	e    *endpoint
+	once sync.Once
+}
+
+// Begin records the start of a call to the endpoint addr. Endpoints are
+// given as the gateway labels them in metrics: host:port, without scheme or
+// credentials.
+func (t *Tracker) Begin(addr string) *Call {
+	e := t.get(addr)
+	e.inFlight.Add(1)
+	return &Call{e: e}
+}
+
+// Done records the outcome of the call: err is nil unless the endpoint gave
+// no usable answer.
+func (c *Call) Done(err error) {
+	c.once.Do(func() {
+		c.e.inFlight.Add(-1)
+		c.e.observe(err)
+	})
+}
+
+func (e *endpoint) observe(err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	if err == nil {
+		e.failures = 0
+		e.openedAt = time.Time{}
+		e.lastSuccess = now
+		return
+	}
+	e.failures++
+	e.lastError = err.Error()
+	e.lastFailure = now
+	// A failure while half open reopens the breaker for another cooldown.
+	if e.failures >= breakerThreshold && (e.openedAt.IsZero() || now.Sub(e.openedAt) >= breakerCooldown) {
+		e.openedAt = now
+	}
+}
+
+func (e *endpoint) breaker(now time.Time) Breaker {
+	switch {
+	case e.openedAt.IsZero():
+		return BreakerClosed
+	case now.Sub(e.openedAt) < breakerCooldown:
+		return BreakerOpen
+	default:
+		return BreakerHalfOpen
+	}
+}
+
+// Available reports whether calls may be sent to the endpoint, that is
+// whether its breaker is not open.
+func (t *Tracker) Available(addr string) bool {
+	e := t.get(addr)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.breaker(time.Now()) != BreakerOpen
+}
+
+// Get returns the status of the endpoint addr.
+func (t *Tracker) Get(addr string) Status {
+	e := t.get(addr)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return Status{
+		Breaker:     e.breaker(time.Now()),
+		Failures:    e.failures,
+		LastError:   e.lastError,
+		LastFailure: e.lastFailure,
+		LastSuccess: e.lastSuccess,
+		InFlight:    e.inFlight.Load(),
+		Tip:         e.tip,
+		TipAt:       e.tipAt,
+	}
+}
+
+// ObserveTip records the latest block height seen from the endpoint addr. The
+// time of the tip only moves when the height does, so that a node stuck on a
+// block is noticed however often it is asked.
+func (t *Tracker) ObserveTip(addr string, height uint64) {
+	e := t.get(addr)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if height > e.tip {
+		e.tip = height
+		e.tipAt = time.Now()
+	}
+}
+
+// Reset closes the breaker of the endpoint addr and forgets its failures.
+func (t *Tracker) Reset(addr string) {
+	e := t.get(addr)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.failures = 0
+	e.openedAt = time.Time{}
+}
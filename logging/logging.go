@@ -0,0 +1,176 @@
+// Package logging sets up the gateway's structured logger and carries the
+// details of each request that end up in its access log line.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/decentrio/gateway/config"
+)
+
+const (
+	// RequestIDHeader carries the request ID to and from HTTP clients and
+	// upstreams.
+	RequestIDHeader = "X-Request-ID"
+	// RequestIDMetadata carries it in gRPC metadata.
+	RequestIDMetadata = "x-request-id"
+
+	maxRequestIDLength = 128
+)
+
+// Setup makes a logger configured by opts the default one, also used by the
+// standard log package.
+func Setup(opts config.LogOptions) error {
+	handler, err := NewHandler(os.Stderr, opts)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// NewHandler returns a handler writing to w in the format and from the level
+// of opts, adding the request ID of the context to every record.
+func NewHandler(w io.Writer, opts config.LogOptions) (slog.Handler, error) {
+	level, err := opts.SlogLevel()
+	if err != nil {
+		return nil, err
+	}
+	handlerOpts := &slog.HandlerOptions{Level: level}
+	if opts.Format == "json" {
+		return ContextHandler(slog.NewJSONHandler(w, handlerOpts)), nil
+	}
+	return ContextHandler(slog.NewTextHandler(w, handlerOpts)), nil
+}
+
+// ContextHandler wraps h to add the request ID of the context to every record.
+// Handlers it returned are left as they are.
+func ContextHandler(h slog.Handler) slog.Handler {
+	if _, ok := h.(contextHandler); ok {
+		return h
+	}
+	return contextHandler{h}
+}
+
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if req := FromContext(ctx); req != nil {
+		record.AddAttrs(slog.String("request_id", req.ID))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// RequestID returns id if it is fit to be logged and sent upstream, or else a
+// new random one.
+func RequestID(id string) string {
+	if id != "" && len(id) <= maxRequestIDLength && printable(id) {
+		return id
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func printable(s string) bool {
+	for _, c := range s {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// Request is a request being served, filled in as it is routed.
+type Request struct {
+	ID       string
+	Protocol string
+	Client   string
+	Method   string
+	start    time.Time
+
+	mu       sync.Mutex
+	height   *uint64
+	upstream string
+}
+
+// NewRequest starts timing a request.
+func NewRequest(id, protocol, client, method string) *Request {
+	return &Request{ID: id, Protocol: protocol, Client: client, Method: method, start: time.Now()}
+}
+
+type requestKey struct{}
+
+// NewContext returns a copy of ctx carrying req.
+func NewContext(ctx context.Context, req *Request) context.Context {
+	return context.WithValue(ctx, requestKey{}, req)
+}
+
+// FromContext returns the request of ctx, or nil.
+func FromContext(ctx context.Context) *Request {
+	req, _ := ctx.Value(requestKey{}).(*Request)
+	return req
+}
+
+// SetHeight records the height the request of ctx was routed on.
+func SetHeight(ctx context.Context, height uint64) {
+	if req := FromContext(ctx); req != nil {
+		req.mu.Lock()
+		req.height = &height
+		req.mu.Unlock()
+	}
+}
+
+// SetUpstream records the upstream that served the request of ctx.
+func SetUpstream(ctx context.Context, upstream string) {
+	if req := FromContext(ctx); req != nil {
+		req.mu.Lock()
+		req.upstream = upstream
+		req.mu.Unlock()
+	}
+}
+
+// Elapsed returns the time since the request started.
+func (r *Request) Elapsed() time.Duration {
+	return time.Since(r.start)
+}
+
+// Done writes the access log line of the request to logger.
+func (r *Request) Done(logger *slog.Logger, status string, bytes int64) {
+	r.mu.Lock()
+	attrs := []slog.Attr{
+		slog.String("request_id", r.ID),
+		slog.String("client", r.Client),
+		slog.String("protocol", r.Protocol),
+		slog.String("method", r.Method),
+	}
+	if r.height != nil {
+		attrs = append(attrs, slog.Uint64("height", *r.height))
+	}
+	attrs = append(attrs,
+		slog.String("upstream", r.upstream),
+		slog.String("status", status),
+		slog.Int64("bytes", bytes),
+		slog.Duration("latency", r.Elapsed()),
+	)
+	r.mu.Unlock()
+	// The request ID is already among the attributes.
+	logger.LogAttrs(context.Background(), slog.LevelInfo, "access", attrs...)
+}
@@ -0,0 +1,205 @@
+// Package metrics holds the Prometheus metrics of a gateway, shared by its
+// servers and the packages reaching upstream nodes.
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// maxMethodsPerServer bounds the method label of each server: method names
+// and paths come from clients, anything past the first ones seen is "other".
+const maxMethodsPerServer = 256
+
+// Metrics holds the metrics of a gateway, in a registry of their own along
+// with the Go runtime and process collectors.
+type Metrics struct {
+	Registry *prometheus.Registry
+
+	requests         *prometheus.CounterVec
+	requestDuration  *prometheus.HistogramVec
+	upstreamRequests *prometheus.CounterVec
+	upstreamDuration *prometheus.HistogramVec
+	routes           *prometheus.CounterVec
+	tipHeight        *prometheus.GaugeVec
+
+	methodsMu sync.Mutex
+	methods   map[string]map[string]struct{} // server -> methods seen
+}
+
+// New returns the metrics of a new gateway.
+func New() *Metrics {
+	m := &Metrics{
+		Registry: prometheus.NewRegistry(),
+
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gateway_requests_total",
+			Help: "Requests handled, by server, method and status.",
+		}, []string{"server", "method", "status"}),
+
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "gateway_request_duration_seconds",
+			Help:    "Time taken to answer requests, by server and method.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"server", "method"}),
+
+		upstreamRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gateway_upstream_requests_total",
+			Help: "Calls made to upstream nodes, by server, upstream and status. Calls that got no response have status \"error\".",
+		}, []string{"server", "upstream", "status"}),
+
+		upstreamDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "gateway_upstream_request_duration_seconds",
+			Help:    "Time taken by upstream nodes to answer, by server and upstream.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"server", "upstream"}),
+
+		routes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gateway_routed_requests_total",
+			Help: "Requests routed to an upstream, by server, height range and upstream.",
+		}, []string{"server", "range", "upstream"}),
+
+		tipHeight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gateway_upstream_tip_height",
+			Help: "Latest block height seen from each upstream.",
+		}, []string{"upstream"}),
+
+		methods: make(map[string]map[string]struct{}),
+	}
+	m.Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests, m.requestDuration, m.upstreamRequests, m.upstreamDuration, m.routes, m.tipHeight,
+	)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{})
+}
+
+// GaugeFunc registers a gauge whose value is read from value at scrape time.
+// Gauges sharing a name are told apart by their labels.
+func (m *Metrics) GaugeFunc(name, help string, labels prometheus.Labels, value func() float64) {
+	m.Registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        name,
+		Help:        help,
+		ConstLabels: labels,
+	}, value))
+}
+
+// methodLabel returns method, or "other" once server has seen too many.
+func (m *Metrics) methodLabel(server, method string) string {
+	m.methodsMu.Lock()
+	defer m.methodsMu.Unlock()
+	seen, ok := m.methods[server]
+	if !ok {
+		seen = make(map[string]struct{})
+		m.methods[server] = seen
+	}
+	if _, ok := seen[method]; !ok {
+		if len(seen) >= maxMethodsPerServer {
+			return "other"
+		}
+		seen[method] = struct{}{}
+	}
+	return method
+}
+
+// ObserveRequest records a request answered by server.
+func (m *Metrics) ObserveRequest(server, method, status string, elapsed time.Duration) {
+	method = m.methodLabel(server, method)
+	m.requests.WithLabelValues(server, method, status).Inc()
+	m.requestDuration.WithLabelValues(server, method).Observe(elapsed.Seconds())
+}
+
+// ObserveUpstream records a call made to upstream on behalf of server.
+func (m *Metrics) ObserveUpstream(server, upstream, status string, elapsed time.Duration) {
+	m.upstreamRequests.WithLabelValues(server, upstream, status).Inc()
+	m.upstreamDuration.WithLabelValues(server, upstream).Observe(elapsed.Seconds())
+}
+
+// ObserveRoute records that a request of server was routed to upstream, which
+// serves heightRange.
+func (m *Metrics) ObserveRoute(server, heightRange, upstream string) {
+	m.routes.WithLabelValues(server, heightRange, upstream).Inc()
+}
+
+// ObserveTip records the latest block height seen from upstream.
+func (m *Metrics) ObserveTip(upstream string, height uint64) {
+	m.tipHeight.WithLabelValues(upstream).Set(float64(height))
+}
+
+type serverKey struct{}
+
+// WithServer tags ctx with the server handling the request, so that upstream
+// calls made with it are attributed to that server.
+func WithServer(ctx context.Context, server string) context.Context {
+	return context.WithValue(ctx, serverKey{}, server)
+}
+
+// Server returns the server ctx was tagged with.
+func Server(ctx context.Context) string {
+	if server, ok := ctx.Value(serverKey{}).(string); ok {
+		return server
+	}
+	return "unknown"
+}
+
+// StatusRecorder wraps a ResponseWriter to capture the status and size of the
+// response.
+type StatusRecorder struct {
+	http.ResponseWriter
+	Status int
+	Bytes  int64
+}
+
+func (r *StatusRecorder) WriteHeader(status int) {
+	if r.Status == 0 {
+		r.Status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *StatusRecorder) Write(b []byte) (int, error) {
+	if r.Status == 0 {
+		r.Status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.Bytes += int64(n)
+	return n, err
+}
+
+func (r *StatusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack hands the connection over for WebSocket upgrades, recorded as 101.
+func (r *StatusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T does not support hijacking", r.ResponseWriter)
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil && r.Status == 0 {
+		r.Status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *StatusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,285 @@
+// Package pool keeps the connections to upstream gRPC nodes, shared by the
+// transparent proxy and the services registered on the gateway.
+package pool
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/decentrio/gateway/config"
+	"github.com/decentrio/gateway/health"
+	"github.com/decentrio/gateway/logging"
+	"github.com/decentrio/gateway/metrics"
+	"github.com/decentrio/gateway/tracing"
+)
+
+// HeightHeader is the metadata key Cosmos SDK nodes read the query height from.
+const HeightHeader = "x-cosmos-block-height"
+
+// Pool holds the connections of a gateway to its upstream gRPC nodes.
+type Pool struct {
+	store   *config.Store
+	health  *health.Tracker
+	metrics *metrics.Metrics
+	route   func(height uint64) []*config.Node
+
+	mu    sync.RWMutex
+	conns map[string]*grpc.ClientConn
+}
+
+// New returns an empty pool routing calls to the nodes route returns for a
+// height, in the order it prefers them.
+func New(store *config.Store, tracker *health.Tracker, m *metrics.Metrics, route func(height uint64) []*config.Node) *Pool {
+	p := &Pool{store: store, health: tracker, metrics: m, route: route, conns: make(map[string]*grpc.ClientConn)}
+	m.GaugeFunc("gateway_grpc_pool_connections", "Connections held open to upstream gRPC nodes.", nil, func() float64 {
+		p.mu.RLock()
+		defer p.mu.RUnlock()
+		return float64(len(p.conns))
+	})
+	return p
+}
+
+// Config returns the current configuration of the gateway of the pool.
+func (p *Pool) Config() *config.Config {
+	return p.store.Get()
+}
+
+func (p *Pool) GetGRPCConn(ctx context.Context, addr string) (*grpc.ClientConn, error) {
+	p.mu.RLock()
+	conn, ok := p.conns[addr]
+	p.mu.RUnlock()
+
+	if ok {
+		return conn, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// Double check to avoid race
+	if conn, ok := p.conns[addr]; ok {
+		return conn, nil
+	}
+	opts := grpc.WithTransportCredentials(insecure.NewCredentials())
+	if settings := p.store.Get().EndpointTLS(addr); settings.Enable {
+		tlsConfig, err := settings.ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts = grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))
+	}
+
+	newConn, err := grpc.DialContext(ctx, addr, opts,
+		grpc.WithChainUnaryInterceptor(tracing.UnaryClientInterceptor),
+		grpc.WithChainStreamInterceptor(tracing.StreamClientInterceptor),
+	)
+
+	if err != nil {
+		return nil, err
+	}
+	p.conns[addr] = newConn
+	return newConn, nil
+}
+
+func (p *Pool) CloseAllGRPCConnections() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for addr, conn := range p.conns {
+		conn.Close()
+		delete(p.conns, addr)
+	}
+}
+
+// CloseGRPCConn closes the pooled connection to addr, if any, failing the
+// calls still running on it.
+func (p *Pool) CloseGRPCConn(addr string) {
+	p.mu.Lock()
+	conn, ok := p.conns[addr]
+	delete(p.conns, addr)
+	p.mu.Unlock()
+	if ok {
+		conn.Close()
+	}
+}
+
+// Healthy reports whether the pooled connection to addr, if any, is usable
+// and the breaker of addr lets calls through. A node is only considered down
+// once its connection or its calls have failed.
+func (p *Pool) Healthy(addr string) bool {
+	p.mu.RLock()
+	conn, ok := p.conns[addr]
+	p.mu.RUnlock()
+	return (!ok || conn.GetState() != connectivity.TransientFailure) && p.health.Available(addr)
+}
+
+// UpstreamFailure returns what the outcome err of a call counts as for the
+// health of the node: only calls finding the node unavailable are failures.
+func UpstreamFailure(err error) error {
+	if status.Code(err) == codes.Unavailable {
+		return err
+	}
+	return nil
+}
+
+// GRPCNodes returns the gRPC nodes able to serve height in routing order:
+// healthy nodes first, in the order the router of the pool prefers them,
+// followed by the failed ones as a last resort.
+func (p *Pool) GRPCNodes(height uint64) []*config.Node {
+	var up, down []*config.Node
+	for _, node := range p.route(height) {
+		if node.GRPC == "" {
+			continue
+		}
+		if p.Healthy(node.GRPC) {
+			up = append(up, node)
+		} else {
+			down = append(down, node)
+		}
+	}
+	return append(up, down...)
+}
+
+// Route returns the nodes able to serve height to the call of ctx, in the
+// order of GRPCNodes, recording the height for the logs and traces.
+func (p *Pool) Route(ctx context.Context, height uint64) []*config.Node {
+	logging.SetHeight(ctx, height)
+	_, span := tracing.Start(ctx, "route", trace.WithAttributes(attribute.Int64("gateway.height", int64(height))))
+	defer span.End()
+
+	nodes := p.GRPCNodes(height)
+	if len(nodes) == 0 {
+		span.SetStatus(otelcodes.Error, "no node for height")
+		return nil
+	}
+	span.SetAttributes(attribute.String("gateway.range", nodes[0].HeightRange()))
+	return nodes
+}
+
+// RequestHeight returns the height a call should be routed on: height, if set
+// by the request itself, or else the x-cosmos-block-height header.
+func RequestHeight(ctx context.Context, height int64) (uint64, error) {
+	if height > 0 {
+		return uint64(height), nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(HeightHeader)
+	if len(values) == 0 {
+		return 0, nil
+	}
+	h, err := strconv.ParseUint(values[0], 10, 64)
+	if err != nil {
+		return 0, status.Errorf(codes.InvalidArgument, "Invalid %s", HeightHeader)
+	}
+	return h, nil
+}
+
+// OutgoingContext forwards the caller's metadata to the upstream call.
+func OutgoingContext(ctx context.Context) context.Context {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ctx
+	}
+	return metadata.NewOutgoingContext(ctx, md.Copy())
+}
+
+// headerForwardingConn passes the upstream's response headers and trailers back
+// to the gateway's caller, as the transparent proxy does.
+type headerForwardingConn struct {
+	*grpc.ClientConn
+	serverCtx context.Context
+}
+
+func (c headerForwardingConn) Invoke(ctx context.Context, method string, args, reply any, opts ...grpc.CallOption) error {
+	var header, trailer metadata.MD
+	err := c.ClientConn.Invoke(ctx, method, args, reply, append(opts, grpc.Header(&header), grpc.Trailer(&trailer))...)
+	if len(header) > 0 {
+		grpc.SetHeader(c.serverCtx, header)
+	}
+	if len(trailer) > 0 {
+		grpc.SetTrailer(c.serverCtx, trailer)
+	}
+	return err
+}
+
+// Invoke runs call against the nodes of p able to serve height, moving on to
+// the next node for as long as they are unavailable. A height no node serves
+// is reported as NotFound.
+func Invoke[T any](ctx context.Context, p *Pool, height uint64, call func(ctx context.Context, conn grpc.ClientConnInterface) (T, error)) (T, error) {
+	return invoke(ctx, p, height, true, call)
+}
+
+// InvokeOnce runs call against the first node of p able to serve height only,
+// for calls that must not be sent twice, such as broadcasts.
+func InvokeOnce[T any](ctx context.Context, p *Pool, height uint64, call func(ctx context.Context, conn grpc.ClientConnInterface) (T, error)) (T, error) {
+	return invoke(ctx, p, height, false, call)
+}
+
+func invoke[T any](ctx context.Context, p *Pool, height uint64, failover bool, call func(ctx context.Context, conn grpc.ClientConnInterface) (T, error)) (T, error) {
+	var zero T
+	nodes := p.Route(ctx, height)
+	if len(nodes) == 0 {
+		if height == 0 {
+			return zero, status.Errorf(codes.Unavailable, "No available gRPC backends")
+		}
+		return zero, status.Errorf(codes.NotFound, "No matching backend found for height %d", height)
+	}
+	if !failover {
+		nodes = nodes[:1]
+	}
+
+	outCtx := OutgoingContext(ctx)
+	err := status.Errorf(codes.Unavailable, "Connection error")
+	for _, node := range nodes {
+		conn, dialErr := p.GetGRPCConn(ctx, node.GRPC)
+		if dialErr != nil {
+			continue
+		}
+		res, callErr := observe(ctx, p, node, func() (T, error) {
+			return call(outCtx, headerForwardingConn{ClientConn: conn, serverCtx: ctx})
+		})
+		if status.Code(callErr) == codes.Unavailable {
+			err = callErr
+			continue
+		}
+		p.metrics.ObserveRoute(metrics.Server(ctx), node.HeightRange(), node.GRPC)
+		logging.SetUpstream(ctx, node.GRPC)
+		return res, callErr
+	}
+	return zero, err
+}
+
+// Call runs call against node alone, for calls sent to several nodes at once.
+// Like Invoke, it reports the outcome to the health and metrics of p.
+func Call[T any](ctx context.Context, p *Pool, node *config.Node, call func(ctx context.Context, conn grpc.ClientConnInterface) (T, error)) (T, error) {
+	conn, err := p.GetGRPCConn(ctx, node.GRPC)
+	if err != nil {
+		var zero T
+		return zero, status.Errorf(codes.Unavailable, "Connection error")
+	}
+	outCtx := OutgoingContext(ctx)
+	return observe(ctx, p, node, func() (T, error) {
+		return call(outCtx, conn)
+	})
+}
+
+// observe runs a call to node, recording its outcome.
+func observe[T any](ctx context.Context, p *Pool, node *config.Node, call func() (T, error)) (T, error) {
+	upstream := p.health.Begin(node.GRPC)
+	start := time.Now()
+	res, err := call()
+	p.metrics.ObserveUpstream(metrics.Server(ctx), node.GRPC, status.Code(err).String(), time.Since(start))
+	upstream.Done(UpstreamFailure(err))
+	return res, err
+}
@@ -2,38 +2,31 @@ package register
 
 import (
 	"context"
-	"crypto/tls"
-	"fmt"
-
-	// "fmt"
-	"strings"
 
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials"
-	"google.golang.org/grpc/credentials/insecure"
 
 	tmservice "github.com/cosmos/cosmos-sdk/client/grpc/tmservice"
 
-	"github.com/decentrio/gateway/config"
+	"github.com/decentrio/gateway/pool"
 )
 
 type CustomTMService struct {
 	tmservice.UnimplementedServiceServer
+	pool *pool.Pool
 }
 
 // grpcurl -plaintext -d '{"height":"12"}' localhost:5002 cosmos.base.tendermint.v1beta1.Service.GetBlockByHeight
 func (s *CustomTMService) GetBlockByHeight(ctx context.Context, req *tmservice.GetBlockByHeightRequest) (*tmservice.GetBlockByHeightResponse, error) {
-	client, conn := getClientTm(ctx, req.Height)
-	defer conn.Close()
-	return client.GetBlockByHeight(ctx, req)
+	return invokeTm(ctx, s.pool, req.Height, func(ctx context.Context, client tmservice.ServiceClient) (*tmservice.GetBlockByHeightResponse, error) {
+		return client.GetBlockByHeight(ctx, req)
+	})
 }
 
 // grpcurl -plaintext -d '{"height":"12"}' localhost:5002 cosmos.base.tendermint.v1beta1.Service.GetValidatorSetByHeight
 func (s *CustomTMService) GetValidatorSetByHeight(ctx context.Context, req *tmservice.GetValidatorSetByHeightRequest) (*tmservice.GetValidatorSetByHeightResponse, error) {
-	client, conn := getClientTm(ctx, req.Height)
-	defer conn.Close()
-	return client.GetValidatorSetByHeight(ctx, req)
-
+	return invokeTm(ctx, s.pool, req.Height, func(ctx context.Context, client tmservice.ServiceClient) (*tmservice.GetValidatorSetByHeightResponse, error) {
+		return client.GetValidatorSetByHeight(ctx, req)
+	})
 }
 
 //	grpcurl -plaintext -d '{
@@ -41,49 +34,38 @@ func (s *CustomTMService) GetValidatorSetByHeight(ctx context.Context, req *tmse
 //		"data": "0a2d636f736d6f73316c71733763746e393578386d3930347a6766786a646b7777766638746b6c6b707936656b"
 //	  }' localhost:5002 cosmos.base.tendermint.v1beta1.Service.ABCIQuery
 func (s *CustomTMService) ABCIQuery(ctx context.Context, req *tmservice.ABCIQueryRequest) (*tmservice.ABCIQueryResponse, error) {
-	client, conn := getClientTm(ctx, req.Height)
-	defer conn.Close()
-	return client.ABCIQuery(ctx, req)
+	return invokeTm(ctx, s.pool, req.Height, func(ctx context.Context, client tmservice.ServiceClient) (*tmservice.ABCIQueryResponse, error) {
+		return client.ABCIQuery(ctx, req)
+	})
 }
 
-func (*CustomTMService) GetLatestBlock(ctx context.Context, req *tmservice.GetLatestBlockRequest) (*tmservice.GetLatestBlockResponse, error) {
-	client, conn := getClientTm(ctx, 0)
-	defer conn.Close()
-	return client.GetLatestBlock(ctx, req)
+func (s *CustomTMService) GetLatestBlock(ctx context.Context, req *tmservice.GetLatestBlockRequest) (*tmservice.GetLatestBlockResponse, error) {
+	return invokeTm(ctx, s.pool, 0, func(ctx context.Context, client tmservice.ServiceClient) (*tmservice.GetLatestBlockResponse, error) {
+		return client.GetLatestBlock(ctx, req)
+	})
 }
 
-func (*CustomTMService) GetSyncing(ctx context.Context, req *tmservice.GetSyncingRequest) (*tmservice.GetSyncingResponse, error) {
-	client, conn := getClientTm(ctx, 0)
-	defer conn.Close()
-	return client.GetSyncing(ctx, req)
+func (s *CustomTMService) GetSyncing(ctx context.Context, req *tmservice.GetSyncingRequest) (*tmservice.GetSyncingResponse, error) {
+	return invokeTm(ctx, s.pool, 0, func(ctx context.Context, client tmservice.ServiceClient) (*tmservice.GetSyncingResponse, error) {
+		return client.GetSyncing(ctx, req)
+	})
 }
 
-func (*CustomTMService) GetNodeInfo(ctx context.Context, req *tmservice.GetNodeInfoRequest) (*tmservice.GetNodeInfoResponse, error) {
-	client, conn := getClientTm(ctx, 0)
-	defer conn.Close()
-	return client.GetNodeInfo(ctx, req)
+func (s *CustomTMService) GetNodeInfo(ctx context.Context, req *tmservice.GetNodeInfoRequest) (*tmservice.GetNodeInfoResponse, error) {
+	return invokeTm(ctx, s.pool, 0, func(ctx context.Context, client tmservice.ServiceClient) (*tmservice.GetNodeInfoResponse, error) {
+		return client.GetNodeInfo(ctx, req)
+	})
 }
 
-func getClientTm(ctx context.Context, height int64) (tmservice.ServiceClient, *grpc.ClientConn) {
-	node := config.GetNodebyHeight(uint64(height))
-	if node == nil {
-		return nil, nil
-	}
-
-	fmt.Printf("Forwarding GetBlockByHeight request to node: %s\n", node.GRPC)
-
-	var err error
-	var conn *grpc.ClientConn
-	if strings.HasSuffix(node.GRPC, ":443") {
-		tlsConfig := &tls.Config{InsecureSkipVerify: true}
-		conn, err = grpc.DialContext(ctx, node.GRPC, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
-	} else {
-		conn, err = grpc.DialContext(ctx, node.GRPC, grpc.WithTransportCredentials(insecure.NewCredentials()))
-	}
-
+// invokeTm calls the node serving height, or the x-cosmos-block-height header
+// when height is 0, failing over to the other nodes able to serve it.
+func invokeTm[T any](ctx context.Context, p *pool.Pool, height int64, call func(context.Context, tmservice.ServiceClient) (T, error)) (T, error) {
+	h, err := pool.RequestHeight(ctx, height)
 	if err != nil {
-		return nil, nil
+		var zero T
+		return zero, err
 	}
-
-	return tmservice.NewServiceClient(conn), conn
+	return pool.Invoke(ctx, p, h, func(ctx context.Context, conn grpc.ClientConnInterface) (T, error) {
+		return call(ctx, tmservice.NewServiceClient(conn))
+	})
 }
@@ -5,10 +5,13 @@ import (
 
 	tmservice "github.com/cosmos/cosmos-sdk/client/grpc/tmservice"
 	txsservice "github.com/cosmos/cosmos-sdk/types/tx"
+
+	"github.com/decentrio/gateway/pool"
 )
 
-func Register(grpcServer *grpc.Server) {
-	tmservice.RegisterServiceServer(grpcServer, &CustomTMService{})
-	txsservice.RegisterServiceServer(grpcServer, &CustomTxsService{})
+// Register adds the services served by calling the nodes of p to grpcServer.
+func Register(grpcServer *grpc.Server, p *pool.Pool) {
+	tmservice.RegisterServiceServer(grpcServer, &CustomTMService{pool: p})
+	txsservice.RegisterServiceServer(grpcServer, &CustomTxsService{pool: p})
 	// add service
 }
@@ -0,0 +1,258 @@
+package register
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/cosmos/cosmos-sdk/types/query"
+	txsservice "github.com/cosmos/cosmos-sdk/types/tx"
+
+	"github.com/decentrio/gateway/config"
+	"github.com/decentrio/gateway/pool"
+	"github.com/decentrio/gateway/tracing"
+)
+
+// fanOutTxs runs call against every gRPC upstream at once and returns the first
+// successful reply, cancelling the other calls. When every node fails, a
+// NotFound from any of them is reported in preference to other errors.
+func fanOutTxs[T any](ctx context.Context, p *pool.Pool, call func(context.Context, txsservice.ServiceClient) (T, error)) (T, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		res T
+		err error
+	}
+	cfg := p.Config()
+	var nodes []*config.Node
+	for i, node := range cfg.Upstream {
+		if node.GRPC != "" && node.Enabled() {
+			nodes = append(nodes, &cfg.Upstream[i])
+		}
+	}
+	ctx, span := tracing.Start(ctx, "fanout", trace.WithAttributes(attribute.Int("gateway.upstreams", len(nodes))))
+	defer span.End()
+	results := make(chan result, len(nodes))
+	for _, node := range nodes {
+		go func(node *config.Node) {
+			res, err := pool.Call(ctx, p, node, func(ctx context.Context, conn grpc.ClientConnInterface) (T, error) {
+				return call(ctx, txsservice.NewServiceClient(conn))
+			})
+			results <- result{res: res, err: err}
+		}(node)
+	}
+
+	var zero T
+	err := status.Errorf(codes.Unavailable, "No available gRPC backends")
+	for range nodes {
+		r := <-results
+		if r.err == nil {
+			return r.res, nil
+		}
+		if status.Code(err) != codes.NotFound {
+			err = r.err
+		}
+	}
+	return zero, err
+}
+
+// txHeightRange returns the heights allowed by the tx.height conditions of
+// events, such as "tx.height >= 100" or "tx.height<'200'". to is 0 when there
+// is no upper bound, and conditions no height meets give from > to.
+func txHeightRange(events []string) (from, to uint64, err error) {
+	bounded := false
+	for _, event := range events {
+		rest, ok := strings.CutPrefix(strings.TrimSpace(event), "tx.height")
+		if !ok {
+			continue
+		}
+		rest = strings.TrimSpace(rest)
+		op := ""
+		for _, candidate := range []string{">=", "<=", ">", "<", "="} {
+			if strings.HasPrefix(rest, candidate) {
+				op = candidate
+				break
+			}
+		}
+		if op == "" {
+			continue
+		}
+		value := strings.TrimSpace(strings.Trim(strings.TrimSpace(strings.TrimPrefix(rest, op)), `'"`))
+		height, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid tx.height in event %s", event)
+		}
+		switch op {
+		case ">":
+			height++
+			fallthrough
+		case ">=":
+			from = max(from, height)
+			continue
+		case "<":
+			if height > 0 {
+				height--
+			}
+		case "=":
+			from = max(from, height)
+		}
+		if !bounded || height < to {
+			to, bounded = height, true
+		}
+	}
+	if bounded && to == 0 {
+		// Heights start at 1, and a to of 0 would mean no upper bound.
+		return max(from, 2), 1, nil
+	}
+	return from, to, nil
+}
+
+func searchTxsEvent(ctx context.Context, p *pool.Pool, req *txsservice.GetTxsEventRequest) (*txsservice.GetTxsEventResponse, error) {
+	from, to, err := txHeightRange(req.Events)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if to != 0 && from > to {
+		return &txsservice.GetTxsEventResponse{}, nil
+	}
+
+	parts := p.Config().SplitHeightRange(from, to)
+	switch len(parts) {
+	case 0:
+		return nil, status.Errorf(codes.Unavailable, "No matching backend found")
+	case 1:
+		// Routed on the top of the part, or on the latest block when open.
+		return pool.Invoke(ctx, p, parts[0].To, func(ctx context.Context, conn grpc.ClientConnInterface) (*txsservice.GetTxsEventResponse, error) {
+			return txsservice.NewServiceClient(conn).GetTxsEvent(ctx, req)
+		})
+	}
+	return splitTxsEvent(ctx, p, req, parts)
+}
+
+// txsSearchLeg is the share of a split search sent to one node, restricted to
+// the heights that node is responsible for.
+type txsSearchLeg struct {
+	pool   *pool.Pool
+	node   *config.Node
+	events []string
+	total  uint64
+}
+
+func (l *txsSearchLeg) search(ctx context.Context, req *txsservice.GetTxsEventRequest, page, limit uint64) (*txsservice.GetTxsEventResponse, error) {
+	return pool.Call(ctx, l.pool, l.node, func(ctx context.Context, conn grpc.ClientConnInterface) (*txsservice.GetTxsEventResponse, error) {
+		return txsservice.NewServiceClient(conn).GetTxsEvent(ctx, &txsservice.GetTxsEventRequest{
+			Events:  l.events,
+			OrderBy: req.OrderBy,
+			Page:    page,
+			Limit:   limit,
+		})
+	})
+}
+
+// fetch returns count results of the leg starting at offset. Upstreams page by
+// page number, so this takes at most two pages of size count.
+func (l *txsSearchLeg) fetch(ctx context.Context, req *txsservice.GetTxsEventRequest, offset, count uint64) (*txsservice.GetTxsEventResponse, error) {
+	page := offset/count + 1
+	res, err := l.search(ctx, req, page, count)
+	if err != nil {
+		return nil, err
+	}
+	skip := min(offset%count, uint64(len(res.TxResponses)))
+	out := &txsservice.GetTxsEventResponse{TxResponses: res.TxResponses[skip:]}
+	if uint64(len(res.Txs)) >= skip {
+		out.Txs = res.Txs[skip:]
+	}
+	if skip > 0 {
+		next, err := l.search(ctx, req, page+1, count)
+		if err != nil {
+			return nil, err
+		}
+		n := min(skip, uint64(len(next.TxResponses)))
+		out.TxResponses = append(out.TxResponses, next.TxResponses[:n]...)
+		out.Txs = append(out.Txs, next.Txs[:min(n, uint64(len(next.Txs)))]...)
+	}
+	return out, nil
+}
+
+// splitTxsEvent runs a search spanning several nodes as one search per node,
+// each limited to that node's heights, and pages through their results as if
+// they came from a single node.
+func splitTxsEvent(ctx context.Context, p *pool.Pool, req *txsservice.GetTxsEventRequest, parts []config.NodeRange) (*txsservice.GetTxsEventResponse, error) {
+	page := max(req.Page, 1)
+	limit := req.Limit
+	if limit == 0 {
+		limit = query.DefaultLimit
+	}
+	if req.OrderBy == txsservice.OrderBy_ORDER_BY_DESC {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+
+	legs := make([]*txsSearchLeg, len(parts))
+	for i, part := range parts {
+		events := append([]string{}, req.Events...)
+		events = append(events, fmt.Sprintf("tx.height>=%d", part.From))
+		if part.To != 0 {
+			events = append(events, fmt.Sprintf("tx.height<=%d", part.To))
+		}
+		legs[i] = &txsSearchLeg{pool: p, node: part.Node, events: events}
+	}
+	ctx, span := tracing.Start(ctx, "fanout", trace.WithAttributes(attribute.Int("gateway.upstreams", len(legs))))
+	defer span.End()
+
+	// Count the matches on every node first, to know where the page falls.
+	var wg sync.WaitGroup
+	errs := make([]error, len(legs))
+	for i, leg := range legs {
+		wg.Add(1)
+		go func(i int, leg *txsSearchLeg) {
+			defer wg.Done()
+			res, err := leg.search(ctx, req, 1, 1)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			leg.total = res.Total
+		}(i, leg)
+	}
+	wg.Wait()
+
+	res := &txsservice.GetTxsEventResponse{}
+	for i, leg := range legs {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		res.Total += leg.total
+	}
+
+	offset, remaining := (page-1)*limit, limit
+	for _, leg := range legs {
+		if remaining == 0 {
+			break
+		}
+		if offset >= leg.total {
+			offset -= leg.total
+			continue
+		}
+		count := min(remaining, leg.total-offset)
+		part, err := leg.fetch(ctx, req, offset, count)
+		if err != nil {
+			return nil, err
+		}
+		res.Txs = append(res.Txs, part.Txs...)
+		res.TxResponses = append(res.TxResponses, part.TxResponses...)
+		remaining -= count
+		offset = 0
+	}
+	return res, nil
+}
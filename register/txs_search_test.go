@@ -0,0 +1,31 @@
+package register
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTxHeightRange(t *testing.T) {
+	for _, tc := range []struct {
+		events   []string
+		from, to uint64
+	}{
+		{events: []string{"message.action='send'"}},
+		{events: []string{"tx.height=120"}, from: 120, to: 120},
+		{events: []string{"tx.height>=10", "tx.height<=12"}, from: 10, to: 12},
+		{events: []string{" tx.height >= 10 ", "tx.height <= '12'"}, from: 10, to: 12},
+		{events: []string{"tx.height > 10", "tx.height<12"}, from: 11, to: 11},
+		{events: []string{"tx.height>=10", "tx.height>20", "tx.height<=40", "tx.height<30"}, from: 21, to: 29},
+		{events: []string{"tx.height<1"}, from: 2, to: 1},
+		{events: []string{"tx.height<=0"}, from: 2, to: 1},
+	} {
+		from, to, err := txHeightRange(tc.events)
+		require.NoError(t, err, tc.events)
+		require.Equal(t, tc.from, from, tc.events)
+		require.Equal(t, tc.to, to, tc.events)
+	}
+
+	_, _, err := txHeightRange([]string{"tx.height >= ten"})
+	require.ErrorContains(t, err, "invalid tx.height")
+}
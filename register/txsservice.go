@@ -2,91 +2,85 @@ package register
 
 import (
 	"context"
-	"crypto/tls"
-	"fmt"
-	"strings"
 
 	"google.golang.org/grpc"
 
-	"google.golang.org/grpc/credentials"
-	"google.golang.org/grpc/credentials/insecure"
-
 	txsservice "github.com/cosmos/cosmos-sdk/types/tx"
 
-	"github.com/decentrio/gateway/config"
+	"github.com/decentrio/gateway/pool"
 )
 
 type CustomTxsService struct {
 	txsservice.UnimplementedServiceServer
+	pool *pool.Pool
 }
 
+// BroadcastTx is sent to a single node serving the latest blocks, with no
+// failover: a node failing to answer may still have taken the transaction.
 func (s *CustomTxsService) BroadcastTx(ctx context.Context, req *txsservice.BroadcastTxRequest) (*txsservice.BroadcastTxResponse, error) {
-	client, conn := getClientTxs(ctx, 0)
-	defer conn.Close()
-	return client.BroadcastTx(ctx, req)
+	return pool.InvokeOnce(ctx, s.pool, 0, func(ctx context.Context, conn grpc.ClientConnInterface) (*txsservice.BroadcastTxResponse, error) {
+		return txsservice.NewServiceClient(conn).BroadcastTx(ctx, req)
+	})
 }
+
 func (s *CustomTxsService) GetBlockWithTxs(ctx context.Context, req *txsservice.GetBlockWithTxsRequest) (*txsservice.GetBlockWithTxsResponse, error) {
-	client, conn := getClientTxs(ctx, req.Height)
-	defer conn.Close()
-	return client.GetBlockWithTxs(ctx, req)
+	return invokeTxs(ctx, s.pool, req.Height, func(ctx context.Context, client txsservice.ServiceClient) (*txsservice.GetBlockWithTxsResponse, error) {
+		return client.GetBlockWithTxs(ctx, req)
+	})
 }
+
+// GetTx asks every upstream at once, since a transaction may live on any
+// archive segment, and answers with the first node that has it.
+//
+//	grpcurl -plaintext -d '{"hash": "<hash>"}' localhost:5002 cosmos.tx.v1beta1.Service/GetTx
 func (s *CustomTxsService) GetTx(ctx context.Context, req *txsservice.GetTxRequest) (*txsservice.GetTxResponse, error) {
-	client, conn := getClientTxs(ctx, 0)
-	defer conn.Close()
-	return client.GetTx(ctx, req)
+	return fanOutTxs(ctx, s.pool, func(ctx context.Context, client txsservice.ServiceClient) (*txsservice.GetTxResponse, error) {
+		return client.GetTx(ctx, req)
+	})
 }
 
+// GetTxsEvent is routed on the tx.height conditions of the events, and split
+// across nodes when the heights span several of them.
+//
+//	grpcurl -plaintext -d '{"events": ["tx.height>=100", "tx.height<=2000"]}' localhost:5002 cosmos.tx.v1beta1.Service/GetTxsEvent
 func (s *CustomTxsService) GetTxsEvent(ctx context.Context, req *txsservice.GetTxsEventRequest) (*txsservice.GetTxsEventResponse, error) {
-	client, conn := getClientTxs(ctx, 0)
-	defer conn.Close()
-	return client.GetTxsEvent(ctx, req)
+	return searchTxsEvent(ctx, s.pool, req)
 }
 func (s *CustomTxsService) Simulate(ctx context.Context, req *txsservice.SimulateRequest) (*txsservice.SimulateResponse, error) {
-	client, conn := getClientTxs(ctx, 0)
-	defer conn.Close()
-	return client.Simulate(ctx, req)
+	return invokeTxs(ctx, s.pool, 0, func(ctx context.Context, client txsservice.ServiceClient) (*txsservice.SimulateResponse, error) {
+		return client.Simulate(ctx, req)
+	})
 }
 func (s *CustomTxsService) TxDecode(ctx context.Context, req *txsservice.TxDecodeRequest) (*txsservice.TxDecodeResponse, error) {
-	client, conn := getClientTxs(ctx, 0)
-	defer conn.Close()
-	return client.TxDecode(ctx, req)
+	return invokeTxs(ctx, s.pool, 0, func(ctx context.Context, client txsservice.ServiceClient) (*txsservice.TxDecodeResponse, error) {
+		return client.TxDecode(ctx, req)
+	})
 }
 func (s *CustomTxsService) TxDecodeAmino(ctx context.Context, req *txsservice.TxDecodeAminoRequest) (*txsservice.TxDecodeAminoResponse, error) {
-	client, conn := getClientTxs(ctx, 0)
-	defer conn.Close()
-	return client.TxDecodeAmino(ctx, req)
+	return invokeTxs(ctx, s.pool, 0, func(ctx context.Context, client txsservice.ServiceClient) (*txsservice.TxDecodeAminoResponse, error) {
+		return client.TxDecodeAmino(ctx, req)
+	})
 }
 func (s *CustomTxsService) TxEncode(ctx context.Context, req *txsservice.TxEncodeRequest) (*txsservice.TxEncodeResponse, error) {
-	client, conn := getClientTxs(ctx, 0)
-	defer conn.Close()
-	return client.TxEncode(ctx, req)
+	return invokeTxs(ctx, s.pool, 0, func(ctx context.Context, client txsservice.ServiceClient) (*txsservice.TxEncodeResponse, error) {
+		return client.TxEncode(ctx, req)
+	})
 }
 func (s *CustomTxsService) TxEncodeAmino(ctx context.Context, req *txsservice.TxEncodeAminoRequest) (*txsservice.TxEncodeAminoResponse, error) {
-	client, conn := getClientTxs(ctx, 0)
-	defer conn.Close()
-	return client.TxEncodeAmino(ctx, req)
+	return invokeTxs(ctx, s.pool, 0, func(ctx context.Context, client txsservice.ServiceClient) (*txsservice.TxEncodeAminoResponse, error) {
+		return client.TxEncodeAmino(ctx, req)
+	})
 }
 
-func getClientTxs(ctx context.Context, height int64) (txsservice.ServiceClient, *grpc.ClientConn) {
-	node := config.GetNodebyHeight(uint64(height))
-	if node == nil {
-		return nil, nil
-	}
-
-	fmt.Printf("Forwarding GetBlockByHeight request to node: %s\n", node.GRPC)
-
-	var err error
-	var conn *grpc.ClientConn
-	if strings.HasSuffix(node.GRPC, ":443") {
-		tlsConfig := &tls.Config{InsecureSkipVerify: true}
-		conn, err = grpc.DialContext(ctx, node.GRPC, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
-	} else {
-		conn, err = grpc.DialContext(ctx, node.GRPC, grpc.WithTransportCredentials(insecure.NewCredentials()))
-	}
-
+// invokeTxs calls the node serving height, or the x-cosmos-block-height header
+// when height is 0, failing over to the other nodes able to serve it.
+func invokeTxs[T any](ctx context.Context, p *pool.Pool, height int64, call func(context.Context, txsservice.ServiceClient) (T, error)) (T, error) {
+	h, err := pool.RequestHeight(ctx, height)
 	if err != nil {
-		return nil, nil
+		var zero T
+		return zero, err
 	}
-
-	return txsservice.NewServiceClient(conn), conn
+	return pool.Invoke(ctx, p, h, func(ctx context.Context, conn grpc.ClientConnInterface) (T, error) {
+		return call(ctx, txsservice.NewServiceClient(conn))
+	})
 }
@@ -0,0 +1,202 @@
+// Package tracing sets up the OpenTelemetry traces of the gateway and carries
+// their context to and from clients and upstreams.
+package tracing
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/decentrio/gateway/config"
+)
+
+const instrumentation = "github.com/decentrio/gateway"
+
+// Setup makes a tracer provider exporting to the collector configured by opts
+// the global one, or a no-op provider when tracing is disabled. The returned
+// function flushes and stops the exporter.
+//
+// W3C trace context is propagated either way, so that the traces of callers
+// carry on through the gateway to the upstreams.
+func Setup(opts config.TracingOptions) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if !opts.Enabled {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := newExporter(opts)
+	if err != nil {
+		return nil, err
+	}
+	name := opts.ServiceName
+	if name == "" {
+		name = "gateway"
+	}
+	ratio := 1.0
+	if opts.SampleRatio != nil {
+		ratio = *opts.SampleRatio
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(name))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+func newExporter(opts config.TracingOptions) (sdktrace.SpanExporter, error) {
+	ctx := context.Background()
+	if opts.Protocol == "http" {
+		var options []otlptracehttp.Option
+		if opts.Endpoint != "" {
+			options = append(options, otlptracehttp.WithEndpoint(opts.Endpoint))
+		}
+		if opts.Insecure {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		if len(opts.Headers) > 0 {
+			options = append(options, otlptracehttp.WithHeaders(opts.Headers))
+		}
+		return otlptracehttp.New(ctx, options...)
+	}
+	var options []otlptracegrpc.Option
+	if opts.Endpoint != "" {
+		options = append(options, otlptracegrpc.WithEndpoint(opts.Endpoint))
+	}
+	if opts.Insecure {
+		options = append(options, otlptracegrpc.WithInsecure())
+	}
+	if len(opts.Headers) > 0 {
+		options = append(options, otlptracegrpc.WithHeaders(opts.Headers))
+	}
+	return otlptracegrpc.New(ctx, options...)
+}
+
+// Start starts a span of the gateway.
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentation).Start(ctx, name, opts...)
+}
+
+// StartUpstream starts the span of a call to upstream.
+func StartUpstream(ctx context.Context, upstream string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append(attrs, attribute.String("gateway.upstream", upstream))
+	return Start(ctx, "upstream", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+// End ends span, marking it failed with err, if any.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Extract returns ctx with the trace context sent by a caller in carrier.
+func Extract(ctx context.Context, carrier propagation.TextMapCarrier) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, carrier)
+}
+
+// Inject writes the trace context of ctx into carrier.
+func Inject(ctx context.Context, carrier propagation.TextMapCarrier) {
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+}
+
+// MetadataCarrier carries trace context in gRPC metadata.
+type MetadataCarrier metadata.MD
+
+func (c MetadataCarrier) Get(key string) string {
+	if values := metadata.MD(c).Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (c MetadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c MetadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// outgoingContext starts the span of a call to the upstream gRPC node target
+// and passes its trace context on in the call's metadata.
+func outgoingContext(ctx context.Context, target, method string) (context.Context, trace.Span) {
+	ctx, span := StartUpstream(ctx, target, attribute.String("rpc.method", method))
+	md, _ := metadata.FromOutgoingContext(ctx)
+	md = md.Copy()
+	Inject(ctx, MetadataCarrier(md))
+	return metadata.NewOutgoingContext(ctx, md), span
+}
+
+func endCall(span trace.Span, err error) {
+	span.SetAttributes(attribute.Int("rpc.grpc.status_code", int(status.Code(err))))
+	End(span, err)
+}
+
+// UnaryClientInterceptor traces the calls made to upstream gRPC nodes.
+func UnaryClientInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	ctx, span := outgoingContext(ctx, cc.Target(), method)
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	endCall(span, err)
+	return err
+}
+
+// StreamClientInterceptor traces the streams opened to upstream gRPC nodes,
+// until the upstream ends them or the caller gives up on them.
+func StreamClientInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	ctx, span := outgoingContext(ctx, cc.Target(), method)
+	stream, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		endCall(span, err)
+		return nil, err
+	}
+	traced := &tracedClientStream{ClientStream: stream, span: span}
+	go func() {
+		<-ctx.Done()
+		traced.end(ctx.Err())
+	}()
+	return traced, nil
+}
+
+type tracedClientStream struct {
+	grpc.ClientStream
+	span trace.Span
+	once sync.Once
+}
+
+func (s *tracedClientStream) RecvMsg(m any) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err == io.EOF {
+		s.end(nil)
+	} else if err != nil {
+		s.end(err)
+	}
+	return err
+}
+
+func (s *tracedClientStream) end(err error) {
+	s.once.Do(func() { endCall(s.span, err) })
+}
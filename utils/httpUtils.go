@@ -1,74 +1,248 @@
 package httpUtils
 
 import (
+	"bytes"
 	"context"
-	"log"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
 	"sync"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/decentrio/gateway/config"
+	"github.com/decentrio/gateway/health"
+	"github.com/decentrio/gateway/logging"
+	"github.com/decentrio/gateway/metrics"
+	"github.com/decentrio/gateway/tracing"
 )
 
-var sharedTransport = &http.Transport{
-	MaxIdleConns:          2000,
-	MaxIdleConnsPerHost:   2000,
-	IdleConnTimeout:       60 * time.Second,
-	TLSHandshakeTimeout:   5 * time.Second,
-	ExpectContinueTimeout: 1 * time.Second,
-	ForceAttemptHTTP2:     true,
+// NewTransport returns the transport upstreams are reached with by default.
+func NewTransport() *http.Transport {
+	return &http.Transport{
+		MaxIdleConns:          2000,
+		MaxIdleConnsPerHost:   2000,
+		IdleConnTimeout:       60 * time.Second,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		ForceAttemptHTTP2:     true,
+	}
+}
+
+// Client sends the HTTP requests of a gateway to its upstreams, recording
+// them in its metrics and health.
+type Client struct {
+	store   *config.Store
+	health  *health.Tracker
+	metrics *metrics.Metrics
+	log     *slog.Logger
+
+	sharedTransport *http.Transport
+	httpClient      *http.Client
+
+	// tlsTransports holds a copy of sharedTransport for each upstream host
+	// with its own TLS settings.
+	tlsTransports sync.Map // map[string]*http.Transport
+	proxyCache    sync.Map // map[proxyKey]*httputil.ReverseProxy
+}
+
+// NewClient returns a client reaching upstreams with transport, or a
+// NewTransport when nil. Upstreams with TLS settings of their own get a clone
+// of it.
+func NewClient(store *config.Store, tracker *health.Tracker, m *metrics.Metrics, logger *slog.Logger, transport *http.Transport) *Client {
+	if transport == nil {
+		transport = NewTransport()
+	}
+	return &Client{
+		store:           store,
+		health:          tracker,
+		metrics:         m,
+		log:             logger,
+		sharedTransport: transport,
+		httpClient: &http.Client{
+			Transport: transport,
+			Timeout:   0, // Không đặt timeout ở client nếu backend chậm
+		},
+	}
+}
+
+// upstream resolves destination to the URL and transport used to reach it,
+// applying the TLS settings configured for that endpoint.
+func (c *Client) upstream(destination string) (*url.URL, *http.Transport, error) {
+	target, err := url.Parse(destination)
+	if err != nil {
+		return nil, nil, err
+	}
+	settings := c.store.Get().EndpointTLS(destination)
+	if settings.Enable && target.Scheme == "http" {
+		target.Scheme = "https"
+	}
+	if target.Scheme != "https" || settings == (config.TLS{}) {
+		return target, c.sharedTransport, nil
+	}
+
+	if t, ok := c.tlsTransports.Load(target.Host); ok {
+		return target, t.(*http.Transport), nil
+	}
+	tlsConfig, err := settings.ClientConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	transport := c.sharedTransport.Clone()
+	transport.TLSClientConfig = tlsConfig
+	t, _ := c.tlsTransports.LoadOrStore(target.Host, transport)
+	return target, t.(*http.Transport), nil
+}
+
+func (c *Client) clientFor(transport *http.Transport) *http.Client {
+	if transport == c.sharedTransport {
+		return c.httpClient
+	}
+	return &http.Client{Transport: transport}
 }
 
-// init http.Client reuse globally
-var httpClient = &http.Client{
-	Transport: sharedTransport,
-	Timeout:   0, // Không đặt timeout ở client nếu backend chậm
+type proxyKey struct {
+	target    string
+	transport *http.Transport
 }
 
-var proxyCache = sync.Map{} // map[string]*httputil.ReverseProxy
-func getProxy(target *url.URL) *httputil.ReverseProxy {
-	key := target.Host
-	if p, ok := proxyCache.Load(key); ok {
+func (c *Client) getProxy(target *url.URL, transport *http.Transport) *httputil.ReverseProxy {
+	key := proxyKey{target: target.Scheme + "://" + target.Host, transport: transport}
+	if p, ok := c.proxyCache.Load(key); ok {
 		return p.(*httputil.ReverseProxy)
 	}
 	proxy := httputil.NewSingleHostReverseProxy(target)
-	proxy.Transport = sharedTransport
+	proxy.Transport = transport
 	proxy.Director = func(req *http.Request) {
 		req.URL.Scheme = target.Scheme
 		req.URL.Host = target.Host
 		req.Host = target.Host
+		tracing.Inject(req.Context(), propagation.HeaderCarrier(req.Header))
 	}
 	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
-		log.Printf("[proxy] error to %s: %v", target, err)
+		c.log.WarnContext(req.Context(), "Upstream request failed", "upstream", target.Host, "err", err)
+		if rec, ok := w.(*upstreamRecorder); ok {
+			rec.err = err
+		}
 		http.Error(w, "Upstream error", http.StatusBadGateway)
 	}
 	proxy.ModifyResponse = func(resp *http.Response) error {
 		resp.Header.Set("Cache-Control", "public, max-age=10")
 		return nil
 	}
-	proxyCache.Store(key, proxy)
+	c.proxyCache.Store(key, proxy)
 	return proxy
 }
 
-func FowardRequest(w http.ResponseWriter, r *http.Request, destination string) {
+// FlushCaches drops the reverse proxies and TLS transports kept for the
+// upstreams. They are built again, from the current settings, on next use.
+func (c *Client) FlushCaches() {
+	c.proxyCache.Clear()
+	c.tlsTransports.Range(func(host, t any) bool {
+		c.tlsTransports.Delete(host)
+		t.(*http.Transport).CloseIdleConnections()
+		return true
+	})
+}
+
+func (c *Client) FowardRequest(w http.ResponseWriter, r *http.Request, destination string) {
 	_, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
-	target, err := url.Parse(destination)
+	target, transport, err := c.upstream(destination)
 	if err != nil {
+		c.log.ErrorContext(r.Context(), "Invalid upstream", "upstream", destination, "err", err)
 		http.Error(w, "Invalid target", http.StatusInternalServerError)
 		return
 	}
-	proxy := getProxy(target)
-	proxy.ServeHTTP(w, r)
+	server := metrics.Server(r.Context())
+	if node := c.store.Get().NodeByEndpoint(destination); node != nil {
+		c.metrics.ObserveRoute(server, node.HeightRange(), target.Host)
+	}
+	logging.SetUpstream(r.Context(), target.Host)
 
+	proxy := c.getProxy(target, transport)
+	rec := &upstreamRecorder{StatusRecorder: metrics.StatusRecorder{ResponseWriter: w}}
+	ctx, span := tracing.StartUpstream(r.Context(), target.Host, attribute.String("url.path", r.URL.Path))
+	call := c.health.Begin(target.Host)
+	start := time.Now()
+	proxy.ServeHTTP(rec, r.WithContext(ctx))
+	status := strconv.Itoa(rec.Status)
+	if rec.err != nil {
+		status = "error"
+	}
+	c.metrics.ObserveUpstream(server, target.Host, status, time.Since(start))
+	call.Done(upstreamFailure(rec.Status, rec.err))
+	endUpstreamSpan(span, rec.Status, rec.err != nil)
+}
+
+// upstreamFailure returns what an upstream call counts as for the health of
+// the node: a failure when there was no response or the node said it is
+// unavailable. Calls given up by the client are not held against the node.
+func upstreamFailure(code int, err error) error {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return nil
+	case err != nil:
+		return err
+	case code == http.StatusBadGateway, code == http.StatusServiceUnavailable, code == http.StatusGatewayTimeout:
+		return fmt.Errorf("upstream answered %d %s", code, http.StatusText(code))
+	}
+	return nil
 }
 
-func CheckRequest(r *http.Request, node string) (*http.Response, error) {
+// endUpstreamSpan ends the span of an upstream call answered with code, or
+// that got no answer.
+func endUpstreamSpan(span trace.Span, code int, failed bool) {
+	if failed {
+		span.SetStatus(codes.Error, "no response")
+	} else {
+		span.SetAttributes(attribute.Int("http.response.status_code", code))
+		if code >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(code))
+		}
+	}
+	span.End()
+}
+
+// upstreamRecorder records the response of a proxied request, or why the
+// upstream failed to give one.
+type upstreamRecorder struct {
+	metrics.StatusRecorder
+	err error
+}
+
+// observeUpstream records a call made with client.Do. Upstreams are labelled
+// by host only, as their URLs may carry credentials.
+func (c *Client) observeUpstream(ctx context.Context, host string, res *http.Response, err error, start time.Time) {
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(res.StatusCode)
+	}
+	c.metrics.ObserveUpstream(metrics.Server(ctx), host, status, time.Since(start))
+}
+
+func responseFailure(res *http.Response, err error) error {
+	if err != nil {
+		return upstreamFailure(0, err)
+	}
+	return upstreamFailure(res.StatusCode, nil)
+}
+
+func (c *Client) CheckRequest(r *http.Request, node string) (*http.Response, error) {
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
-	new_target, err := url.Parse(node)
+	new_target, transport, err := c.upstream(node)
 	if err != nil {
 		return nil, err
 	}
@@ -76,16 +250,95 @@ func CheckRequest(r *http.Request, node string) (*http.Response, error) {
 	new_target.Path = r.URL.Path
 	new_target.RawQuery = r.URL.RawQuery
 
+	ctx, span := tracing.StartUpstream(ctx, new_target.Host, attribute.String("url.path", r.URL.Path))
 	req, err := http.NewRequestWithContext(ctx, r.Method, new_target.String(), r.Body)
 	if err != nil {
+		span.End()
 		return nil, err
 	}
 
 	req.Header = r.Header.Clone()
+	tracing.Inject(ctx, propagation.HeaderCarrier(req.Header))
 
-	res, err := httpClient.Do(req)
+	call := c.health.Begin(new_target.Host)
+	start := time.Now()
+	res, err := c.clientFor(transport).Do(req)
+	c.observeUpstream(r.Context(), new_target.Host, res, err, start)
+	call.Done(responseFailure(res, err))
 	if err != nil {
+		endUpstreamSpan(span, 0, true)
 		return nil, err
 	}
+	endUpstreamSpan(span, res.StatusCode, false)
 	return res, nil
 }
+
+// GetJSON sends a GET request for path to node and returns the response body.
+func (c *Client) GetJSON(ctx context.Context, node string, path string) ([]byte, error) {
+	target, transport, err := c.upstream(node)
+	if err != nil {
+		return nil, err
+	}
+	target = target.JoinPath(path)
+	ctx, span := tracing.StartUpstream(ctx, target.Host, attribute.String("url.path", target.Path))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		span.End()
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	tracing.Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	call := c.health.Begin(target.Host)
+	start := time.Now()
+	res, err := c.clientFor(transport).Do(req)
+	c.observeUpstream(ctx, target.Host, res, err, start)
+	call.Done(responseFailure(res, err))
+	if err != nil {
+		endUpstreamSpan(span, 0, true)
+		return nil, err
+	}
+	endUpstreamSpan(span, res.StatusCode, false)
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s from %s", res.Status, target.Host)
+	}
+	return io.ReadAll(res.Body)
+}
+
+// PostJSON sends body to node as a JSON POST request and returns the response body.
+func (c *Client) PostJSON(ctx context.Context, node string, body []byte) ([]byte, error) {
+	target, transport, err := c.upstream(node)
+	if err != nil {
+		return nil, err
+	}
+	ctx, span := tracing.StartUpstream(ctx, target.Host)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target.String(), bytes.NewReader(body))
+	if err != nil {
+		span.End()
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if r := logging.FromContext(ctx); r != nil {
+		req.Header.Set(logging.RequestIDHeader, r.ID)
+	}
+	tracing.Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	call := c.health.Begin(target.Host)
+	start := time.Now()
+	res, err := c.clientFor(transport).Do(req)
+	c.observeUpstream(ctx, target.Host, res, err, start)
+	call.Done(responseFailure(res, err))
+	if err != nil {
+		endUpstreamSpan(span, 0, true)
+		return nil, err
+	}
+	endUpstreamSpan(span, res.StatusCode, false)
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s from %s", res.Status, node)
+	}
+	return io.ReadAll(res.Body)
+}